@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+)
+
+type bodyLimitMiddleware struct {
+	limit int64
+	// routeLimits are the limits of specific routes, by path template or route
+	// name
+	routeLimits map[string]int64
+}
+
+type BodyLimitMiddlewareOption func(m *bodyLimitMiddleware)
+
+// WithRouteBodyLimit sets the limit of a route, identified by its path template
+// (e.g. /apps/{app_id}/deployments) or its name. A limit lower or equal to 0
+// disables the limit of the route.
+func WithRouteBodyLimit(route string, limit int64) BodyLimitMiddlewareOption {
+	return func(m *bodyLimitMiddleware) {
+		m.routeLimits[route] = limit
+	}
+}
+
+// NewBodyLimitMiddleware initializes a middleware limiting the size of the
+// request bodies to limit bytes. A request whose Content-Length exceeds the
+// limit is rejected before calling the handler. Otherwise, reading more than
+// the limit from the body returns a *PayloadTooLargeError. In both cases, the
+// ErrorMiddleware answers 413.
+func NewBodyLimitMiddleware(limit int64, options ...BodyLimitMiddlewareOption) Middleware {
+	m := &bodyLimitMiddleware{
+		limit:       limit,
+		routeLimits: map[string]int64{},
+	}
+	for _, opt := range options {
+		opt(m)
+	}
+	return m
+}
+
+func (m *bodyLimitMiddleware) Apply(next HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		limit := m.routeLimit(r)
+		if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+			return next(w, r, vars)
+		}
+		if r.ContentLength > limit {
+			// Close the connection rather than reading the oversized body, which
+			// would be needed to reuse it
+			w.Header().Set("Connection", "close")
+			return &PayloadTooLargeError{Limit: limit}
+		}
+
+		r.Body = &limitedBody{
+			ReadCloser: http.MaxBytesReader(w, r.Body, limit),
+			header:     w.Header(),
+			limit:      limit,
+		}
+		return next(w, r, vars)
+	}
+}
+
+func (m *bodyLimitMiddleware) routeLimit(r *http.Request) int64 {
+	if len(m.routeLimits) == 0 {
+		return m.limit
+	}
+	template, name := currentRoute(r)
+	if limit, ok := m.routeLimits[template]; ok && template != "" {
+		return limit
+	}
+	if limit, ok := m.routeLimits[name]; ok && name != "" {
+		return limit
+	}
+	return m.limit
+}
+
+// limitedBody replaces the error of http.MaxBytesReader by a
+// *PayloadTooLargeError, which is mapped to 413 by the ErrorMiddleware. It sets
+// the Connection: close header so that the server closes the connection instead
+// of reading the remaining of the body: http.MaxBytesReader only does it when
+// it is given the response writer of the server, not a wrapped one.
+type limitedBody struct {
+	io.ReadCloser
+	header http.Header
+	limit  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxBytesError *http.MaxBytesError
+	if err != nil && errors.As(err, &maxBytesError) {
+		b.header.Set("Connection", "close")
+		return n, &PayloadTooLargeError{Limit: b.limit}
+	}
+	return n, err
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+)
+
+func TestNewBodyLimitMiddleware(t *testing.T) {
+	decodeHandler := func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		var payload map[string]string
+		err := json.NewDecoder(r.Body).Decode(&payload)
+		if err != nil {
+			return errors.Wrap(r.Context(), err, "decode payload")
+		}
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}
+
+	examples := map[string]struct {
+		options            []BodyLimitMiddlewareOption
+		path               string
+		body               string
+		chunked            bool
+		expectedStatusCode int
+		expectedBody       string
+		expectHandlerCall  bool
+	}{
+		"it should accept a body under the limit": {
+			path:               "/apps",
+			body:               `{"name":"app"}`,
+			expectedStatusCode: http.StatusCreated,
+			expectHandlerCall:  true,
+		},
+		"it should reject a Content-Length over the limit before calling the handler": {
+			path:               "/apps",
+			body:               `{"name":"my-application"}`,
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+			expectedBody:       "request body is too large, the limit is 16 bytes\n",
+		},
+		"it should reject a chunked body when the limit is exceeded while reading": {
+			path:               "/apps",
+			body:               `{"name":"my-application"}`,
+			chunked:            true,
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+			expectedBody:       "decode payload: request body is too large, the limit is 16 bytes\n",
+			expectHandlerCall:  true,
+		},
+		"it should apply the limit of the route template": {
+			options:            []BodyLimitMiddlewareOption{WithRouteBodyLimit("/apps/{app}/files", 1024)},
+			path:               "/apps/my-app/files",
+			body:               `{"name":"my-application"}`,
+			expectedStatusCode: http.StatusCreated,
+			expectHandlerCall:  true,
+		},
+		"it should apply the limit of the route name": {
+			options:            []BodyLimitMiddlewareOption{WithRouteBodyLimit("create-app", 4)},
+			path:               "/apps",
+			body:               `{"name":"app"}`,
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+			expectedBody:       "request body is too large, the limit is 4 bytes\n",
+		},
+		"it should disable the limit of a route": {
+			options:            []BodyLimitMiddlewareOption{WithRouteBodyLimit("/apps/{app}/files", 0)},
+			path:               "/apps/my-app/files",
+			body:               `{"name":"` + strings.Repeat("a", 1024) + `"}`,
+			chunked:            true,
+			expectedStatusCode: http.StatusCreated,
+			expectHandlerCall:  true,
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			log, _ := test.NewNullLogger()
+			router := NewRouter(log, WithoutOtelInstrumentation())
+			router.Use(ErrorMiddleware)
+			router.Use(NewBodyLimitMiddleware(16, example.options...))
+
+			handlerCalled := false
+			handler := func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				handlerCalled = true
+				return decodeHandler(w, r, vars)
+			}
+			router.HandleFunc("/apps", handler).Methods(http.MethodPost).Name("create-app")
+			router.HandleFunc("/apps/{app}/files", handler).Methods(http.MethodPost)
+
+			var body io.Reader = strings.NewReader(example.body)
+			if example.chunked {
+				// Hide the length of the body
+				body = io.MultiReader(body)
+			}
+			r := httptest.NewRequest(http.MethodPost, example.path, body)
+			if example.chunked {
+				r.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, example.expectedStatusCode, w.Code)
+			assert.Equal(t, example.expectHandlerCall, handlerCalled)
+			if example.expectedBody != "" {
+				assert.Equal(t, example.expectedBody, w.Body.String())
+			}
+			if example.expectedStatusCode == http.StatusRequestEntityTooLarge {
+				assert.Equal(t, "close", w.Header().Get("Connection"))
+			} else {
+				assert.Empty(t, w.Header().Get("Connection"))
+			}
+		})
+	}
+}
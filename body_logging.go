@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const bodyLoggingDefaultMaxSize = 4096
+
+var bodyLoggingDefaultContentTypes = []string{
+	"application/json", "+json", "text/*", "application/xml", "+xml",
+}
+
+type bodyLogging struct {
+	// maxSize is the maximum number of bytes logged per body
+	maxSize int
+	// contentTypes are the media types of the logged bodies, matched like the
+	// content types of the compression middleware
+	contentTypes []string
+	// redactedFields are the key paths of the redacted JSON fields
+	redactedFields [][]string
+	// routes are the path templates or names of the routes whose bodies are
+	// always logged
+	routes     map[string]bool
+	sampleRate float64
+	// random is overridden in tests
+	random func() float64
+}
+
+type BodyLoggingOption func(b *bodyLogging)
+
+// WithBodyLoggingMaxSize sets the maximum number of bytes logged per body (4KiB
+// by default). The longer bodies are truncated.
+func WithBodyLoggingMaxSize(size int) BodyLoggingOption {
+	return func(b *bodyLogging) {
+		b.maxSize = size
+	}
+}
+
+// WithBodyLoggingContentTypes sets the media types of the logged bodies
+// (application/json, +json, text/*, application/xml and +xml by default). A
+// value ending with "/*" matches any subtype, and a value starting with "+"
+// matches any media type with this suffix.
+func WithBodyLoggingContentTypes(contentTypes ...string) BodyLoggingOption {
+	return func(b *bodyLogging) {
+		b.contentTypes = nil
+		for _, contentType := range contentTypes {
+			b.contentTypes = append(b.contentTypes, strings.ToLower(contentType))
+		}
+	}
+}
+
+// WithBodyLoggingRedactedFields replaces the value of the JSON fields at the
+// given key paths, e.g. "password" or "user.api_token". The paths start at the
+// root of the document, the arrays are traversed and "*" matches any key. The
+// keys are case insensitive. The bodies are redacted whatever their media type,
+// and the bodies which are not valid JSON or are truncated cannot be redacted
+// and are not logged.
+func WithBodyLoggingRedactedFields(paths ...string) BodyLoggingOption {
+	return func(b *bodyLogging) {
+		for _, path := range paths {
+			b.redactedFields = append(b.redactedFields, strings.Split(path, "."))
+		}
+	}
+}
+
+// WithBodyLoggingRoutes logs the bodies of the given routes, identified by
+// their path template (e.g. /apps/{app_id}) or their name
+func WithBodyLoggingRoutes(routes ...string) BodyLoggingOption {
+	return func(b *bodyLogging) {
+		if b.routes == nil {
+			b.routes = map[string]bool{}
+		}
+		for _, route := range routes {
+			b.routes[route] = true
+		}
+	}
+}
+
+// WithBodyLoggingSampleRate logs the bodies of a ratio of the requests, between
+// 0 and 1
+func WithBodyLoggingSampleRate(rate float64) BodyLoggingOption {
+	return func(b *bodyLogging) {
+		b.sampleRate = rate
+	}
+}
+
+// WithBodyLogging adds the request and response bodies to the request completed
+// log, in the request_body and response_body fields. Only the bodies read by
+// the handler, of an allowed media type and without Content-Encoding are
+// logged.
+//
+// The bodies of all the requests are logged, unless WithBodyLoggingRoutes or
+// WithBodyLoggingSampleRate restrict the logging to some routes or to a sample
+// of the requests. The bodies can contain personal data or secrets: this mode
+// is meant for debugging.
+func WithBodyLogging(options ...BodyLoggingOption) LoggingMiddlewareOption {
+	return func(l *LoggingMiddleware) {
+		b := &bodyLogging{
+			maxSize:      bodyLoggingDefaultMaxSize,
+			contentTypes: bodyLoggingDefaultContentTypes,
+			random:       rand.Float64,
+		}
+		for _, opt := range options {
+			opt(b)
+		}
+		l.bodyLogging = b
+	}
+}
+
+func (b *bodyLogging) isEnabled(r *http.Request) bool {
+	if len(b.routes) == 0 && b.sampleRate <= 0 {
+		return true
+	}
+	template, name := currentRoute(r)
+	if (template != "" && b.routes[template]) || (name != "" && b.routes[name]) {
+		return true
+	}
+	return b.sampleRate > 0 && b.random() < b.sampleRate
+}
+
+// capture replaces the body of the request and the response writer to capture
+// the bodies. The headers describing the request body are read before the
+// handler, since an inner middleware like the DecompressionMiddleware can
+// remove them once it has decoded the body.
+func (b *bodyLogging) capture(w http.ResponseWriter, r *http.Request) (*bodyCaptureWriter, *bodyCaptureReader) {
+	var reader *bodyCaptureReader
+	if r.Body != nil && r.Body != http.NoBody {
+		reader = &bodyCaptureReader{
+			ReadCloser:      r.Body,
+			buffer:          limitedBuffer{max: b.maxSize},
+			contentEncoding: r.Header.Get("Content-Encoding"),
+			contentType:     r.Header.Get("Content-Type"),
+		}
+		r.Body = reader
+	}
+	writer := &bodyCaptureWriter{ResponseWriter: w, buffer: limitedBuffer{max: b.maxSize}}
+	return writer, reader
+}
+
+// fields returns the log fields of the captured bodies
+func (b *bodyLogging) fields(writer *bodyCaptureWriter, reader *bodyCaptureReader) logrus.Fields {
+	fields := logrus.Fields{}
+	if reader != nil {
+		b.addBodyFields(fields, "request_body", reader.contentEncoding, reader.contentType, &reader.buffer)
+	}
+	header := writer.Header()
+	b.addBodyFields(fields, "response_body", header.Get("Content-Encoding"), header.Get("Content-Type"), &writer.buffer)
+	return fields
+}
+
+func (b *bodyLogging) addBodyFields(fields logrus.Fields, name, encoding, contentType string, buffer *limitedBuffer) {
+	if buffer.Len() == 0 {
+		return
+	}
+	if encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return
+	}
+	if !matchMediaType(b.contentTypes, contentType) {
+		return
+	}
+	if buffer.truncated {
+		fields[name+"_truncated"] = true
+	}
+
+	if len(b.redactedFields) == 0 {
+		fields[name] = buffer.String()
+		return
+	}
+	// The handlers can decode JSON whatever the declared media type, so any body
+	// is redacted as JSON, and the bodies which cannot be redacted are not logged
+	if buffer.truncated {
+		return
+	}
+	body, err := b.redactJSON(buffer.Bytes())
+	if err != nil {
+		return
+	}
+	fields[name] = string(body)
+}
+
+func (b *bodyLogging) redactJSON(body []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// Keep the numbers as they are
+	decoder.UseNumber()
+	var document any
+	err := decoder.Decode(&document)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range b.redactedFields {
+		redactJSONPath(document, path)
+	}
+	return json.Marshal(document)
+}
+
+func redactJSONPath(value any, path []string) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if path[0] != "*" && !strings.EqualFold(path[0], key) {
+				continue
+			}
+			if len(path) == 1 {
+				v[key] = "REDACTED"
+				continue
+			}
+			redactJSONPath(child, path[1:])
+		}
+	case []any:
+		for _, item := range v {
+			redactJSONPath(item, path)
+		}
+	}
+}
+
+// limitedBuffer keeps the first max bytes written
+type limitedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if remaining := b.max - b.Len(); n > remaining {
+		b.truncated = true
+		p = p[:max(remaining, 0)]
+	}
+	b.Buffer.Write(p)
+	return n, nil
+}
+
+// bodyCaptureReader captures the request body read by the handler
+type bodyCaptureReader struct {
+	io.ReadCloser
+	buffer limitedBuffer
+	// contentEncoding and contentType are the headers of the request when it was
+	// received
+	contentEncoding string
+	contentType     string
+}
+
+func (cr *bodyCaptureReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	_, _ = cr.buffer.Write(p[:n])
+	return n, err
+}
+
+// bodyCaptureWriter captures the response body written by the handler
+type bodyCaptureWriter struct {
+	http.ResponseWriter
+	buffer limitedBuffer
+}
+
+func (cw *bodyCaptureWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	_, _ = cw.buffer.Write(b[:n])
+	return n, err
+}
+
+func (cw *bodyCaptureWriter) Flush() {
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (cw *bodyCaptureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap is used by http.ResponseController
+func (cw *bodyCaptureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggingMiddleware_BodyLogging(t *testing.T) {
+	examples := map[string]struct {
+		options             []BodyLoggingOption
+		path                string
+		requestHeaders      map[string]string
+		requestBody         string
+		responseContentType string
+		responseBody        string
+		expectedFields      map[string]any
+		expectedMissing     []string
+	}{
+		"it should log the request and response bodies": {
+			requestBody:  `{"name":"my-app"}`,
+			responseBody: `{"id":"app-1"}`,
+			expectedFields: map[string]any{
+				"request_body":  `{"name":"my-app"}`,
+				"response_body": `{"id":"app-1"}`,
+			},
+		},
+		"it should truncate the bodies longer than the maximum size": {
+			options:             []BodyLoggingOption{WithBodyLoggingMaxSize(4)},
+			requestHeaders:      map[string]string{"Content-Type": "text/plain"},
+			requestBody:         "request body",
+			responseContentType: "text/plain",
+			responseBody:        "response body",
+			expectedFields: map[string]any{
+				"request_body":            "requ",
+				"request_body_truncated":  true,
+				"response_body":           "resp",
+				"response_body_truncated": true,
+			},
+		},
+		"it should not log the bodies of other media types": {
+			requestHeaders:      map[string]string{"Content-Type": "application/octet-stream"},
+			requestBody:         "binary",
+			responseContentType: "image/png",
+			responseBody:        "image",
+			expectedMissing:     []string{"request_body", "response_body"},
+		},
+		"it should log the bodies of the allowed media types": {
+			options:             []BodyLoggingOption{WithBodyLoggingContentTypes("application/octet-stream")},
+			requestHeaders:      map[string]string{"Content-Type": "application/octet-stream"},
+			requestBody:         "binary",
+			responseContentType: "application/json",
+			responseBody:        `{"id":"app-1"}`,
+			expectedFields:      map[string]any{"request_body": "binary"},
+			expectedMissing:     []string{"response_body"},
+		},
+		"it should not log the encoded bodies": {
+			requestHeaders:  map[string]string{"Content-Encoding": "gzip"},
+			requestBody:     `{"name":"my-app"}`,
+			responseBody:    `{"id":"app-1"}`,
+			expectedFields:  map[string]any{"response_body": `{"id":"app-1"}`},
+			expectedMissing: []string{"request_body"},
+		},
+		"it should redact the JSON fields": {
+			options:     []BodyLoggingOption{WithBodyLoggingRedactedFields("password", "user.api_token", "tokens.*")},
+			requestBody: `{"password":"secret","user":{"name":"biniou","API_TOKEN":"tk-1","password":"kept"},"tokens":[{"a":"tk-2"},{"b":"tk-3"}],"count":12345678901234567890}`,
+			expectedFields: map[string]any{
+				"request_body": `{"count":12345678901234567890,"password":"REDACTED","tokens":[{"a":"REDACTED"},{"b":"REDACTED"}],"user":{"API_TOKEN":"REDACTED","name":"biniou","password":"kept"}}`,
+			},
+		},
+		"it should not log a truncated JSON body which cannot be redacted": {
+			options:         []BodyLoggingOption{WithBodyLoggingRedactedFields("password"), WithBodyLoggingMaxSize(10)},
+			requestBody:     `{"password":"secret"}`,
+			expectedFields:  map[string]any{"request_body_truncated": true},
+			expectedMissing: []string{"request_body"},
+		},
+		"it should not log an invalid JSON body which cannot be redacted": {
+			options:         []BodyLoggingOption{WithBodyLoggingRedactedFields("password")},
+			requestBody:     `{"password":`,
+			expectedMissing: []string{"request_body"},
+		},
+		"it should redact the JSON fields of a body of another media type": {
+			options:        []BodyLoggingOption{WithBodyLoggingRedactedFields("password")},
+			requestHeaders: map[string]string{"Content-Type": "text/plain"},
+			requestBody:    `{"password":"secret"}`,
+			expectedFields: map[string]any{"request_body": `{"password":"REDACTED"}`},
+		},
+		"it should not log a body which is not JSON if fields are redacted": {
+			options:             []BodyLoggingOption{WithBodyLoggingRedactedFields("password")},
+			requestHeaders:      map[string]string{"Content-Type": "application/xml"},
+			requestBody:         `<password>secret</password>`,
+			responseContentType: "text/plain",
+			responseBody:        "password=secret",
+			expectedMissing:     []string{"request_body", "response_body"},
+		},
+		"it should log the bodies of the selected routes": {
+			options:        []BodyLoggingOption{WithBodyLoggingRoutes("/apps/{app}")},
+			path:           "/apps/my-app",
+			requestBody:    `{"name":"my-app"}`,
+			expectedFields: map[string]any{"request_body": `{"name":"my-app"}`},
+		},
+		"it should not log the bodies of the other routes": {
+			options:         []BodyLoggingOption{WithBodyLoggingRoutes("/apps/{app}")},
+			requestBody:     `{"name":"my-app"}`,
+			expectedMissing: []string{"request_body", "response_body"},
+		},
+		"it should log the bodies of the sampled requests": {
+			options:        []BodyLoggingOption{WithBodyLoggingSampleRate(1)},
+			requestBody:    `{"name":"my-app"}`,
+			expectedFields: map[string]any{"request_body": `{"name":"my-app"}`},
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			log, hook := test.NewNullLogger()
+			router := NewRouter(log, WithoutOtelInstrumentation(), WithLoggingOptions(WithBodyLogging(example.options...)))
+			handler := func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				_, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+
+				contentType := example.responseContentType
+				if contentType == "" {
+					contentType = "application/json"
+				}
+				w.Header().Set("Content-Type", contentType)
+				_, err = w.Write([]byte(example.responseBody))
+				return err
+			}
+			router.HandleFunc("/apps", handler)
+			router.HandleFunc("/apps/{app}", handler)
+
+			path := example.path
+			if path == "" {
+				path = "/apps"
+			}
+			r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(example.requestBody))
+			r.Header.Set("Content-Type", "application/json")
+			for name, value := range example.requestHeaders {
+				r.Header.Set(name, value)
+			}
+			router.ServeHTTP(httptest.NewRecorder(), r)
+
+			entry := hook.LastEntry()
+			require.NotNil(t, entry)
+			require.Equal(t, "request completed", entry.Message)
+			for field, value := range example.expectedFields {
+				assert.Equal(t, value, entry.Data[field], field)
+			}
+			for _, field := range example.expectedMissing {
+				assert.NotContains(t, entry.Data, field)
+			}
+		})
+	}
+}
+
+func TestLoggingMiddleware_BodyLoggingDecompression(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	router := NewRouter(log, WithoutOtelInstrumentation(), WithLoggingOptions(WithBodyLogging(WithBodyLoggingRedactedFields("password"))))
+	router.Use(NewDecompressionMiddleware())
+	router.HandleFunc("/apps", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"password":"secret"}`, string(body))
+		return nil
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/apps", bytes.NewReader(compress(t, "gzip", []byte(`{"password":"secret"}`))))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Encoding", "gzip")
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	require.Equal(t, "request completed", entry.Message)
+	// The encoded body read from the connection is neither logged nor redacted
+	assert.NotContains(t, entry.Data, "request_body")
+	for _, entry := range hook.AllEntries() {
+		line, err := entry.String()
+		require.NoError(t, err)
+		assert.NotContains(t, line, "secret")
+	}
+}
+
+func TestBodyLogging_isEnabled(t *testing.T) {
+	b := &bodyLogging{sampleRate: 0.5}
+	r := httptest.NewRequest(http.MethodGet, "/apps", nil)
+
+	b.random = func() float64 { return 0.2 }
+	assert.True(t, b.isEnabled(r))
+	b.random = func() float64 { return 0.7 }
+	assert.False(t, b.isEnabled(r))
+}
@@ -0,0 +1,460 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+	"github.com/Scalingo/go-utils/logger"
+)
+
+const cacheDefaultMaxBodySize = 1 << 20
+
+// cacheableStatusCodes are the status codes cacheable by default (RFC 9110
+// section 15.1)
+var cacheableStatusCodes = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+type cacheMiddleware struct {
+	store CacheStore
+	// defaultTTL is the time to live of the responses without explicit
+	// freshness
+	defaultTTL time.Duration
+	// routeTTLs are the default TTLs of specific routes, by path template or
+	// route name
+	routeTTLs   map[string]time.Duration
+	maxBodySize int
+
+	// calls are the requests being handled, by cache key, on which the
+	// concurrent misses wait
+	callsMutex sync.Mutex
+	calls      map[string]*cacheCall
+}
+
+// cacheCall is a request whose response is awaited by concurrent requests with
+// the same cache key
+type cacheCall struct {
+	done       chan struct{}
+	variantKey string
+	// response is nil if the response cannot be shared
+	response *CachedResponse
+}
+
+type CacheMiddlewareOption func(m *cacheMiddleware)
+
+// WithCacheStore sets the store of the responses (a MemoryCacheStore of 1000
+// entries by default)
+func WithCacheStore(store CacheStore) CacheMiddlewareOption {
+	return func(m *cacheMiddleware) {
+		m.store = store
+	}
+}
+
+// WithCacheDefaultTTL caches the responses without Cache-Control max-age,
+// s-maxage or Expires header during ttl. By default, these responses are not
+// cached.
+func WithCacheDefaultTTL(ttl time.Duration) CacheMiddlewareOption {
+	return func(m *cacheMiddleware) {
+		m.defaultTTL = ttl
+	}
+}
+
+// WithRouteCacheTTL sets the default TTL of a route, identified by its path
+// template (e.g. /apps/{app_id}/deployments) or its name
+func WithRouteCacheTTL(route string, ttl time.Duration) CacheMiddlewareOption {
+	return func(m *cacheMiddleware) {
+		m.routeTTLs[route] = ttl
+	}
+}
+
+// WithCacheMaxBodySize sets the maximum size in bytes of the cached response
+// bodies (1MiB by default)
+func WithCacheMaxBodySize(size int) CacheMiddlewareOption {
+	return func(m *cacheMiddleware) {
+		m.maxBodySize = size
+	}
+}
+
+// NewCacheMiddleware initializes a middleware caching the responses to the GET
+// requests, as a shared cache following the Cache-Control semantics (RFC
+// 9111). The responses are keyed by path, query and the request headers listed
+// in their Vary header. The concurrent requests missing the same key wait for
+// the first one to complete instead of calling the handler.
+//
+// The X-Cache header of the responses is HIT or MISS, and the Age header of the
+// cached responses is their age in seconds. The store errors are logged and the
+// request is handled as a miss.
+func NewCacheMiddleware(options ...CacheMiddlewareOption) Middleware {
+	m := &cacheMiddleware{
+		routeTTLs:   map[string]time.Duration{},
+		maxBodySize: cacheDefaultMaxBodySize,
+		calls:       map[string]*cacheCall{},
+	}
+	for _, opt := range options {
+		opt(m)
+	}
+	if m.store == nil {
+		m.store = NewMemoryCacheStore(cacheDefaultMaxEntries)
+	}
+	return m
+}
+
+func (m *cacheMiddleware) Apply(next HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		if r.Method != http.MethodGet {
+			return next(w, r, vars)
+		}
+		directives := parseCacheControl(r.Header.Values("Cache-Control"))
+		if _, ok := directives["no-store"]; ok {
+			return next(w, r, vars)
+		}
+
+		key := cacheKey(r)
+		if _, ok := directives["no-cache"]; !ok {
+			response := m.lookup(r, key)
+			if response != nil && isFreshEnough(response, directives) {
+				serveCachedResponse(w, response)
+				return nil
+			}
+		}
+		if _, ok := directives["only-if-cached"]; ok {
+			w.Header().Set("X-Cache", "MISS")
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return nil
+		}
+
+		call, leader := m.startCall(key)
+		if !leader {
+			select {
+			case <-call.done:
+			case <-r.Context().Done():
+				err := r.Context().Err()
+				if errors.Is(err, context.Canceled) {
+					// The client is gone, this is not an error of the service
+					return ClientClosedRequestError{}
+				}
+				return errors.Wrap(r.Context(), err, "wait for the response of a concurrent request")
+			}
+			if call.response != nil && variantKey(key, call.response.Vary, r) == call.variantKey {
+				serveCachedResponse(w, call.response)
+				return nil
+			}
+		}
+
+		var response *CachedResponse
+		if leader {
+			defer func() {
+				m.endCall(r, key, call, response)
+			}()
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		cw := newCacheWriter(w, m.maxBodySize)
+		err := next(cw, r, vars)
+		if err != nil {
+			return err
+		}
+		response = m.storableResponse(r, cw)
+		if response == nil {
+			return nil
+		}
+		m.save(r, key, response)
+		return nil
+	}
+}
+
+// lookup returns the response cached for the request, following the Vary
+// header of the response
+func (m *cacheMiddleware) lookup(r *http.Request, key string) *CachedResponse {
+	response, err := m.store.Get(r.Context(), key)
+	if err != nil {
+		logger.Get(r.Context()).WithError(err).Error("Fail to get cached response")
+		return nil
+	}
+	if response == nil || response.StatusCode != 0 {
+		return response
+	}
+	// An entry without status code only lists the Vary headers of the
+	// responses cached for the key
+	response, err = m.store.Get(r.Context(), variantKey(key, response.Vary, r))
+	if err != nil {
+		logger.Get(r.Context()).WithError(err).Error("Fail to get cached response")
+		return nil
+	}
+	return response
+}
+
+func (m *cacheMiddleware) save(r *http.Request, key string, response *CachedResponse) {
+	var err error
+	if len(response.Vary) == 0 {
+		err = m.store.Set(r.Context(), key, response)
+	} else {
+		err = m.store.Set(r.Context(), key, &CachedResponse{Vary: response.Vary, StoredAt: response.StoredAt, ExpiresAt: response.ExpiresAt})
+		if err == nil {
+			err = m.store.Set(r.Context(), variantKey(key, response.Vary, r), response)
+		}
+	}
+	if err != nil {
+		logger.Get(r.Context()).WithError(err).Error("Fail to store cached response")
+	}
+}
+
+func (m *cacheMiddleware) startCall(key string) (*cacheCall, bool) {
+	m.callsMutex.Lock()
+	defer m.callsMutex.Unlock()
+	if call, ok := m.calls[key]; ok {
+		return call, false
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	m.calls[key] = call
+	return call, true
+}
+
+// endCall shares the response with the waiting requests. It is called even if
+// the handler panics.
+func (m *cacheMiddleware) endCall(r *http.Request, key string, call *cacheCall, response *CachedResponse) {
+	m.callsMutex.Lock()
+	delete(m.calls, key)
+	m.callsMutex.Unlock()
+	if response != nil {
+		call.response = response
+		call.variantKey = variantKey(key, response.Vary, r)
+	}
+	close(call.done)
+}
+
+// storableResponse returns the response to store, or nil if it cannot be
+// stored
+func (m *cacheMiddleware) storableResponse(r *http.Request, cw *cacheWriter) *CachedResponse {
+	if cw.tooLarge || !cacheableStatusCodes[cw.statusCode] {
+		return nil
+	}
+	header := cw.header
+	if header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	directives := parseCacheControl(header.Values("Cache-Control"))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return nil
+		}
+	}
+	// A shared cache only stores the responses to authenticated requests
+	// explicitly allowed to be shared (RFC 9111 section 3.5)
+	if r.Header.Get("Authorization") != "" {
+		_, public := directives["public"]
+		_, sMaxAge := directives["s-maxage"]
+		_, mustRevalidate := directives["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return nil
+		}
+	}
+
+	var vary []string
+	for _, name := range splitHeaderValues(header.Values("Vary")) {
+		if name == "*" {
+			return nil
+		}
+		vary = append(vary, http.CanonicalHeaderKey(name))
+	}
+	sort.Strings(vary)
+	vary = slices.Compact(vary)
+
+	now := time.Now()
+	ttl, ok := m.ttl(r, header, directives, now)
+	if !ok || ttl <= 0 {
+		return nil
+	}
+	return &CachedResponse{
+		StatusCode: cw.statusCode,
+		Header:     cw.handlerHeader(),
+		Body:       cw.body.Bytes(),
+		Vary:       vary,
+		StoredAt:   now,
+		ExpiresAt:  now.Add(ttl),
+	}
+}
+
+// ttl returns the freshness lifetime of the response (RFC 9111 section 4.2.1)
+func (m *cacheMiddleware) ttl(r *http.Request, header http.Header, directives map[string]string, now time.Time) (time.Duration, bool) {
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		value, ok := directives[directive]
+		if !ok {
+			continue
+		}
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		date, ok := parseHTTPDate(expires)
+		if !ok {
+			// An invalid date represents a time in the past
+			return 0, false
+		}
+		return date.Sub(now), true
+	}
+
+	if len(m.routeTTLs) > 0 {
+		template, name := currentRoute(r)
+		if ttl, ok := m.routeTTLs[template]; ok && template != "" {
+			return ttl, true
+		}
+		if ttl, ok := m.routeTTLs[name]; ok && name != "" {
+			return ttl, true
+		}
+	}
+	return m.defaultTTL, true
+}
+
+// isFreshEnough returns false if the request asks for a fresher response with
+// the max-age directive
+func isFreshEnough(response *CachedResponse, directives map[string]string) bool {
+	value, ok := directives["max-age"]
+	if !ok {
+		return true
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return false
+	}
+	return time.Since(response.StoredAt) <= time.Duration(seconds)*time.Second
+}
+
+func serveCachedResponse(w http.ResponseWriter, response *CachedResponse) {
+	header := w.Header()
+	for name, values := range response.Header {
+		header[name] = slices.Clone(values)
+	}
+	header.Set("Age", strconv.Itoa(int(time.Since(response.StoredAt).Seconds())))
+	header.Set("X-Cache", "HIT")
+	w.WriteHeader(response.StatusCode)
+	_, _ = w.Write(response.Body)
+}
+
+// cacheKey identifies the responses to the requests with the same path and
+// query. The query parameters are sorted.
+func cacheKey(r *http.Request) string {
+	return r.Method + " " + r.Host + r.URL.Path + "?" + r.URL.Query().Encode()
+}
+
+// variantKey identifies the responses to the requests with the same key and the
+// same values of the vary headers
+func variantKey(key string, vary []string, r *http.Request) string {
+	if len(vary) == 0 {
+		return key
+	}
+	var builder strings.Builder
+	builder.WriteString(key)
+	for _, name := range vary {
+		builder.WriteString("|" + name + "=" + strings.Join(r.Header.Values(name), ","))
+	}
+	return builder.String()
+}
+
+// parseCacheControl returns the directives of the Cache-Control header, by
+// lower case name
+func parseCacheControl(values []string) map[string]string {
+	directives := map[string]string{}
+	for _, value := range splitHeaderValues(values) {
+		name, argument, _ := strings.Cut(value, "=")
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(argument), `"`)
+	}
+	return directives
+}
+
+// cacheWriter writes the response and keeps a copy of it
+type cacheWriter struct {
+	http.ResponseWriter
+	// initialHeader are the headers set before calling the handler, e.g. by the
+	// request ID middleware, which are not cached
+	initialHeader http.Header
+	maxBodySize   int
+
+	statusCode int
+	header     http.Header
+	body       bytes.Buffer
+	tooLarge   bool
+}
+
+func newCacheWriter(w http.ResponseWriter, maxBodySize int) *cacheWriter {
+	return &cacheWriter{
+		ResponseWriter: w,
+		initialHeader:  w.Header().Clone(),
+		maxBodySize:    maxBodySize,
+	}
+}
+
+func (cw *cacheWriter) WriteHeader(statusCode int) {
+	if cw.statusCode == 0 && (statusCode >= 200 || statusCode == http.StatusSwitchingProtocols) {
+		cw.statusCode = statusCode
+		cw.header = cw.Header().Clone()
+	}
+	cw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if cw.statusCode == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	n, err := cw.ResponseWriter.Write(b)
+	if !cw.tooLarge {
+		cw.body.Write(b[:n])
+		if cw.body.Len() > cw.maxBodySize {
+			cw.tooLarge = true
+			cw.body = bytes.Buffer{}
+		}
+	}
+	return n, err
+}
+
+func (cw *cacheWriter) Flush() {
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		if cw.statusCode == 0 {
+			cw.WriteHeader(http.StatusOK)
+		}
+		flusher.Flush()
+	}
+}
+
+// Unwrap is used by http.ResponseController
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// handlerHeader returns the headers set or modified by the handler
+func (cw *cacheWriter) handlerHeader() http.Header {
+	written := cw.header
+	if written == nil {
+		// The handler did not write anything
+		written = cw.Header()
+	}
+	header := http.Header{}
+	for name, values := range written {
+		if initial, ok := cw.initialHeader[name]; ok && slices.Equal(initial, values) {
+			continue
+		}
+		header[name] = values
+	}
+	return header
+}
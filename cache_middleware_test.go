@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheMiddleware(t *testing.T) {
+	type request struct {
+		path          string
+		headers       map[string]string
+		expectedCache string
+		expectedBody  string
+	}
+
+	examples := map[string]struct {
+		options        []CacheMiddlewareOption
+		responseHeader map[string]string
+		statusCode     int
+		requests       []request
+	}{
+		"it should cache a response with max-age": {
+			responseHeader: map[string]string{"Cache-Control": "max-age=60"},
+			requests: []request{
+				{expectedCache: "MISS", expectedBody: "response 1"},
+				{expectedCache: "HIT", expectedBody: "response 1"},
+			},
+		},
+		"it should cache a response with s-maxage": {
+			responseHeader: map[string]string{"Cache-Control": "s-maxage=60"},
+			requests: []request{
+				{expectedCache: "MISS", expectedBody: "response 1"},
+				{expectedCache: "HIT", expectedBody: "response 1"},
+			},
+		},
+		"it should not cache a response without freshness": {
+			requests: []request{
+				{expectedCache: "MISS", expectedBody: "response 1"},
+				{expectedCache: "MISS", expectedBody: "response 2"},
+			},
+		},
+		"it should cache a response without freshness with the default TTL": {
+			options: []CacheMiddlewareOption{WithCacheDefaultTTL(time.Minute)},
+			requests: []request{
+				{expectedCache: "MISS", expectedBody: "response 1"},
+				{expectedCache: "HIT", expectedBody: "response 1"},
+			},
+		},
+		"it should use the default TTL of the route": {
+			options: []CacheMiddlewareOption{WithRouteCacheTTL("/apps/{app}", time.Minute)},
+			requests: []request{
+				{expectedCache: "MISS", expectedBody: "response 1"},
+				{expectedCache: "HIT", expectedBody: "response 1"},
+			},
+		},
+		"it should not cache a private response": {
+			responseHeader: map[string]string{"Cache-Control": "private, max-age=60"},
+			requests: []request{
+				{expectedCache: "MISS", expectedBody: "response 1"},
+				{expectedCache: "MISS", expectedBody: "response 2"},
+			},
+		},
+		"it should not cache a no-store response": {
+			responseHeader: map[string]string{"Cache-Control": "no-store"},
+			options:        []CacheMiddlewareOption{WithCacheDefaultTTL(time.Minute)},
+			requests: []request{
+				{expectedCache: "MISS", expectedBody: "response 1"},
+				{expectedCache: "MISS", expectedBody: "response 2"},
+			},
+		},
+		"it should not cache a response setting a cookie": {
+			responseHeader: map[string]string{"Cache-Control": "max-age=60", "Set-Cookie": "session=biniou"},
+			requests: []request{
+				{expectedCache: "MISS", expectedBody: "response 1"},
+				{expectedCache: "MISS", expectedBody: "response 2"},
+			},
+		},
+		"it should not cache an error response": {
+			responseHeader: map[string]string{"Cache-Control": "max-age=60"},
+			statusCode:     http.StatusInternalServerError,
+			requests: []request{
+				{expectedCache: "MISS", expectedBody: "response 1"},
+				{expectedCache: "MISS", expectedBody: "response 2"},
+			},
+		},
+		"it should not cache the response to an authenticated request": {
+			responseHeader: map[string]string{"Cache-Control": "max-age=60"},
+			requests: []request{
+				{headers: map[string]string{"Authorization": "Bearer token"}, expectedCache: "MISS", expectedBody: "response 1"},
+				{headers: map[string]string{"Authorization": "Bearer token"}, expectedCache: "MISS", expectedBody: "response 2"},
+			},
+		},
+		"it should cache the public response to an authenticated request": {
+			responseHeader: map[string]string{"Cache-Control": "public, max-age=60"},
+			requests: []request{
+				{headers: map[string]string{"Authorization": "Bearer token"}, expectedCache: "MISS", expectedBody: "response 1"},
+				{headers: map[string]string{"Authorization": "Bearer token"}, expectedCache: "HIT", expectedBody: "response 1"},
+			},
+		},
+		"it should key the responses by path and sorted query": {
+			responseHeader: map[string]string{"Cache-Control": "max-age=60"},
+			requests: []request{
+				{path: "/apps/my-app?a=1&b=2", expectedCache: "MISS", expectedBody: "response 1"},
+				{path: "/apps/other-app?a=1&b=2", expectedCache: "MISS", expectedBody: "response 2"},
+				{path: "/apps/my-app?b=2&a=1", expectedCache: "HIT", expectedBody: "response 1"},
+				{path: "/apps/my-app?a=2", expectedCache: "MISS", expectedBody: "response 3"},
+			},
+		},
+		"it should key the responses by the headers of Vary": {
+			responseHeader: map[string]string{"Cache-Control": "max-age=60", "Vary": "Accept-Language"},
+			requests: []request{
+				{headers: map[string]string{"Accept-Language": "fr"}, expectedCache: "MISS", expectedBody: "response 1"},
+				{headers: map[string]string{"Accept-Language": "en"}, expectedCache: "MISS", expectedBody: "response 2"},
+				{headers: map[string]string{"Accept-Language": "fr"}, expectedCache: "HIT", expectedBody: "response 1"},
+				{headers: map[string]string{"Accept-Language": "en"}, expectedCache: "HIT", expectedBody: "response 2"},
+			},
+		},
+		"it should not cache a response varying on all headers": {
+			responseHeader: map[string]string{"Cache-Control": "max-age=60", "Vary": "*"},
+			requests: []request{
+				{expectedCache: "MISS", expectedBody: "response 1"},
+				{expectedCache: "MISS", expectedBody: "response 2"},
+			},
+		},
+		"it should bypass the cache if the request has no-cache": {
+			responseHeader: map[string]string{"Cache-Control": "max-age=60"},
+			requests: []request{
+				{expectedCache: "MISS", expectedBody: "response 1"},
+				{headers: map[string]string{"Cache-Control": "no-cache"}, expectedCache: "MISS", expectedBody: "response 2"},
+				{expectedCache: "HIT", expectedBody: "response 2"},
+			},
+		},
+		"it should not store the response if the request has no-store": {
+			responseHeader: map[string]string{"Cache-Control": "max-age=60"},
+			requests: []request{
+				{headers: map[string]string{"Cache-Control": "no-store"}, expectedBody: "response 1"},
+				{expectedCache: "MISS", expectedBody: "response 2"},
+			},
+		},
+		"it should answer 504 to only-if-cached requests on a miss": {
+			responseHeader: map[string]string{"Cache-Control": "max-age=60"},
+			requests: []request{
+				{headers: map[string]string{"Cache-Control": "only-if-cached"}, expectedCache: "MISS", expectedBody: ""},
+				{expectedCache: "MISS", expectedBody: "response 1"},
+				{headers: map[string]string{"Cache-Control": "only-if-cached"}, expectedCache: "HIT", expectedBody: "response 1"},
+			},
+		},
+		"it should not cache a body larger than the limit": {
+			options:        []CacheMiddlewareOption{WithCacheMaxBodySize(5)},
+			responseHeader: map[string]string{"Cache-Control": "max-age=60"},
+			requests: []request{
+				{expectedCache: "MISS", expectedBody: "response 1"},
+				{expectedCache: "MISS", expectedBody: "response 2"},
+			},
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			log, _ := test.NewNullLogger()
+			router := NewRouter(log, WithoutOtelInstrumentation())
+			router.Use(ErrorMiddleware)
+			router.Use(NewCacheMiddleware(example.options...))
+
+			calls := 0
+			router.HandleFunc("/apps/{app}", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				calls++
+				for name, value := range example.responseHeader {
+					w.Header().Set(name, value)
+				}
+				if example.statusCode != 0 {
+					w.WriteHeader(example.statusCode)
+				}
+				_, err := fmt.Fprintf(w, "response %d", calls)
+				return err
+			})
+
+			for i, request := range example.requests {
+				path := request.path
+				if path == "" {
+					path = "/apps/my-app"
+				}
+				r := httptest.NewRequest(http.MethodGet, path, nil)
+				for name, value := range request.headers {
+					r.Header.Set(name, value)
+				}
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r)
+
+				assert.Equal(t, request.expectedCache, w.Header().Get("X-Cache"), "request %d", i)
+				assert.Equal(t, request.expectedBody, w.Body.String(), "request %d", i)
+				if request.expectedCache == "HIT" {
+					assert.Equal(t, "0", w.Header().Get("Age"), "request %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheMiddleware_Headers(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	router := NewRouter(log, WithoutOtelInstrumentation())
+	router.Use(ErrorMiddleware)
+	router.Use(NewCacheMiddleware())
+	router.HandleFunc("/apps", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+
+	responses := make([]*httptest.ResponseRecorder, 2)
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		router.ServeHTTP(responses[i], httptest.NewRequest(http.MethodGet, "/apps", nil))
+	}
+
+	assert.Equal(t, "HIT", responses[1].Header().Get("X-Cache"))
+	assert.Equal(t, http.StatusNoContent, responses[1].Code)
+	assert.Equal(t, "application/json", responses[1].Header().Get("Content-Type"))
+	// The request ID is not cached
+	assert.NotEqual(t, responses[0].Header().Get("X-Request-ID"), responses[1].Header().Get("X-Request-ID"))
+}
+
+func TestCacheMiddleware_Coalescing(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	router := NewRouter(log, WithoutOtelInstrumentation())
+	router.Use(ErrorMiddleware)
+	router.Use(NewCacheMiddleware())
+
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	router.HandleFunc("/apps", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, err := w.Write([]byte("apps"))
+		return err
+	})
+
+	const requests = 5
+	responses := make([]*httptest.ResponseRecorder, requests)
+	wg := sync.WaitGroup{}
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/apps", nil))
+		}(responses[i])
+		if i == 0 {
+			<-started
+		}
+	}
+	// Let the other requests wait for the first one
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.EqualValues(t, 1, calls.Load())
+	hits := 0
+	for _, w := range responses {
+		require.Equal(t, "apps", w.Body.String())
+		if w.Header().Get("X-Cache") == "HIT" {
+			hits++
+		}
+	}
+	assert.Equal(t, requests-1, hits)
+}
+
+func TestCacheMiddleware_CoalescingCanceled(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	router := NewRouter(log, WithoutOtelInstrumentation())
+	router.Use(ErrorMiddleware)
+	router.Use(NewCacheMiddleware())
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	router.HandleFunc("/apps", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/apps", nil))
+	}()
+	defer func() {
+		close(release)
+		wg.Wait()
+	}()
+	<-started
+
+	// The client of the request waiting for the first one is gone
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/apps", nil).WithContext(ctx))
+	assert.Equal(t, 499, w.Code)
+}
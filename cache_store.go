@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const cacheDefaultMaxEntries = 1000
+
+// CachedResponse is a response stored by the CacheMiddleware. It must not be
+// modified once stored.
+type CachedResponse struct {
+	StatusCode int
+	// Header contains the headers set by the handler
+	Header http.Header
+	Body   []byte
+	// Vary are the request headers the response depends on
+	Vary []string
+	// StoredAt is used to compute the Age header
+	StoredAt  time.Time
+	ExpiresAt time.Time
+}
+
+// CacheStore stores the responses cached by the CacheMiddleware. It can be
+// implemented on top of an external backend to share the cache between several
+// instances of a service.
+type CacheStore interface {
+	// Get returns the response stored with key, or nil if there is none or if it
+	// expired
+	Get(ctx context.Context, key string) (*CachedResponse, error)
+	// Set stores response with key until response.ExpiresAt
+	Set(ctx context.Context, key string, response *CachedResponse) error
+}
+
+// MemoryCacheStore stores the responses in memory, evicting the least recently
+// used ones when the maximum number of entries is reached. The cache is not
+// shared between the instances of a service.
+type MemoryCacheStore struct {
+	mutex      sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	// lru contains the entries from the most to the least recently used
+	lru *list.List
+	// now is overridden in tests
+	now func() time.Time
+}
+
+type memoryCacheEntry struct {
+	key      string
+	response *CachedResponse
+}
+
+// NewMemoryCacheStore initializes a store keeping at most maxEntries
+// responses. A maxEntries lower or equal to 0 uses the default of 1000
+// entries.
+func NewMemoryCacheStore(maxEntries int) *MemoryCacheStore {
+	if maxEntries <= 0 {
+		maxEntries = cacheDefaultMaxEntries
+	}
+	return &MemoryCacheStore{
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+		now:        time.Now,
+	}
+}
+
+func (s *MemoryCacheStore) Get(ctx context.Context, key string) (*CachedResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	entry := element.Value.(*memoryCacheEntry)
+	if !s.now().Before(entry.response.ExpiresAt) {
+		s.lru.Remove(element)
+		delete(s.entries, key)
+		return nil, nil
+	}
+	s.lru.MoveToFront(element)
+	return entry.response, nil
+}
+
+func (s *MemoryCacheStore) Set(ctx context.Context, key string, response *CachedResponse) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if element, ok := s.entries[key]; ok {
+		element.Value.(*memoryCacheEntry).response = response
+		s.lru.MoveToFront(element)
+		return nil
+	}
+	s.entries[key] = s.lru.PushFront(&memoryCacheEntry{key: key, response: response})
+	for s.lru.Len() > s.maxEntries {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+	return nil
+}
+
+// Len returns the number of entries in the store, including the expired ones
+// which have not been evicted yet
+func (s *MemoryCacheStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lru.Len()
+}
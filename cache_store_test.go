@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryCacheStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	newResponse := func(body string) *CachedResponse {
+		return &CachedResponse{StatusCode: 200, Body: []byte(body), StoredAt: now, ExpiresAt: now.Add(time.Minute)}
+	}
+
+	t.Run("it should return the stored responses until they expire", func(t *testing.T) {
+		store := NewMemoryCacheStore(10)
+		store.now = func() time.Time { return now }
+
+		response, err := store.Get(ctx, "key")
+		require.NoError(t, err)
+		assert.Nil(t, response)
+
+		require.NoError(t, store.Set(ctx, "key", newResponse("biniou")))
+		response, err = store.Get(ctx, "key")
+		require.NoError(t, err)
+		require.NotNil(t, response)
+		assert.Equal(t, "biniou", string(response.Body))
+
+		store.now = func() time.Time { return now.Add(time.Minute) }
+		response, err = store.Get(ctx, "key")
+		require.NoError(t, err)
+		assert.Nil(t, response)
+		assert.Equal(t, 0, store.Len())
+	})
+
+	t.Run("it should evict the least recently used responses", func(t *testing.T) {
+		store := NewMemoryCacheStore(2)
+		store.now = func() time.Time { return now }
+
+		require.NoError(t, store.Set(ctx, "key-1", newResponse("1")))
+		require.NoError(t, store.Set(ctx, "key-2", newResponse("2")))
+		// key-1 becomes the most recently used
+		_, err := store.Get(ctx, "key-1")
+		require.NoError(t, err)
+		require.NoError(t, store.Set(ctx, "key-3", newResponse("3")))
+
+		assert.Equal(t, 2, store.Len())
+		response, err := store.Get(ctx, "key-2")
+		require.NoError(t, err)
+		assert.Nil(t, response)
+		for _, key := range []string{"key-1", "key-3"} {
+			response, err := store.Get(ctx, key)
+			require.NoError(t, err)
+			assert.NotNil(t, response, key)
+		}
+	})
+
+	t.Run("it should replace a stored response", func(t *testing.T) {
+		store := NewMemoryCacheStore(2)
+		store.now = func() time.Time { return now }
+
+		require.NoError(t, store.Set(ctx, "key", newResponse("1")))
+		require.NoError(t, store.Set(ctx, "key", newResponse("2")))
+
+		assert.Equal(t, 1, store.Len())
+		response, err := store.Get(ctx, "key")
+		require.NoError(t, err)
+		assert.Equal(t, "2", string(response.Body))
+	})
+}
@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+	"github.com/Scalingo/go-utils/logger"
+)
+
+const (
+	circuitBreakerDefaultFailureRatio     = 0.5
+	circuitBreakerDefaultMinRequests      = 10
+	circuitBreakerDefaultWindow           = 10 * time.Second
+	circuitBreakerDefaultOpenDuration     = 30 * time.Second
+	circuitBreakerDefaultHalfOpenRequests = 1
+)
+
+// CircuitState is the state of a circuit breaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets the requests through and counts their failures
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects the requests until the open duration has elapsed
+	CircuitOpen
+	// CircuitHalfOpen lets a limited number of probe requests through. The
+	// circuit is closed if they all succeed, and opened again otherwise.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreakerConfig configures the circuit breaker of a route. The zero
+// values are replaced by the defaults.
+type CircuitBreakerConfig struct {
+	// FailureRatio is the ratio of failed requests over Window opening the
+	// circuit (0.5 by default)
+	FailureRatio float64
+	// MinRequests is the minimum number of requests over Window before the
+	// circuit can be opened (10 by default)
+	MinRequests int
+	// Window is the duration over which the requests are counted (10 seconds by
+	// default)
+	Window time.Duration
+	// OpenDuration is the duration during which the requests are rejected
+	// before the circuit is half-opened (30 seconds by default). It is also the
+	// maximum duration of the probe requests, after which other probes are let
+	// through.
+	OpenDuration time.Duration
+	// HalfOpenRequests is the number of successful probe requests closing the
+	// circuit (1 by default)
+	HalfOpenRequests int
+}
+
+// CircuitBreaker is a middleware rejecting the requests to the routes whose
+// handlers keep failing, for instance because a backing dependency is down
+type CircuitBreaker struct {
+	// routes are the circuits of the protected routes, by path template or
+	// route name
+	routes    map[string]*circuit
+	isFailure func(err error) bool
+	// now is overridden in tests
+	now func() time.Time
+}
+
+type CircuitBreakerOption func(b *CircuitBreaker)
+
+// WithRouteCircuitBreaker protects a route, identified by its path template
+// (e.g. /apps/{app_id}/deployments) or its name, with its own circuit
+func WithRouteCircuitBreaker(route string, config CircuitBreakerConfig) CircuitBreakerOption {
+	return func(b *CircuitBreaker) {
+		b.routes[route] = newCircuit(route, config)
+	}
+}
+
+// WithCircuitBreakerFailure sets the function deciding whether the error
+// returned by a handler is a failure of the route. By default, all the errors
+// are failures except the cancellation of the request, the validation errors,
+// the BadRequestError and the errors implementing HTTPError with a status code
+// lower than 500. The errors which are not failures do not close a half-open
+// circuit either: the probe request is not counted.
+func WithCircuitBreakerFailure(isFailure func(err error) bool) CircuitBreakerOption {
+	return func(b *CircuitBreaker) {
+		b.isFailure = isFailure
+	}
+}
+
+// NewCircuitBreaker initializes a middleware protecting the routes configured
+// with WithRouteCircuitBreaker. When the failure ratio of a route is reached,
+// its circuit is opened and the requests are rejected with a
+// *ServiceUnavailableError, rendered as 503 with a Retry-After header and logged
+// at warning level by the ErrorMiddleware. The state of the circuit is added to
+// the request completed log and the state changes are logged.
+func NewCircuitBreaker(options ...CircuitBreakerOption) *CircuitBreaker {
+	b := &CircuitBreaker{
+		routes:    map[string]*circuit{},
+		isFailure: isCircuitBreakerFailure,
+		now:       time.Now,
+	}
+	for _, opt := range options {
+		opt(b)
+	}
+	return b
+}
+
+// State returns the state of the circuit of a route
+func (b *CircuitBreaker) State(route string) (CircuitState, bool) {
+	c, ok := b.routes[route]
+	if !ok {
+		return CircuitClosed, false
+	}
+	return c.currentState(b.now()), true
+}
+
+// RegisterMetrics registers the http.server.circuit_breaker.state gauge,
+// labelled with the http.route attribute. Its value is 0 when the circuit is
+// closed, 1 when it is open and 2 when it is half-open.
+func (b *CircuitBreaker) RegisterMetrics(ctx context.Context, provider metric.MeterProvider) error {
+	meter := provider.Meter(metricsInstrumentationName)
+
+	state, err := meter.Int64ObservableGauge("http.server.circuit_breaker.state",
+		metric.WithDescription("State of the circuit breaker of the route: 0 closed, 1 open, 2 half-open."),
+		metric.WithUnit("{state}"),
+	)
+	if err != nil {
+		return errors.Wrap(ctx, err, "create circuit breaker state gauge")
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		now := b.now()
+		for route, c := range b.routes {
+			o.ObserveInt64(state, int64(c.currentState(now)), metric.WithAttributes(attribute.String("http.route", route)))
+		}
+		return nil
+	}, state)
+	if err != nil {
+		return errors.Wrap(ctx, err, "register circuit breaker gauge callback")
+	}
+	return nil
+}
+
+func (b *CircuitBreaker) Apply(next HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		c := b.routeCircuit(r)
+		if c == nil {
+			return next(w, r, vars)
+		}
+		ctx := r.Context()
+
+		admission, retryAfter := c.allow(ctx, b.now())
+		AddRequestLogFields(ctx, logrus.Fields{"circuit_breaker_state": admission.state.String()})
+		if admission.rejected {
+			return &ServiceUnavailableError{Reason: "circuit breaker open", RetryAfter: retryAfter}
+		}
+
+		outcome := circuitFailure
+		defer func() {
+			// A panicking handler is a failure
+			c.record(ctx, b.now(), admission, outcome)
+		}()
+		err := next(w, r, vars)
+		switch {
+		case err == nil:
+			outcome = circuitSuccess
+		case !b.isFailure(err):
+			outcome = circuitInconclusive
+		}
+		return err
+	}
+}
+
+func (b *CircuitBreaker) routeCircuit(r *http.Request) *circuit {
+	if len(b.routes) == 0 {
+		return nil
+	}
+	template, name := currentRoute(r)
+	if c, ok := b.routes[template]; ok && template != "" {
+		return c
+	}
+	if c, ok := b.routes[name]; ok && name != "" {
+		return c
+	}
+	return nil
+}
+
+func isCircuitBreakerFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	// The client errors are not failures of the route
+	var validationErrors *errors.ValidationErrors
+	var badRequestError *BadRequestError
+	if errors.As(err, &validationErrors) || errors.As(err, &badRequestError) || isInvalidTokenError(err) {
+		return false
+	}
+	var httpError HTTPError
+	if errors.As(err, &httpError) {
+		return httpError.StatusCode() >= 500
+	}
+	return true
+}
+
+type circuit struct {
+	route  string
+	config CircuitBreakerConfig
+
+	mutex sync.Mutex
+	state CircuitState
+	// generation is incremented at each state change, so that the requests
+	// admitted before are not counted
+	generation  uint64
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	// probes is the number of requests admitted in the half-open state, the
+	// first of them at probesStart
+	probes      int
+	probesStart time.Time
+	successes   int
+}
+
+// circuitOutcome is the result of an admitted request
+type circuitOutcome int
+
+const (
+	circuitSuccess circuitOutcome = iota
+	circuitFailure
+	// circuitInconclusive is the result of a request failing with an error which
+	// is not a failure of the route, like a client error or a cancellation. It
+	// does not tell whether the route has recovered.
+	circuitInconclusive
+)
+
+// circuitAdmission is the decision taken for a request
+type circuitAdmission struct {
+	state      CircuitState
+	generation uint64
+	rejected   bool
+}
+
+func newCircuit(route string, config CircuitBreakerConfig) *circuit {
+	if config.FailureRatio <= 0 {
+		config.FailureRatio = circuitBreakerDefaultFailureRatio
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = circuitBreakerDefaultMinRequests
+	}
+	if config.Window <= 0 {
+		config.Window = circuitBreakerDefaultWindow
+	}
+	if config.OpenDuration <= 0 {
+		config.OpenDuration = circuitBreakerDefaultOpenDuration
+	}
+	if config.HalfOpenRequests <= 0 {
+		config.HalfOpenRequests = circuitBreakerDefaultHalfOpenRequests
+	}
+	return &circuit{route: route, config: config}
+}
+
+func (c *circuit) currentState(now time.Time) CircuitState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state == CircuitOpen && !now.Before(c.openedAt.Add(c.config.OpenDuration)) {
+		return CircuitHalfOpen
+	}
+	return c.state
+}
+
+// allow decides whether a request is let through. If it is rejected, the
+// duration until the circuit is half-opened is returned.
+func (c *circuit) allow(ctx context.Context, now time.Time) (circuitAdmission, time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state == CircuitOpen {
+		reopenAt := c.openedAt.Add(c.config.OpenDuration)
+		if now.Before(reopenAt) {
+			return circuitAdmission{state: CircuitOpen, generation: c.generation, rejected: true}, reopenAt.Sub(now)
+		}
+		c.transition(ctx, now, CircuitHalfOpen)
+	}
+
+	if c.state == CircuitHalfOpen {
+		if c.probes >= c.config.HalfOpenRequests && now.Sub(c.probesStart) >= c.config.OpenDuration {
+			// The probes in flight for longer than the open duration are considered
+			// lost. They are not counted if they ever complete.
+			c.generation++
+			c.probes = 0
+			c.successes = 0
+		}
+		if c.probes >= c.config.HalfOpenRequests {
+			// The probes are in flight
+			return circuitAdmission{state: CircuitHalfOpen, generation: c.generation, rejected: true}, time.Second
+		}
+		if c.probes == 0 {
+			c.probesStart = now
+		}
+		c.probes++
+	}
+	return circuitAdmission{state: c.state, generation: c.generation}, 0
+}
+
+// record counts the outcome of an admitted request
+func (c *circuit) record(ctx context.Context, now time.Time, admission circuitAdmission, outcome circuitOutcome) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if admission.generation != c.generation {
+		return
+	}
+
+	switch c.state {
+	case CircuitClosed:
+		if now.Sub(c.windowStart) >= c.config.Window {
+			c.windowStart = now
+			c.requests = 0
+			c.failures = 0
+		}
+		c.requests++
+		if outcome == circuitFailure {
+			c.failures++
+		}
+		if c.requests >= c.config.MinRequests &&
+			float64(c.failures)/float64(c.requests) >= c.config.FailureRatio {
+			c.transition(ctx, now, CircuitOpen)
+		}
+	case CircuitHalfOpen:
+		switch outcome {
+		case circuitFailure:
+			c.transition(ctx, now, CircuitOpen)
+			return
+		case circuitInconclusive:
+			// Release the slot of the probe so that another request probes the route
+			c.probes--
+			return
+		}
+		c.successes++
+		if c.successes >= c.config.HalfOpenRequests {
+			c.transition(ctx, now, CircuitClosed)
+		}
+	}
+}
+
+// transition changes the state of the circuit. The mutex must be held.
+func (c *circuit) transition(ctx context.Context, now time.Time, state CircuitState) {
+	logger.Get(ctx).WithFields(logrus.Fields{
+		"circuit_breaker_route": c.route,
+		"circuit_breaker_from":  c.state.String(),
+		"circuit_breaker_to":    state.String(),
+	}).Warn("Circuit breaker state changed")
+
+	c.state = state
+	c.generation++
+	c.probes = 0
+	c.successes = 0
+	switch state {
+	case CircuitOpen:
+		c.openedAt = now
+	case CircuitClosed:
+		c.windowStart = now
+		c.requests = 0
+		c.failures = 0
+	}
+}
@@ -0,0 +1,322 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+)
+
+var errDependencyDown = errors.New(context.Background(), "dependency down")
+
+// circuitBreakerRouter returns a router whose /apps/{app}/deployments handler
+// returns the error pointed by handlerErr
+func circuitBreakerRouter(t *testing.T, breaker *CircuitBreaker, handlerErr *error) (*Router, *test.Hook) {
+	t.Helper()
+	log, hook := test.NewNullLogger()
+	router := NewRouter(log, WithoutOtelInstrumentation())
+	router.Use(ErrorMiddleware)
+	router.Use(breaker)
+
+	handler := func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		return *handlerErr
+	}
+	router.HandleFunc("/apps", handler)
+	router.HandleFunc("/apps/{app}/deployments", handler)
+	return router, hook
+}
+
+func serveCircuitBreaker(router *Router, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	const route = "/apps/{app}/deployments"
+	config := CircuitBreakerConfig{
+		FailureRatio:     0.5,
+		MinRequests:      4,
+		Window:           10 * time.Second,
+		OpenDuration:     30 * time.Second,
+		HalfOpenRequests: 2,
+	}
+
+	// newBreaker returns a circuit breaker whose circuit is open
+	newBreaker := func(t *testing.T, handlerErr *error, now *time.Time, options ...CircuitBreakerOption) (*CircuitBreaker, *Router) {
+		t.Helper()
+		options = append([]CircuitBreakerOption{WithRouteCircuitBreaker(route, config)}, options...)
+		breaker := NewCircuitBreaker(options...)
+		breaker.now = func() time.Time { return *now }
+		router, _ := circuitBreakerRouter(t, breaker, handlerErr)
+
+		for _, err := range []error{nil, nil, errDependencyDown, errDependencyDown} {
+			*handlerErr = err
+			serveCircuitBreaker(router, "/apps/my-app/deployments")
+		}
+		state, ok := breaker.State(route)
+		require.True(t, ok)
+		require.Equal(t, CircuitOpen, state)
+		return breaker, router
+	}
+
+	t.Run("it should open the circuit when the failure ratio is reached", func(t *testing.T) {
+		var handlerErr error
+		now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		_, router := newBreaker(t, &handlerErr, &now)
+
+		handlerErr = nil
+		w := serveCircuitBreaker(router, "/apps/my-app/deployments")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "30", w.Header().Get("Retry-After"))
+		assert.Equal(t, "service unavailable: circuit breaker open\n", w.Body.String())
+
+		// The other routes are not protected
+		w = serveCircuitBreaker(router, "/apps")
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("it should not open the circuit under the minimum number of requests", func(t *testing.T) {
+		var handlerErr error = errDependencyDown
+		breaker := NewCircuitBreaker(WithRouteCircuitBreaker(route, config))
+		router, _ := circuitBreakerRouter(t, breaker, &handlerErr)
+
+		for range config.MinRequests - 1 {
+			w := serveCircuitBreaker(router, "/apps/my-app/deployments")
+			assert.Equal(t, http.StatusInternalServerError, w.Code)
+		}
+		state, _ := breaker.State(route)
+		assert.Equal(t, CircuitClosed, state)
+	})
+
+	t.Run("it should reset the counts at the end of the window", func(t *testing.T) {
+		var handlerErr error
+		now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		breaker := NewCircuitBreaker(WithRouteCircuitBreaker(route, config))
+		breaker.now = func() time.Time { return now }
+		router, _ := circuitBreakerRouter(t, breaker, &handlerErr)
+
+		for _, err := range []error{nil, nil, errDependencyDown} {
+			handlerErr = err
+			serveCircuitBreaker(router, "/apps/my-app/deployments")
+		}
+		now = now.Add(config.Window)
+		handlerErr = errDependencyDown
+		serveCircuitBreaker(router, "/apps/my-app/deployments")
+
+		state, _ := breaker.State(route)
+		assert.Equal(t, CircuitClosed, state)
+	})
+
+	t.Run("it should not count the client errors as failures", func(t *testing.T) {
+		var handlerErr error
+		breaker := NewCircuitBreaker(WithRouteCircuitBreaker(route, config))
+		router, _ := circuitBreakerRouter(t, breaker, &handlerErr)
+
+		for _, err := range []error{
+			&BadRequestError{Errors: map[string][]string{"name": {"is required"}}},
+			&TooManyRequestsError{},
+			errors.Wrap(context.Background(), context.Canceled, "call dependency"),
+			PreconditionFailedError{},
+		} {
+			handlerErr = err
+			serveCircuitBreaker(router, "/apps/my-app/deployments")
+		}
+		state, _ := breaker.State(route)
+		assert.Equal(t, CircuitClosed, state)
+	})
+
+	t.Run("it should only count the failures selected by the failure function", func(t *testing.T) {
+		var handlerErr error
+		breaker := NewCircuitBreaker(
+			WithRouteCircuitBreaker(route, config),
+			WithCircuitBreakerFailure(func(err error) bool {
+				return errors.Is(err, errDependencyDown)
+			}),
+		)
+		router, _ := circuitBreakerRouter(t, breaker, &handlerErr)
+
+		handlerErr = errors.New(context.Background(), "invalid deployment")
+		for range config.MinRequests {
+			serveCircuitBreaker(router, "/apps/my-app/deployments")
+		}
+		state, _ := breaker.State(route)
+		assert.Equal(t, CircuitClosed, state)
+
+		handlerErr = errors.Wrap(context.Background(), errDependencyDown, "list deployments")
+		for range config.MinRequests {
+			serveCircuitBreaker(router, "/apps/my-app/deployments")
+		}
+		state, _ = breaker.State(route)
+		assert.Equal(t, CircuitOpen, state)
+	})
+
+	t.Run("it should close the circuit when the probe requests succeed", func(t *testing.T) {
+		var handlerErr error
+		now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		breaker, router := newBreaker(t, &handlerErr, &now)
+
+		now = now.Add(config.OpenDuration)
+		state, _ := breaker.State(route)
+		assert.Equal(t, CircuitHalfOpen, state)
+
+		handlerErr = nil
+		for range config.HalfOpenRequests {
+			w := serveCircuitBreaker(router, "/apps/my-app/deployments")
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+		state, _ = breaker.State(route)
+		assert.Equal(t, CircuitClosed, state)
+	})
+
+	t.Run("it should open the circuit again when a probe request fails", func(t *testing.T) {
+		var handlerErr error
+		now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		breaker, router := newBreaker(t, &handlerErr, &now)
+
+		now = now.Add(config.OpenDuration)
+		w := serveCircuitBreaker(router, "/apps/my-app/deployments")
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+		state, _ := breaker.State(route)
+		assert.Equal(t, CircuitOpen, state)
+		w = serveCircuitBreaker(router, "/apps/my-app/deployments")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+
+	t.Run("it should not close the circuit when a probe request is inconclusive", func(t *testing.T) {
+		var handlerErr error
+		now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		breaker, router := newBreaker(t, &handlerErr, &now)
+
+		now = now.Add(config.OpenDuration)
+		for _, err := range []error{
+			errors.Wrap(context.Background(), context.Canceled, "call dependency"),
+			&BadRequestError{Errors: map[string][]string{"name": {"is required"}}},
+			nil,
+		} {
+			handlerErr = err
+			serveCircuitBreaker(router, "/apps/my-app/deployments")
+			state, _ := breaker.State(route)
+			assert.Equal(t, CircuitHalfOpen, state)
+		}
+
+		// The inconclusive probes released their slot
+		handlerErr = nil
+		w := serveCircuitBreaker(router, "/apps/my-app/deployments")
+		assert.Equal(t, http.StatusOK, w.Code)
+		state, _ := breaker.State(route)
+		assert.Equal(t, CircuitClosed, state)
+	})
+
+	t.Run("it should limit the number of probe requests in flight", func(t *testing.T) {
+		c := newCircuit(route, CircuitBreakerConfig{HalfOpenRequests: 1})
+		ctx := context.Background()
+		now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		c.state = CircuitHalfOpen
+
+		probe, _ := c.allow(ctx, now)
+		assert.False(t, probe.rejected)
+		admission, _ := c.allow(ctx, now)
+		assert.True(t, admission.rejected)
+
+		c.record(ctx, now, probe, circuitSuccess)
+		assert.Equal(t, CircuitClosed, c.currentState(now))
+	})
+
+	t.Run("it should admit new probe requests if the probes in flight never complete", func(t *testing.T) {
+		c := newCircuit(route, CircuitBreakerConfig{HalfOpenRequests: 1, OpenDuration: 30 * time.Second})
+		ctx := context.Background()
+		now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		c.state = CircuitHalfOpen
+
+		lost, _ := c.allow(ctx, now)
+		assert.False(t, lost.rejected)
+		admission, _ := c.allow(ctx, now.Add(29*time.Second))
+		assert.True(t, admission.rejected)
+
+		probe, _ := c.allow(ctx, now.Add(30*time.Second))
+		assert.False(t, probe.rejected)
+		// The lost probe is not counted
+		c.record(ctx, now.Add(31*time.Second), lost, circuitFailure)
+		assert.Equal(t, CircuitHalfOpen, c.currentState(now))
+		c.record(ctx, now.Add(31*time.Second), probe, circuitSuccess)
+		assert.Equal(t, CircuitClosed, c.currentState(now))
+	})
+
+	t.Run("it should not log the rejected requests at error level", func(t *testing.T) {
+		var handlerErr error
+		now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		breaker := NewCircuitBreaker(WithRouteCircuitBreaker(route, config))
+		breaker.now = func() time.Time { return now }
+		router, hook := circuitBreakerRouter(t, breaker, &handlerErr)
+		breaker.routes[route].transition(context.Background(), now, CircuitOpen)
+		hook.Reset()
+
+		w := serveCircuitBreaker(router, "/apps/my-app/deployments")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		for _, entry := range hook.AllEntries() {
+			assert.Greater(t, entry.Level, logrus.ErrorLevel, entry.Message)
+		}
+	})
+
+	t.Run("it should log the state of the circuit", func(t *testing.T) {
+		var handlerErr error = errDependencyDown
+		breaker := NewCircuitBreaker(WithRouteCircuitBreaker(route, config))
+		router, hook := circuitBreakerRouter(t, breaker, &handlerErr)
+
+		for range config.MinRequests + 1 {
+			serveCircuitBreaker(router, "/apps/my-app/deployments")
+		}
+
+		var states []any
+		var changes int
+		for _, entry := range hook.AllEntries() {
+			switch entry.Message {
+			case "request completed":
+				states = append(states, entry.Data["circuit_breaker_state"])
+			case "Circuit breaker state changed":
+				changes++
+				assert.Equal(t, "closed", entry.Data["circuit_breaker_from"])
+				assert.Equal(t, "open", entry.Data["circuit_breaker_to"])
+			}
+		}
+		assert.Equal(t, []any{"closed", "closed", "closed", "closed", "open"}, states)
+		assert.Equal(t, 1, changes)
+	})
+}
+
+func TestCircuitBreaker_RegisterMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	breaker := NewCircuitBreaker(
+		WithRouteCircuitBreaker("/apps", CircuitBreakerConfig{MinRequests: 1}),
+		WithRouteCircuitBreaker("/apps/{app}/deployments", CircuitBreakerConfig{}),
+	)
+	require.NoError(t, breaker.RegisterMetrics(context.Background(), provider))
+
+	var handlerErr error = errDependencyDown
+	router, _ := circuitBreakerRouter(t, breaker, &handlerErr)
+	serveCircuitBreaker(router, "/apps")
+
+	metrics := collectMetrics(t, reader)
+	state, ok := metrics["http.server.circuit_breaker.state"].(metricdata.Gauge[int64])
+	require.True(t, ok)
+	values := map[string]int64{}
+	for _, point := range state.DataPoints {
+		route, _ := point.Attributes.Value(attribute.Key("http.route"))
+		values[route.AsString()] = point.Value
+	}
+	assert.Equal(t, map[string]int64{"/apps": 1, "/apps/{app}/deployments": 0}, values)
+}
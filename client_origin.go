@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientOrigin is the IP address and the scheme used by the client, as seen by
+// the first trusted proxy handling the request
+type ClientOrigin struct {
+	// IP is the IP address of the client. It may not be a valid IP address if a
+	// trusted proxy sent an obfuscated identifier (RFC 7239).
+	IP     string
+	Scheme string
+	// schemeForwarded indicates if the scheme has been sent by a trusted proxy
+	schemeForwarded bool
+}
+
+// TrustedProxies resolves the origin of the requests. The forwarding headers
+// (Forwarded, X-Forwarded-For and X-Forwarded-Proto) are only read if the
+// request comes from one of the trusted proxies.
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// DefaultTrustedProxies trusts the loopback and the private networks
+var DefaultTrustedProxies = &TrustedProxies{
+	prefixes: []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.0/8"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+		netip.MustParsePrefix("::1/128"),
+		netip.MustParsePrefix("fc00::/7"),
+	},
+}
+
+// NewTrustedProxies initializes the trusted proxies from CIDRs (e.g.
+// 10.0.0.0/8) or IP addresses. Without any argument, no proxy is trusted.
+func NewTrustedProxies(cidrs ...string) (*TrustedProxies, error) {
+	p := &TrustedProxies{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%v': %v", cidr, err)
+			}
+			p.prefixes = append(p.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%v': %v", cidr, err)
+		}
+		p.prefixes = append(p.prefixes, prefix.Masked())
+	}
+	return p, nil
+}
+
+func (p *TrustedProxies) isTrusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the origin of the request. The forwarding headers are walked
+// from right to left, i.e. from the closest proxy to the farthest one, and the
+// first address which is not a trusted proxy is the client. The RFC 7239
+// Forwarded header takes precedence over the X-Forwarded-* headers.
+func (p *TrustedProxies) Resolve(r *http.Request) ClientOrigin {
+	origin := ClientOrigin{
+		IP:     remoteIP(r.RemoteAddr),
+		Scheme: "http",
+	}
+	if r.TLS != nil {
+		origin.Scheme = "https"
+	}
+	if !p.isTrusted(origin.IP) {
+		return origin
+	}
+
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		elements := parseForwarded(forwarded)
+		for i := len(elements) - 1; i >= 0; i-- {
+			if elements[i].For == "" {
+				continue
+			}
+			origin.IP = elements[i].For
+			if elements[i].Proto != "" {
+				origin.Scheme = elements[i].Proto
+				origin.schemeForwarded = true
+			}
+			if !p.isTrusted(origin.IP) {
+				break
+			}
+		}
+		return origin
+	}
+
+	forwardedFor := splitHeaderValues(r.Header.Values("X-Forwarded-For"))
+	forwardedProto := splitHeaderValues(r.Header.Values("X-Forwarded-Proto"))
+	index := -1
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		index = i
+		origin.IP = normalizeForwardedIP(forwardedFor[i])
+		if !p.isTrusted(origin.IP) {
+			break
+		}
+	}
+	if len(forwardedProto) > 0 {
+		// Proxies appending to the header send one protocol per address,
+		// otherwise the protocol is set by the closest proxy
+		proto := forwardedProto[len(forwardedProto)-1]
+		if len(forwardedProto) == len(forwardedFor) && index >= 0 {
+			proto = forwardedProto[index]
+		}
+		origin.Scheme = strings.ToLower(proto)
+		origin.schemeForwarded = true
+	}
+	return origin
+}
+
+// NewClientOriginMiddleware resolves the origin of the request with the given
+// trusted proxies and stores it in the request context. NewRouter adds it by
+// default with DefaultTrustedProxies.
+func NewClientOriginMiddleware(proxies *TrustedProxies) Middleware {
+	return MiddlewareFunc(func(next HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+			origin := proxies.Resolve(r)
+			r = r.WithContext(ContextWithClientOrigin(r.Context(), origin))
+			return next(w, r, vars)
+		}
+	})
+}
+
+// clientOrigin returns the origin stored in the request context, or resolves
+// it with the default trusted proxies if there is none
+func clientOrigin(r *http.Request) ClientOrigin {
+	origin, ok := ClientOriginFromContext(r.Context())
+	if !ok {
+		origin = DefaultTrustedProxies.Resolve(r)
+	}
+	return origin
+}
+
+type forwardedElement struct {
+	For   string
+	Proto string
+}
+
+// parseForwarded parses the values of the RFC 7239 Forwarded header, e.g.
+// for=192.0.2.60;proto=https, for="[2001:db8:cafe::17]:4711"
+func parseForwarded(values []string) []forwardedElement {
+	var elements []forwardedElement
+	for _, element := range splitHeaderValues(values) {
+		var e forwardedElement
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				continue
+			}
+			value = strings.Trim(value, `"`)
+			switch strings.ToLower(key) {
+			case "for":
+				e.For = normalizeForwardedIP(value)
+			case "proto":
+				e.Proto = strings.ToLower(value)
+			}
+		}
+		elements = append(elements, e)
+	}
+	return elements
+}
+
+// normalizeForwardedIP removes the port and the brackets of an IPv6 address
+func normalizeForwardedIP(value string) string {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "[") {
+		end := strings.Index(value, "]")
+		if end > 0 {
+			return value[1:end]
+		}
+		return value
+	}
+	// An IPv4 address with a port, an IPv6 address without brackets has more
+	// than one colon
+	if strings.Count(value, ":") == 1 {
+		host, _, err := net.SplitHostPort(value)
+		if err == nil {
+			return host
+		}
+	}
+	return value
+}
+
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+func splitHeaderValues(values []string) []string {
+	var res []string
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			if v != "" {
+				res = append(res, v)
+			}
+		}
+	}
+	return res
+}
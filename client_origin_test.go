@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedProxies_Resolve(t *testing.T) {
+	proxies, err := NewTrustedProxies("10.0.0.0/8", "2001:db8::1")
+	require.NoError(t, err)
+
+	examples := map[string]struct {
+		remoteAddr     string
+		tls            bool
+		headers        http.Header
+		expectedIP     string
+		expectedScheme string
+	}{
+		"it should use the remote address without forwarding headers": {
+			remoteAddr:     "203.0.113.1:1234",
+			expectedIP:     "203.0.113.1",
+			expectedScheme: "http",
+		},
+		"it should use https for a TLS connection": {
+			remoteAddr:     "203.0.113.1:1234",
+			tls:            true,
+			expectedIP:     "203.0.113.1",
+			expectedScheme: "https",
+		},
+		"it should ignore the forwarding headers of an untrusted client": {
+			remoteAddr: "203.0.113.1:1234",
+			headers: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Proto": {"https"},
+			},
+			expectedIP:     "203.0.113.1",
+			expectedScheme: "http",
+		},
+		"it should walk X-Forwarded-For from right to left": {
+			remoteAddr: "10.0.0.1:1234",
+			headers: http.Header{
+				"X-Forwarded-For":   {"192.0.2.1, 198.51.100.1", "10.0.0.2"},
+				"X-Forwarded-Proto": {"https"},
+			},
+			expectedIP:     "198.51.100.1",
+			expectedScheme: "https",
+		},
+		"it should use the leftmost address if all the proxies are trusted": {
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			expectedIP:     "10.0.0.3",
+			expectedScheme: "http",
+		},
+		"it should use the protocol matching the client address": {
+			remoteAddr: "10.0.0.1:1234",
+			headers: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1, 10.0.0.2"},
+				"X-Forwarded-Proto": {"https, http"},
+			},
+			expectedIP:     "198.51.100.1",
+			expectedScheme: "https",
+		},
+		"it should trust a single IPv6 address": {
+			remoteAddr:     "[2001:db8::1]:1234",
+			headers:        http.Header{"X-Forwarded-For": {"198.51.100.1:4567"}},
+			expectedIP:     "198.51.100.1",
+			expectedScheme: "http",
+		},
+		"it should parse the Forwarded header": {
+			remoteAddr: "10.0.0.1:1234",
+			headers: http.Header{
+				"Forwarded":       {`for="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.2;proto=http`},
+				"X-Forwarded-For": {"192.0.2.1"},
+			},
+			expectedIP:     "2001:db8:cafe::17",
+			expectedScheme: "https",
+		},
+		"it should keep an obfuscated identifier of the Forwarded header": {
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        http.Header{"Forwarded": {"for=_hidden;proto=https"}},
+			expectedIP:     "_hidden",
+			expectedScheme: "https",
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = example.remoteAddr
+			if example.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range example.headers {
+				r.Header[k] = v
+			}
+
+			origin := proxies.Resolve(r)
+			assert.Equal(t, example.expectedIP, origin.IP)
+			assert.Equal(t, example.expectedScheme, origin.Scheme)
+		})
+	}
+}
+
+func TestNewTrustedProxies(t *testing.T) {
+	_, err := NewTrustedProxies("10.0.0.0/33")
+	require.Error(t, err)
+
+	_, err = NewTrustedProxies("not-an-ip")
+	require.Error(t, err)
+}
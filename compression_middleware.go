@@ -0,0 +1,399 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+)
+
+type CompressionEncoding string
+
+const (
+	CompressionGzip    CompressionEncoding = "gzip"
+	CompressionDeflate CompressionEncoding = "deflate"
+	CompressionZstd    CompressionEncoding = "zstd"
+)
+
+const compressionDefaultMinSize = 1024
+
+var (
+	// compressionDefaultEncodings are the encodings by order of preference
+	compressionDefaultEncodings    = []CompressionEncoding{CompressionZstd, CompressionGzip, CompressionDeflate}
+	compressionDefaultContentTypes = []string{
+		"text/*", "application/json", "+json", "application/xml", "+xml", "application/javascript",
+	}
+)
+
+type compressionMiddleware struct {
+	// encodings are the supported encodings by order of preference
+	encodings []CompressionEncoding
+	// minSize is the minimum size of the compressed response bodies
+	minSize int
+	// contentTypes are the media types of the compressed responses. A type
+	// ending with "/*" matches any subtype, and a type starting with "+" is a
+	// structured syntax suffix, e.g. +json.
+	contentTypes []string
+	compressors  map[CompressionEncoding]*sync.Pool
+}
+
+type CompressionMiddlewareOption func(m *compressionMiddleware)
+
+// WithCompressionEncodings sets the supported encodings by order of preference,
+// used when the client accepts several encodings with the same quality (zstd,
+// gzip and deflate by default)
+func WithCompressionEncodings(encodings ...CompressionEncoding) CompressionMiddlewareOption {
+	return func(m *compressionMiddleware) {
+		m.encodings = encodings
+	}
+}
+
+// WithCompressionMinSize sets the minimum size in bytes of the compressed
+// response bodies (1KiB by default). Smaller bodies are sent uncompressed.
+func WithCompressionMinSize(size int) CompressionMiddlewareOption {
+	return func(m *compressionMiddleware) {
+		m.minSize = size
+	}
+}
+
+// WithCompressionContentTypes sets the media types of the compressed responses
+// (text/*, application/json, +json, application/xml, +xml and
+// application/javascript by default). A value ending with "/*" matches any
+// subtype, and a value starting with "+" matches any media type with this
+// suffix.
+func WithCompressionContentTypes(contentTypes ...string) CompressionMiddlewareOption {
+	return func(m *compressionMiddleware) {
+		m.contentTypes = nil
+		for _, contentType := range contentTypes {
+			m.contentTypes = append(m.contentTypes, strings.ToLower(contentType))
+		}
+	}
+}
+
+// NewCompressionMiddleware initializes a middleware compressing the response
+// bodies with the encoding negotiated with the Accept-Encoding header. The
+// bodies are buffered until the minimum size is reached, the responses which
+// are too small, already encoded or of another media type are sent as is.
+//
+// The middleware must be used before the ErrorMiddleware for the error
+// responses to be compressed. The size logged by the LoggingMiddleware is the
+// compressed size.
+func NewCompressionMiddleware(options ...CompressionMiddlewareOption) Middleware {
+	m := &compressionMiddleware{
+		encodings:    compressionDefaultEncodings,
+		minSize:      compressionDefaultMinSize,
+		contentTypes: compressionDefaultContentTypes,
+		compressors:  map[CompressionEncoding]*sync.Pool{},
+	}
+	for _, opt := range options {
+		opt(m)
+	}
+	for _, encoding := range m.encodings {
+		m.compressors[encoding] = &sync.Pool{}
+	}
+	return m
+}
+
+func (m *compressionMiddleware) Apply(next HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		// The response depends on the Accept-Encoding header even if it is not
+		// compressed, e.g. because it is too small
+		addVary(w.Header(), "Accept-Encoding")
+
+		encoding := m.negotiate(r.Header.Values("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			return next(w, r, vars)
+		}
+
+		cw := &compressWriter{ResponseWriter: w, m: m, encoding: encoding}
+		err := next(cw, r, vars)
+		closeErr := cw.close()
+		if err != nil {
+			return err
+		}
+		if closeErr != nil {
+			return errors.Wrapf(r.Context(), closeErr, "close %s compressor", encoding)
+		}
+		return nil
+	}
+}
+
+// negotiate returns the supported encoding with the highest quality in the
+// Accept-Encoding header, or an empty string if the response must not be
+// encoded
+func (m *compressionMiddleware) negotiate(acceptEncoding []string) CompressionEncoding {
+	qualities := map[string]float64{}
+	for _, value := range splitHeaderValues(acceptEncoding) {
+		coding, params, _ := strings.Cut(value, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "x-gzip" {
+			coding = string(CompressionGzip)
+		}
+		quality := 1.0
+		name, q, ok := strings.Cut(strings.TrimSpace(params), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "q") {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(q), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				continue
+			}
+			quality = parsed
+		}
+		qualities[coding] = quality
+	}
+
+	var best CompressionEncoding
+	bestQuality := 0.0
+	for _, encoding := range m.encodings {
+		quality, ok := qualities[string(encoding)]
+		if !ok {
+			quality = qualities["*"]
+		}
+		if quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+func (m *compressionMiddleware) isCompressible(contentType string) bool {
+	return matchMediaType(m.contentTypes, contentType)
+}
+
+// matchMediaType returns true if the media type of contentType is in
+// mediaTypes. A value of mediaTypes ending with "/*" matches any subtype, and a
+// value starting with "+" is a structured syntax suffix, e.g. +json.
+func matchMediaType(mediaTypes []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, candidate := range mediaTypes {
+		switch {
+		case strings.HasPrefix(candidate, "+"):
+			if strings.HasSuffix(mediaType, candidate) {
+				return true
+			}
+		case strings.HasSuffix(candidate, "/*"):
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(candidate, "*")) {
+				return true
+			}
+		case mediaType == candidate:
+			return true
+		}
+	}
+	return false
+}
+
+// compressor is implemented by the gzip, zlib and zstd writers
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+func (m *compressionMiddleware) getCompressor(encoding CompressionEncoding, w io.Writer) (compressor, error) {
+	pool := m.compressors[encoding]
+	if c, ok := pool.Get().(compressor); ok {
+		c.Reset(w)
+		return c, nil
+	}
+	switch encoding {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionDeflate:
+		return zlib.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("unsupported encoding %s", encoding)
+}
+
+func (m *compressionMiddleware) putCompressor(encoding CompressionEncoding, c compressor) {
+	// Do not keep a reference to the response writer
+	c.Reset(io.Discard)
+	m.compressors[encoding].Put(c)
+}
+
+// compressWriter buffers the beginning of the response body until it knows
+// whether the response must be compressed, i.e. until the minimum size is
+// reached, the response is flushed or the handler returns.
+type compressWriter struct {
+	http.ResponseWriter
+	m        *compressionMiddleware
+	encoding CompressionEncoding
+
+	statusCode int
+	buffer     []byte
+	// started is true once the headers have been written to the
+	// ResponseWriter
+	started    bool
+	compressor compressor
+}
+
+func (cw *compressWriter) WriteHeader(statusCode int) {
+	if cw.started || cw.statusCode != 0 {
+		return
+	}
+	// The informational responses are sent as is
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		cw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	cw.statusCode = statusCode
+	if !cw.mayCompress() {
+		cw.start(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.statusCode == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.started {
+		if cw.compressor != nil {
+			return cw.compressor.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+
+	cw.buffer = append(cw.buffer, b...)
+	if len(cw.buffer) < cw.m.minSize {
+		return len(b), nil
+	}
+	err := cw.start(true)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (cw *compressWriter) Flush() {
+	if cw.statusCode == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.started {
+		// A streamed response is compressed whatever its size
+		_ = cw.start(true)
+	}
+	if cw.compressor != nil {
+		_ = cw.compressor.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap is used by http.ResponseController
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// mayCompress returns false if the response must not be compressed whatever
+// the size of its body
+func (cw *compressWriter) mayCompress() bool {
+	switch cw.statusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusSwitchingProtocols:
+		return false
+	}
+	header := cw.Header()
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	if contentType := header.Get("Content-Type"); contentType != "" && !cw.m.isCompressible(contentType) {
+		return false
+	}
+	if contentLength, err := strconv.Atoi(header.Get("Content-Length")); err == nil && contentLength < cw.m.minSize {
+		return false
+	}
+	return true
+}
+
+// start writes the headers and the buffered body to the ResponseWriter, through
+// a compressor if compress is true and the response may be compressed
+func (cw *compressWriter) start(compress bool) error {
+	cw.started = true
+	header := cw.Header()
+	if header.Get("Content-Type") == "" && len(cw.buffer) > 0 {
+		// The body must be sniffed before being compressed
+		header.Set("Content-Type", http.DetectContentType(cw.buffer))
+	}
+
+	if compress && cw.mayCompress() {
+		c, err := cw.m.getCompressor(cw.encoding, cw.ResponseWriter)
+		if err == nil {
+			cw.compressor = c
+			header.Set("Content-Encoding", string(cw.encoding))
+			header.Del("Content-Length")
+			header.Del("Accept-Ranges")
+			// The compressed representation is not byte-for-byte identical
+			if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				header.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.statusCode)
+	if len(cw.buffer) == 0 {
+		return nil
+	}
+	var err error
+	if cw.compressor != nil {
+		_, err = cw.compressor.Write(cw.buffer)
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buffer)
+	}
+	cw.buffer = nil
+	return err
+}
+
+// close sends the body still buffered, uncompressed as it is smaller than the
+// minimum size, and terminates the compressed stream
+func (cw *compressWriter) close() error {
+	if cw.statusCode == 0 {
+		// Nothing has been written, the outer middlewares may still write the
+		// response
+		return nil
+	}
+	if !cw.started {
+		err := cw.start(false)
+		if err != nil {
+			return err
+		}
+	}
+	if cw.compressor == nil {
+		return nil
+	}
+	err := cw.compressor.Close()
+	cw.m.putCompressor(cw.encoding, cw.compressor)
+	cw.compressor = nil
+	return err
+}
+
+// addVary adds value to the Vary header if it is not already listed
+func addVary(header http.Header, value string) {
+	for _, v := range splitHeaderValues(header.Values("Vary")) {
+		if v == "*" || strings.EqualFold(v, value) {
+			return
+		}
+	}
+	header.Add("Vary", value)
+}
@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	stderr "errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decompress(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+	var reader io.Reader
+	var err error
+	switch encoding {
+	case "gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+	case "zstd":
+		reader, err = zstd.NewReader(bytes.NewReader(body))
+	default:
+		return string(body)
+	}
+	require.NoError(t, err)
+	res, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return string(res)
+}
+
+func TestCompressionMiddleware_Negotiate(t *testing.T) {
+	examples := map[string]struct {
+		options          []CompressionMiddlewareOption
+		acceptEncoding   string
+		expectedEncoding CompressionEncoding
+	}{
+		"it should not encode without Accept-Encoding": {
+			expectedEncoding: "",
+		},
+		"it should use the preferred encoding": {
+			acceptEncoding:   "gzip, deflate, zstd",
+			expectedEncoding: CompressionZstd,
+		},
+		"it should use the encoding with the highest quality": {
+			acceptEncoding:   "zstd;q=0.5, gzip;q=0.8, deflate",
+			expectedEncoding: CompressionDeflate,
+		},
+		"it should use the preference set in the options": {
+			options:          []CompressionMiddlewareOption{WithCompressionEncodings(CompressionGzip, CompressionZstd)},
+			acceptEncoding:   "zstd, gzip",
+			expectedEncoding: CompressionGzip,
+		},
+		"it should not use the encodings with a quality of 0": {
+			acceptEncoding:   "zstd;q=0, gzip;q=0",
+			expectedEncoding: "",
+		},
+		"it should accept the wildcard": {
+			acceptEncoding:   "zstd;q=0, *",
+			expectedEncoding: CompressionGzip,
+		},
+		"it should accept x-gzip": {
+			acceptEncoding:   "x-gzip",
+			expectedEncoding: CompressionGzip,
+		},
+		"it should ignore the unsupported encodings": {
+			acceptEncoding:   "br, identity",
+			expectedEncoding: "",
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			m := NewCompressionMiddleware(example.options...).(*compressionMiddleware)
+			var acceptEncoding []string
+			if example.acceptEncoding != "" {
+				acceptEncoding = []string{example.acceptEncoding}
+			}
+			assert.Equal(t, example.expectedEncoding, m.negotiate(acceptEncoding))
+		})
+	}
+}
+
+func TestCompressionMiddleware(t *testing.T) {
+	largeBody := strings.Repeat(`{"name":"my-app"},`, 100)
+
+	examples := map[string]struct {
+		method           string
+		acceptEncoding   string
+		handler          HandlerFunc
+		expectedEncoding string
+		expectedBody     string
+		expectedHeaders  map[string]string
+	}{
+		"it should compress a large JSON body with gzip": {
+			acceptEncoding: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Length", "1800")
+				w.Header().Set("ETag", `"v1"`)
+				_, err := io.WriteString(w, largeBody)
+				return err
+			},
+			expectedEncoding: "gzip",
+			expectedBody:     largeBody,
+			expectedHeaders:  map[string]string{"Content-Length": "", "ETag": `W/"v1"`},
+		},
+		"it should compress a large body with deflate": {
+			acceptEncoding: "deflate",
+			handler: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				_, err := io.WriteString(w, largeBody)
+				return err
+			},
+			expectedEncoding: "deflate",
+			expectedBody:     largeBody,
+		},
+		"it should compress a body written in several chunks with zstd": {
+			acceptEncoding: "zstd",
+			handler: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				w.Header().Set("Content-Type", "application/vnd.api+json")
+				w.WriteHeader(http.StatusCreated)
+				for i := 0; i < 100; i++ {
+					_, err := io.WriteString(w, `{"name":"my-app"},`)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			expectedEncoding: "zstd",
+			expectedBody:     largeBody,
+		},
+		"it should sniff the content type before compressing": {
+			acceptEncoding: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				_, err := io.WriteString(w, largeBody)
+				return err
+			},
+			expectedEncoding: "gzip",
+			expectedBody:     largeBody,
+			expectedHeaders:  map[string]string{"Content-Type": "text/plain; charset=utf-8"},
+		},
+		"it should not compress a small body": {
+			acceptEncoding: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				w.Header().Set("Content-Type", "application/json")
+				_, err := io.WriteString(w, `{"name":"my-app"}`)
+				return err
+			},
+			expectedBody: `{"name":"my-app"}`,
+		},
+		"it should not compress other content types": {
+			acceptEncoding: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				w.Header().Set("Content-Type", "image/png")
+				_, err := io.WriteString(w, largeBody)
+				return err
+			},
+			expectedBody: largeBody,
+		},
+		"it should not compress an encoded body": {
+			acceptEncoding: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Encoding", "br")
+				_, err := io.WriteString(w, largeBody)
+				return err
+			},
+			expectedEncoding: "br",
+			expectedBody:     largeBody,
+		},
+		"it should not compress a response without body": {
+			acceptEncoding: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				w.WriteHeader(http.StatusNoContent)
+				return nil
+			},
+		},
+		"it should not compress without Accept-Encoding": {
+			handler: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				w.Header().Set("Content-Type", "application/json")
+				_, err := io.WriteString(w, largeBody)
+				return err
+			},
+			expectedBody: largeBody,
+		},
+		"it should compress the error responses": {
+			acceptEncoding: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				return stderr.New(strings.Repeat("internal error ", 100))
+			},
+			expectedEncoding: "gzip",
+			expectedBody:     strings.Repeat("internal error ", 100) + "\n",
+		},
+		"it should not compress the responses to HEAD requests": {
+			method:         http.MethodHead,
+			acceptEncoding: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Length", "1800")
+				return nil
+			},
+			expectedHeaders: map[string]string{"Content-Length": "1800"},
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			log, _ := test.NewNullLogger()
+			router := NewRouter(log, WithoutOtelInstrumentation())
+			router.Use(NewCompressionMiddleware())
+			router.Use(ErrorMiddleware)
+			router.HandleFunc("/apps", example.handler)
+
+			method := example.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "/apps", nil)
+			if example.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", example.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+			assert.Equal(t, example.expectedEncoding, w.Header().Get("Content-Encoding"))
+			assert.Equal(t, example.expectedBody, decompress(t, example.expectedEncoding, w.Body.Bytes()))
+			for name, value := range example.expectedHeaders {
+				assert.Equal(t, value, w.Header().Get(name), name)
+			}
+		})
+	}
+}
+
+func TestCompressionMiddleware_LoggedBytes(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	router := NewRouter(log, WithoutOtelInstrumentation())
+	router.Use(NewCompressionMiddleware())
+	router.Use(ErrorMiddleware)
+	router.HandleFunc("/apps", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		w.Header().Set("Content-Type", "application/json")
+		_, err := io.WriteString(w, strings.Repeat(`{"name":"my-app"},`, 100))
+		return err
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/apps", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	assert.Equal(t, "request completed", entry.Message)
+	assert.Equal(t, w.Body.Len(), entry.Data["bytes"])
+	assert.Less(t, w.Body.Len(), 1800)
+}
+
+func TestCompressionMiddleware_Flush(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	router := NewRouter(log, WithoutOtelInstrumentation())
+	router.Use(NewCompressionMiddleware())
+	router.Use(ErrorMiddleware)
+
+	flushed := make(chan string, 1)
+	var recorder *httptest.ResponseRecorder
+	router.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		w.Header().Set("Content-Type", "text/plain")
+		_, err := io.WriteString(w, "first event\n")
+		require.NoError(t, err)
+		require.NoError(t, http.NewResponseController(w).Flush())
+		// The event is sent even if the body is smaller than the minimum size
+		reader, err := gzip.NewReader(bytes.NewReader(recorder.Body.Bytes()))
+		require.NoError(t, err)
+		event := make([]byte, len("first event\n"))
+		_, err = io.ReadFull(reader, event)
+		require.NoError(t, err)
+		flushed <- string(event)
+		return nil
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/events", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, r)
+
+	assert.Equal(t, "first event\n", <-flushed)
+	assert.True(t, recorder.Flushed)
+	assert.Equal(t, "gzip", recorder.Header().Get("Content-Encoding"))
+	assert.Equal(t, "first event\n", decompress(t, "gzip", recorder.Body.Bytes()))
+}
+
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (r *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.hijacked = true
+	return nil, nil, nil
+}
+
+func TestCompressionMiddleware_Hijack(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	router := NewRouter(log, WithoutOtelInstrumentation())
+	router.Use(NewCompressionMiddleware())
+	router.Use(ErrorMiddleware)
+	router.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		_, _, err := http.NewResponseController(w).Hijack()
+		return err
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := &hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}
+	router.ServeHTTP(w, r)
+
+	assert.True(t, w.hijacked)
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+)
+
+const concurrencyDefaultRetryAfter = time.Second
+
+// ConcurrencyLimit is the maximum number of requests handled concurrently. The
+// requests over the limit wait in a queue of MaxQueued requests during at most
+// QueueTimeout. The requests which cannot be queued or which time out are
+// shed.
+type ConcurrencyLimit struct {
+	// MaxInFlight lower or equal to 0 disables the limit
+	MaxInFlight int
+	// MaxQueued is 0 by default, i.e. the requests over the limit are
+	// immediately shed
+	MaxQueued int
+	// QueueTimeout is the maximum time spent in the queue. 0 means that the
+	// queued requests wait until a slot is available or the request is
+	// canceled.
+	QueueTimeout time.Duration
+}
+
+type ConcurrencyStats struct {
+	InFlight int
+	Queued   int
+}
+
+// ConcurrencyLimiter is a middleware capping the number of requests handled
+// concurrently, globally and per route
+type ConcurrencyLimiter struct {
+	global *concurrencyGate
+	// routes are the gates of specific routes, by path template or route name
+	routes     map[string]*concurrencyGate
+	retryAfter time.Duration
+}
+
+type ConcurrencyLimiterOption func(l *ConcurrencyLimiter)
+
+// WithRouteConcurrencyLimit sets the limit of a route, identified by its path
+// template (e.g. /apps/{app_id}/deployments) or its name. The requests to this
+// route are also subject to the global limit.
+func WithRouteConcurrencyLimit(route string, limit ConcurrencyLimit) ConcurrencyLimiterOption {
+	return func(l *ConcurrencyLimiter) {
+		l.routes[route] = newConcurrencyGate(limit)
+	}
+}
+
+// WithConcurrencyRetryAfter sets the Retry-After header of the shed requests
+// (1 second by default)
+func WithConcurrencyRetryAfter(retryAfter time.Duration) ConcurrencyLimiterOption {
+	return func(l *ConcurrencyLimiter) {
+		l.retryAfter = retryAfter
+	}
+}
+
+// NewConcurrencyLimiter initializes a middleware limiting the number of
+// requests handled concurrently. The shed requests are rejected with a
+// *ServiceUnavailableError, rendered as 503 with a Retry-After header and logged
+// at warning level by the ErrorMiddleware. A queued request canceled by the
+// client returns a ClientClosedRequestError (499). The number of requests in
+// flight and the time spent in the queue are added to the request completed
+// log.
+func NewConcurrencyLimiter(limit ConcurrencyLimit, options ...ConcurrencyLimiterOption) *ConcurrencyLimiter {
+	l := &ConcurrencyLimiter{
+		global:     newConcurrencyGate(limit),
+		routes:     map[string]*concurrencyGate{},
+		retryAfter: concurrencyDefaultRetryAfter,
+	}
+	for _, opt := range options {
+		opt(l)
+	}
+	return l
+}
+
+// Stats returns the number of requests currently handled and queued
+func (l *ConcurrencyLimiter) Stats() ConcurrencyStats {
+	return l.global.stats()
+}
+
+// RouteStats returns the number of requests to a route with a specific limit
+// currently handled and queued
+func (l *ConcurrencyLimiter) RouteStats(route string) (ConcurrencyStats, bool) {
+	gate, ok := l.routes[route]
+	if !ok {
+		return ConcurrencyStats{}, false
+	}
+	return gate.stats(), true
+}
+
+// RegisterMetrics registers the http.server.concurrency.in_flight and
+// http.server.concurrency.queued gauges. The gauges of the routes with a
+// specific limit are labelled with the http.route attribute.
+func (l *ConcurrencyLimiter) RegisterMetrics(ctx context.Context, provider metric.MeterProvider) error {
+	meter := provider.Meter(metricsInstrumentationName)
+
+	inFlight, err := meter.Int64ObservableGauge("http.server.concurrency.in_flight",
+		metric.WithDescription("Number of HTTP requests currently handled under the concurrency limit."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return errors.Wrap(ctx, err, "create in flight requests gauge")
+	}
+	queued, err := meter.Int64ObservableGauge("http.server.concurrency.queued",
+		metric.WithDescription("Number of HTTP requests waiting for the concurrency limit."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return errors.Wrap(ctx, err, "create queued requests gauge")
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		stats := l.Stats()
+		o.ObserveInt64(inFlight, int64(stats.InFlight))
+		o.ObserveInt64(queued, int64(stats.Queued))
+		for route, gate := range l.routes {
+			stats := gate.stats()
+			attributes := metric.WithAttributes(attribute.String("http.route", route))
+			o.ObserveInt64(inFlight, int64(stats.InFlight), attributes)
+			o.ObserveInt64(queued, int64(stats.Queued), attributes)
+		}
+		return nil
+	}, inFlight, queued)
+	if err != nil {
+		return errors.Wrap(ctx, err, "register concurrency gauges callback")
+	}
+	return nil
+}
+
+func (l *ConcurrencyLimiter) Apply(next HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		ctx := r.Context()
+		before := time.Now()
+
+		// The route slot is acquired first so that the requests waiting for a
+		// congested route do not hold the global slots
+		gates := []*concurrencyGate{l.global}
+		if gate := l.routeGate(r); gate != nil {
+			gates = []*concurrencyGate{gate, l.global}
+		}
+		queued := false
+		for i, gate := range gates {
+			gateQueued, err := gate.acquire(ctx)
+			queued = queued || gateQueued
+			if err != nil {
+				for _, acquired := range gates[:i] {
+					acquired.release()
+				}
+				if errors.Is(err, context.Canceled) {
+					return ClientClosedRequestError{}
+				}
+				return &ServiceUnavailableError{Reason: err.Error(), RetryAfter: l.retryAfter}
+			}
+		}
+		defer func() {
+			for _, gate := range gates {
+				gate.release()
+			}
+		}()
+
+		fields := logrus.Fields{"in_flight": l.global.stats().InFlight}
+		if queued {
+			fields["queue_duration"] = time.Since(before).Seconds()
+		}
+		AddRequestLogFields(ctx, fields)
+		return next(w, r, vars)
+	}
+}
+
+func (l *ConcurrencyLimiter) routeGate(r *http.Request) *concurrencyGate {
+	if len(l.routes) == 0 {
+		return nil
+	}
+	template, name := currentRoute(r)
+	if gate, ok := l.routes[template]; ok && template != "" {
+		return gate
+	}
+	if gate, ok := l.routes[name]; ok && name != "" {
+		return gate
+	}
+	return nil
+}
+
+type concurrencyGate struct {
+	limit ConcurrencyLimit
+	// slots contains a value per request in flight
+	slots  chan struct{}
+	queued atomic.Int64
+}
+
+func newConcurrencyGate(limit ConcurrencyLimit) *concurrencyGate {
+	g := &concurrencyGate{limit: limit}
+	if limit.MaxInFlight > 0 {
+		g.slots = make(chan struct{}, limit.MaxInFlight)
+	}
+	return g
+}
+
+func (g *concurrencyGate) stats() ConcurrencyStats {
+	return ConcurrencyStats{InFlight: len(g.slots), Queued: int(g.queued.Load())}
+}
+
+// acquire waits for a slot and returns whether the request has been queued. It
+// returns an error if the request is shed.
+func (g *concurrencyGate) acquire(ctx context.Context) (bool, error) {
+	if g.slots == nil {
+		return false, nil
+	}
+	select {
+	case g.slots <- struct{}{}:
+		return false, nil
+	default:
+	}
+
+	if g.queued.Add(1) > int64(g.limit.MaxQueued) {
+		g.queued.Add(-1)
+		return false, errors.New(ctx, "concurrency limit reached")
+	}
+	defer g.queued.Add(-1)
+
+	var timeout <-chan time.Time
+	if g.limit.QueueTimeout > 0 {
+		timer := time.NewTimer(g.limit.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case g.slots <- struct{}{}:
+		return true, nil
+	case <-timeout:
+		return true, errors.New(ctx, "concurrency queue timeout")
+	case <-ctx.Done():
+		return true, errors.Wrap(ctx, ctx.Err(), "wait in concurrency queue")
+	}
+}
+
+func (g *concurrencyGate) release() {
+	if g.slots == nil {
+		return
+	}
+	<-g.slots
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// blockingRouter returns a router whose handlers block until release is
+// closed. started receives a value when a handler starts.
+func blockingRouter(t *testing.T, limiter *ConcurrencyLimiter) (*Router, chan struct{}, chan struct{}, *test.Hook) {
+	t.Helper()
+	log, hook := test.NewNullLogger()
+	router := NewRouter(log, WithoutOtelInstrumentation())
+	router.Use(ErrorMiddleware)
+	router.Use(limiter)
+
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	handler := func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+	router.HandleFunc("/apps", handler)
+	router.HandleFunc("/apps/{app}/deployments", handler)
+	return router, started, release, hook
+}
+
+func serveAsync(router *Router, path string) (*httptest.ResponseRecorder, *sync.WaitGroup) {
+	w := httptest.NewRecorder()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	}()
+	return w, wg
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	t.Run("it should shed the requests over the limit", func(t *testing.T) {
+		limiter := NewConcurrencyLimiter(ConcurrencyLimit{MaxInFlight: 1}, WithConcurrencyRetryAfter(5*time.Second))
+		router, started, release, hook := blockingRouter(t, limiter)
+
+		first, wg := serveAsync(router, "/apps")
+		<-started
+		assert.Equal(t, ConcurrencyStats{InFlight: 1}, limiter.Stats())
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/apps", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "5", w.Header().Get("Retry-After"))
+		assert.Equal(t, "service unavailable: concurrency limit reached\n", w.Body.String())
+		for _, entry := range hook.AllEntries() {
+			assert.Greater(t, entry.Level, logrus.ErrorLevel, entry.Message)
+		}
+
+		close(release)
+		wg.Wait()
+		assert.Equal(t, http.StatusOK, first.Code)
+		assert.Equal(t, ConcurrencyStats{}, limiter.Stats())
+	})
+
+	t.Run("it should shed the queued requests after the queue timeout", func(t *testing.T) {
+		limiter := NewConcurrencyLimiter(ConcurrencyLimit{MaxInFlight: 1, MaxQueued: 1, QueueTimeout: 50 * time.Millisecond})
+		router, started, release, _ := blockingRouter(t, limiter)
+
+		_, wg := serveAsync(router, "/apps")
+		defer func() {
+			close(release)
+			wg.Wait()
+		}()
+		<-started
+
+		queued, queuedWg := serveAsync(router, "/apps")
+		require.Eventually(t, func() bool {
+			return limiter.Stats().Queued == 1
+		}, time.Second, time.Millisecond)
+
+		// The queue is full
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/apps", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+		queuedWg.Wait()
+		assert.Equal(t, http.StatusServiceUnavailable, queued.Code)
+		assert.Equal(t, "service unavailable: concurrency queue timeout\n", queued.Body.String())
+		assert.Equal(t, ConcurrencyStats{InFlight: 1}, limiter.Stats())
+	})
+
+	t.Run("it should handle the queued requests once a slot is released", func(t *testing.T) {
+		limiter := NewConcurrencyLimiter(ConcurrencyLimit{MaxInFlight: 1, MaxQueued: 1})
+		router, started, release, hook := blockingRouter(t, limiter)
+
+		first, wg := serveAsync(router, "/apps")
+		<-started
+		queued, queuedWg := serveAsync(router, "/apps")
+		require.Eventually(t, func() bool {
+			return limiter.Stats().Queued == 1
+		}, time.Second, time.Millisecond)
+
+		close(release)
+		wg.Wait()
+		queuedWg.Wait()
+		assert.Equal(t, http.StatusOK, first.Code)
+		assert.Equal(t, http.StatusOK, queued.Code)
+
+		var queueDurations int
+		for _, entry := range hook.AllEntries() {
+			if entry.Message != "request completed" {
+				continue
+			}
+			assert.Equal(t, 1, entry.Data["in_flight"])
+			if _, ok := entry.Data["queue_duration"]; ok {
+				queueDurations++
+			}
+		}
+		assert.Equal(t, 1, queueDurations)
+	})
+
+	t.Run("it should stop waiting in the queue if the client closes the request", func(t *testing.T) {
+		limiter := NewConcurrencyLimiter(ConcurrencyLimit{MaxInFlight: 1, MaxQueued: 1})
+		router, started, release, _ := blockingRouter(t, limiter)
+
+		_, wg := serveAsync(router, "/apps")
+		defer func() {
+			close(release)
+			wg.Wait()
+		}()
+		<-started
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/apps", nil).WithContext(ctx))
+		assert.Equal(t, 499, w.Code)
+		assert.Equal(t, ConcurrencyStats{InFlight: 1}, limiter.Stats())
+	})
+
+	t.Run("it should limit the routes separately", func(t *testing.T) {
+		limiter := NewConcurrencyLimiter(ConcurrencyLimit{MaxInFlight: 2},
+			WithRouteConcurrencyLimit("/apps/{app}/deployments", ConcurrencyLimit{MaxInFlight: 1}),
+		)
+		router, started, release, _ := blockingRouter(t, limiter)
+
+		_, wg := serveAsync(router, "/apps/my-app/deployments")
+		<-started
+		stats, ok := limiter.RouteStats("/apps/{app}/deployments")
+		require.True(t, ok)
+		assert.Equal(t, ConcurrencyStats{InFlight: 1}, stats)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/apps/other-app/deployments", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+		// The global limit is not reached
+		other, otherWg := serveAsync(router, "/apps")
+		<-started
+		assert.Equal(t, ConcurrencyStats{InFlight: 2}, limiter.Stats())
+
+		close(release)
+		wg.Wait()
+		otherWg.Wait()
+		assert.Equal(t, http.StatusOK, other.Code)
+		stats, _ = limiter.RouteStats("/apps/{app}/deployments")
+		assert.Equal(t, ConcurrencyStats{}, stats)
+	})
+}
+
+func TestConcurrencyLimiter_RegisterMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	limiter := NewConcurrencyLimiter(ConcurrencyLimit{MaxInFlight: 2},
+		WithRouteConcurrencyLimit("/apps/{app}/deployments", ConcurrencyLimit{MaxInFlight: 1}),
+	)
+	require.NoError(t, limiter.RegisterMetrics(context.Background(), provider))
+
+	router, started, release, _ := blockingRouter(t, limiter)
+	_, wg := serveAsync(router, "/apps/my-app/deployments")
+	<-started
+
+	metrics := collectMetrics(t, reader)
+	close(release)
+	wg.Wait()
+
+	inFlight, ok := metrics["http.server.concurrency.in_flight"].(metricdata.Gauge[int64])
+	require.True(t, ok)
+	values := map[string]int64{}
+	for _, point := range inFlight.DataPoints {
+		route, _ := point.Attributes.Value(attribute.Key("http.route"))
+		values[route.AsString()] = point.Value
+	}
+	assert.Equal(t, map[string]int64{"": 1, "/apps/{app}/deployments": 1}, values)
+
+	_, ok = metrics["http.server.concurrency.queued"].(metricdata.Gauge[int64])
+	assert.True(t, ok)
+}
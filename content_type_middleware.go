@@ -1,7 +1,11 @@
 package handlers
 
 import (
+	"mime"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 var ContentTypeJSONMiddleware = MiddlewareFunc(func(handler HandlerFunc) HandlerFunc {
@@ -10,3 +14,166 @@ var ContentTypeJSONMiddleware = MiddlewareFunc(func(handler HandlerFunc) Handler
 		return handler(w, r, vars)
 	}
 })
+
+// contentTypeDefaultMediaTypes accepts JSON and the +json vendor types
+// recognized by isContentTypeJSON
+var contentTypeDefaultMediaTypes = []string{"application/json", "+json"}
+
+type contentTypeMiddleware struct {
+	// mediaTypes are the media types accepted in the request body and produced in
+	// the response. A type starting with "+" is a structured syntax suffix
+	// matching any type ending with it, e.g. +json.
+	mediaTypes []string
+}
+
+type ContentTypeMiddlewareOption func(m *contentTypeMiddleware)
+
+// WithMediaTypes sets the media types supported by the endpoints (application/json
+// and +json by default). A value starting with "+" matches any media type with
+// this suffix, e.g. +json matches application/vnd.api+json. The first media type
+// which is not a suffix is used for the responses when the client accepts any
+// type.
+func WithMediaTypes(mediaTypes ...string) ContentTypeMiddlewareOption {
+	return func(m *contentTypeMiddleware) {
+		m.mediaTypes = nil
+		for _, mediaType := range mediaTypes {
+			m.mediaTypes = append(m.mediaTypes, strings.ToLower(mediaType))
+		}
+	}
+}
+
+// NewContentTypeMiddleware initializes a middleware enforcing the media types of
+// the requests and setting the Content-Type of the responses. It returns an
+// UnsupportedMediaTypeError (415) if the body of a POST, PUT, PATCH or DELETE
+// request is not of a supported media type, and a NotAcceptableError (406) if
+// the Accept header does not allow any supported media type. The errors are
+// rendered by the ErrorMiddleware.
+func NewContentTypeMiddleware(options ...ContentTypeMiddlewareOption) Middleware {
+	m := &contentTypeMiddleware{
+		mediaTypes: contentTypeDefaultMediaTypes,
+	}
+	for _, opt := range options {
+		opt(m)
+	}
+	return m
+}
+
+func (m *contentTypeMiddleware) Apply(next HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		if hasMutatingBody(r) {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || !m.isSupported(mediaType) {
+				return &UnsupportedMediaTypeError{ContentType: r.Header.Get("Content-Type")}
+			}
+		}
+
+		responseMediaType, ok := m.negotiate(r.Header.Values("Accept"))
+		if !ok {
+			return &NotAcceptableError{Accept: strings.Join(r.Header.Values("Accept"), ", ")}
+		}
+		if responseMediaType != "" {
+			w.Header().Set("Content-Type", responseMediaType)
+		}
+		return next(w, r, vars)
+	}
+}
+
+func (m *contentTypeMiddleware) isSupported(mediaType string) bool {
+	mediaType = strings.ToLower(mediaType)
+	for _, supported := range m.mediaTypes {
+		if strings.HasPrefix(supported, "+") {
+			if strings.HasSuffix(mediaType, supported) {
+				return true
+			}
+		} else if mediaType == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultMediaType returns the first supported media type matching the media
+// range (*/* or type/*), or an empty string if there is none
+func (m *contentTypeMiddleware) defaultMediaType(mediaRange string) string {
+	for _, supported := range m.mediaTypes {
+		if strings.HasPrefix(supported, "+") {
+			continue
+		}
+		if mediaRange == "*/*" || strings.HasPrefix(supported, strings.TrimSuffix(mediaRange, "*")) {
+			return supported
+		}
+	}
+	return ""
+}
+
+// negotiate returns the media type of the response according to the Accept
+// header. It returns false if no supported media type is acceptable. Without
+// Accept header, the client accepts any media type.
+func (m *contentTypeMiddleware) negotiate(accept []string) (string, bool) {
+	mediaRanges := parseAccept(accept)
+	if len(mediaRanges) == 0 {
+		return m.defaultMediaType("*/*"), true
+	}
+	for _, mediaRange := range mediaRanges {
+		if mediaRange.quality == 0 {
+			continue
+		}
+		if strings.HasSuffix(mediaRange.mediaType, "/*") {
+			mediaType := m.defaultMediaType(mediaRange.mediaType)
+			if mediaType != "" {
+				return mediaType, true
+			}
+			continue
+		}
+		if m.isSupported(mediaRange.mediaType) {
+			return mediaRange.mediaType, true
+		}
+	}
+	return "", false
+}
+
+type acceptedMediaRange struct {
+	mediaType string
+	quality   float64
+}
+
+// parseAccept returns the media ranges of the Accept header sorted by
+// decreasing quality. The ranges with the same quality keep the order of the
+// header.
+func parseAccept(values []string) []acceptedMediaRange {
+	var mediaRanges []acceptedMediaRange
+	for _, value := range splitHeaderValues(values) {
+		mediaType, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			// Some clients send * instead of */*
+			if strings.TrimSpace(strings.Split(value, ";")[0]) != "*" {
+				continue
+			}
+			mediaType, params = "*/*", nil
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil || quality < 0 || quality > 1 {
+				continue
+			}
+		}
+		mediaRanges = append(mediaRanges, acceptedMediaRange{mediaType: mediaType, quality: quality})
+	}
+	sort.SliceStable(mediaRanges, func(i, j int) bool {
+		return mediaRanges[i].quality > mediaRanges[j].quality
+	})
+	return mediaRanges
+}
+
+// hasMutatingBody returns true if the request is a POST, PUT, PATCH or DELETE
+// request with a body
+func hasMutatingBody(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return false
+	}
+	// ContentLength is -1 if the length is unknown, e.g. with a chunked body
+	return r.ContentLength != 0 && r.Body != nil && r.Body != http.NoBody
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewContentTypeMiddleware(t *testing.T) {
+	examples := map[string]struct {
+		options             []ContentTypeMiddlewareOption
+		method              string
+		body                string
+		contentType         string
+		accept              string
+		expectedStatusCode  int
+		expectedContentType string
+		expectedBody        string
+	}{
+		"it should accept a JSON body": {
+			method:              http.MethodPost,
+			body:                `{"name":"my-app"}`,
+			contentType:         "application/json; charset=utf-8",
+			expectedStatusCode:  http.StatusOK,
+			expectedContentType: "application/json",
+		},
+		"it should accept a +json vendor body": {
+			method:              http.MethodPatch,
+			body:                `{"name":"my-app"}`,
+			contentType:         "application/merge-patch+json",
+			expectedStatusCode:  http.StatusOK,
+			expectedContentType: "application/json",
+		},
+		"it should reject a body which is not JSON": {
+			method:              http.MethodPut,
+			body:                "name=my-app",
+			contentType:         "application/x-www-form-urlencoded",
+			accept:              "application/json",
+			expectedStatusCode:  http.StatusUnsupportedMediaType,
+			expectedContentType: "application/json",
+			expectedBody:        `{"error":"unsupported Content-Type 'application/x-www-form-urlencoded'"}` + "\n",
+		},
+		"it should reject a body without content type": {
+			method:              http.MethodPost,
+			body:                `{"name":"my-app"}`,
+			expectedStatusCode:  http.StatusUnsupportedMediaType,
+			expectedContentType: "text/plain",
+			expectedBody:        "missing Content-Type\n",
+		},
+		"it should not check the content type of a request without body": {
+			method:              http.MethodPost,
+			expectedStatusCode:  http.StatusOK,
+			expectedContentType: "application/json",
+		},
+		"it should not check the content type of a GET request": {
+			method:              http.MethodGet,
+			body:                "name=my-app",
+			contentType:         "application/x-www-form-urlencoded",
+			expectedStatusCode:  http.StatusOK,
+			expectedContentType: "application/json",
+		},
+		"it should accept a wildcard Accept header": {
+			method:              http.MethodGet,
+			accept:              "text/html, */*;q=0.8",
+			expectedStatusCode:  http.StatusOK,
+			expectedContentType: "application/json",
+		},
+		"it should answer with the accepted vendor type": {
+			method:              http.MethodGet,
+			accept:              "application/json;q=0.5, application/vnd.api+json",
+			expectedStatusCode:  http.StatusOK,
+			expectedContentType: "application/vnd.api+json",
+		},
+		"it should reject an Accept header which cannot be satisfied": {
+			method:              http.MethodGet,
+			accept:              "text/html, application/xml;q=0.9",
+			expectedStatusCode:  http.StatusNotAcceptable,
+			expectedContentType: "text/plain",
+			expectedBody:        "no acceptable media type for 'text/html, application/xml;q=0.9'\n",
+		},
+		"it should reject a media type explicitly refused": {
+			method:             http.MethodGet,
+			accept:             "application/json;q=0, text/*",
+			expectedStatusCode: http.StatusNotAcceptable,
+			// The error middleware does not take the quality into account
+			expectedContentType: "application/json",
+			expectedBody:        `{"error":"no acceptable media type for 'application/json;q=0, text/*'"}` + "\n",
+		},
+		"it should support the configured media types": {
+			options:             []ContentTypeMiddlewareOption{WithMediaTypes("application/msgpack", "application/json")},
+			method:              http.MethodPost,
+			body:                "\x81",
+			contentType:         "application/msgpack",
+			accept:              "application/*",
+			expectedStatusCode:  http.StatusOK,
+			expectedContentType: "application/msgpack",
+		},
+		"it should not accept +json types if they are not configured": {
+			options:             []ContentTypeMiddlewareOption{WithMediaTypes("application/json")},
+			method:              http.MethodPost,
+			body:                `{}`,
+			contentType:         "application/vnd.api+json",
+			expectedStatusCode:  http.StatusUnsupportedMediaType,
+			expectedContentType: "text/plain",
+			expectedBody:        "unsupported Content-Type 'application/vnd.api+json'\n",
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(example.method, "/apps", nil)
+			if example.body != "" {
+				r = httptest.NewRequest(example.method, "/apps", strings.NewReader(example.body))
+			}
+			if example.contentType != "" {
+				r.Header.Set("Content-Type", example.contentType)
+			}
+			if example.accept != "" {
+				r.Header.Set("Accept", example.accept)
+			}
+			w := httptest.NewRecorder()
+
+			handler := ErrorMiddleware.Apply(NewContentTypeMiddleware(example.options...).Apply(
+				func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+					w.WriteHeader(http.StatusOK)
+					return nil
+				},
+			))
+			_ = handler(w, r, map[string]string{})
+
+			assert.Equal(t, example.expectedStatusCode, w.Code)
+			assert.Equal(t, example.expectedContentType, w.Header().Get("Content-Type"))
+			assert.Equal(t, example.expectedBody, w.Body.String())
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Scalingo/go-utils/logger"
+)
+
+// contextKey is the type of the keys used to store values in the request
+// context. Being unexported, it prevents collisions with other packages.
+type contextKey int
+
+const (
+	requestIDContextKey contextKey = iota
+	clientOriginContextKey
+	cspNonceContextKey
+	requestLogFieldsContextKey
+	conditionalRequestContextKey
+)
+
+// RequestIDFromContext returns the request ID stored in the context by the
+// RequestIDMiddleware. The request ID stored by a service under the legacy
+// "request_id" string key is returned if there is none.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDContextKey).(string)
+	if !ok {
+		id, ok = ctx.Value(legacyRequestIDContextKey).(string)
+	}
+	return id, ok && id != ""
+}
+
+// legacyRequestIDContextKey is the string key under which the request ID was
+// stored before the typed accessors. It is still set for the consumers calling
+// ctx.Value("request_id").
+const legacyRequestIDContextKey = "request_id"
+
+// ContextWithRequestID returns a copy of ctx in which the request ID is stored.
+// The request ID is also stored under the legacy "request_id" string key.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	//nolint:staticcheck // The legacy string key is kept for backward compatibility
+	ctx = context.WithValue(ctx, legacyRequestIDContextKey, id)
+	return context.WithValue(ctx, requestIDContextKey, id)
+}
+
+// ClientOriginFromContext returns the client origin stored in the context by the
+// client origin middleware
+func ClientOriginFromContext(ctx context.Context) (ClientOrigin, bool) {
+	origin, ok := ctx.Value(clientOriginContextKey).(ClientOrigin)
+	return origin, ok
+}
+
+// ContextWithClientOrigin returns a copy of ctx in which the client origin is
+// stored
+func ContextWithClientOrigin(ctx context.Context, origin ClientOrigin) context.Context {
+	return context.WithValue(ctx, clientOriginContextKey, origin)
+}
+
+// CSPNonceFromContext returns the Content-Security-Policy nonce generated for
+// the request by the secure headers middleware. It must be set in the nonce
+// attribute of the inline scripts and styles.
+func CSPNonceFromContext(ctx context.Context) (string, bool) {
+	nonce, ok := ctx.Value(cspNonceContextKey).(string)
+	return nonce, ok && nonce != ""
+}
+
+// ContextWithCSPNonce returns a copy of ctx in which the Content-Security-Policy
+// nonce is stored
+func ContextWithCSPNonce(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, cspNonceContextKey, nonce)
+}
+
+// LoggerFromContext returns the request logger stored in the context by the
+// LoggingMiddleware, or the default logger if there is none. It is equivalent
+// to logger.Get from go-utils.
+func LoggerFromContext(ctx context.Context) logrus.FieldLogger {
+	return logger.Get(ctx)
+}
+
+// ContextWithLogger returns a copy of ctx in which the logger is stored. The
+// logger is stored with go-utils so that logger.Get keeps returning it.
+func ContextWithLogger(ctx context.Context, log logrus.FieldLogger) context.Context {
+	return logger.ToCtx(ctx, log)
+}
+
+// requestLogFields are the fields added to the request completed log of the
+// LoggingMiddleware by the inner middlewares and the handler
+type requestLogFields struct {
+	mutex  sync.Mutex
+	fields logrus.Fields
+}
+
+func contextWithRequestLogFields(ctx context.Context) (context.Context, *requestLogFields) {
+	fields := &requestLogFields{fields: logrus.Fields{}}
+	return context.WithValue(ctx, requestLogFieldsContextKey, fields), fields
+}
+
+// AddRequestLogFields adds fields to the request completed log written by the
+// LoggingMiddleware. It returns false if the request is not handled by a
+// LoggingMiddleware. It is safe to call it concurrently.
+func AddRequestLogFields(ctx context.Context, fields logrus.Fields) bool {
+	logFields, ok := ctx.Value(requestLogFieldsContextKey).(*requestLogFields)
+	if !ok {
+		return false
+	}
+	logFields.mutex.Lock()
+	defer logFields.mutex.Unlock()
+	for k, v := range fields {
+		logFields.fields[k] = v
+	}
+	return true
+}
+
+func (f *requestLogFields) get() logrus.Fields {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	fields := make(logrus.Fields, len(f.fields))
+	for k, v := range f.fields {
+		fields[k] = v
+	}
+	return fields
+}
+
+// SetResponseETag sets the entity tag of the response used by the ETagMiddleware
+// instead of computing it from the body. etag is quoted if it is not already,
+// e.g. "v42" or W/"v42" for a weak entity tag. It returns false if the request
+// is not handled by an ETagMiddleware.
+func SetResponseETag(ctx context.Context, etag string) bool {
+	conditional, ok := ctx.Value(conditionalRequestContextKey).(*conditionalRequest)
+	if !ok {
+		return false
+	}
+	conditional.mutex.Lock()
+	defer conditional.mutex.Unlock()
+	conditional.etag = quoteETag(etag)
+	return true
+}
+
+// SetResponseLastModified sets the modification date of the response, sent in
+// the Last-Modified header and compared to the If-Modified-Since and
+// If-Unmodified-Since headers by the ETagMiddleware. It returns false if the
+// request is not handled by an ETagMiddleware.
+func SetResponseLastModified(ctx context.Context, lastModified time.Time) bool {
+	conditional, ok := ctx.Value(conditionalRequestContextKey).(*conditionalRequest)
+	if !ok {
+		return false
+	}
+	conditional.mutex.Lock()
+	defer conditional.mutex.Unlock()
+	conditional.lastModified = lastModified
+	return true
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Scalingo/go-utils/logger"
+)
+
+func TestRequestIDFromContext(t *testing.T) {
+	t.Run("it should return the stored request ID", func(t *testing.T) {
+		id, ok := RequestIDFromContext(ContextWithRequestID(context.Background(), "my-id"))
+		assert.True(t, ok)
+		assert.Equal(t, "my-id", id)
+	})
+
+	t.Run("it should not return any request ID if none is stored", func(t *testing.T) {
+		_, ok := RequestIDFromContext(context.Background())
+		assert.False(t, ok)
+	})
+
+	t.Run("it should store the request ID under the legacy string key", func(t *testing.T) {
+		ctx := ContextWithRequestID(context.Background(), "my-id")
+		assert.Equal(t, "my-id", ctx.Value("request_id"))
+	})
+
+	t.Run("it should return the request ID stored under the legacy string key", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), "request_id", "legacy")
+		id, ok := RequestIDFromContext(ctx)
+		assert.True(t, ok)
+		assert.Equal(t, "legacy", id)
+	})
+
+	t.Run("it should prefer the request ID stored with the typed key", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), "request_id", "legacy")
+		id, ok := RequestIDFromContext(ContextWithRequestID(ctx, "my-id"))
+		assert.True(t, ok)
+		assert.Equal(t, "my-id", id)
+	})
+}
+
+func TestContextWithLogger(t *testing.T) {
+	t.Run("it should store a logger readable by go-utils logger.Get", func(t *testing.T) {
+		log := logrus.New().WithField("field", "value")
+		ctx := ContextWithLogger(context.Background(), log)
+
+		assert.Equal(t, log, logger.Get(ctx))
+		assert.Equal(t, log, LoggerFromContext(ctx))
+	})
+}
+
+func TestAddRequestLogFields(t *testing.T) {
+	t.Run("it should return false without logging middleware", func(t *testing.T) {
+		assert.False(t, AddRequestLogFields(context.Background(), logrus.Fields{"field": "value"}))
+	})
+
+	t.Run("it should merge the fields", func(t *testing.T) {
+		ctx, fields := contextWithRequestLogFields(context.Background())
+		assert.True(t, AddRequestLogFields(ctx, logrus.Fields{"a": 1, "b": 2}))
+		assert.True(t, AddRequestLogFields(ctx, logrus.Fields{"b": 3}))
+		assert.Equal(t, logrus.Fields{"a": 1, "b": 3}, fields.get())
+	})
+}
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+)
+
+const (
+	decompressionDefaultMaxSize  = 10 << 20
+	decompressionDefaultMaxRatio = 100
+	// decompressionRatioMinSize is the decompressed size from which the ratio
+	// is checked, so that small and highly compressible bodies are accepted
+	decompressionRatioMinSize = 1 << 20
+	// decompressionZstdMaxWindow is the maximum window size allowed by the zstd
+	// content coding (RFC 9659)
+	decompressionZstdMaxWindow = 8 << 20
+)
+
+type decompressionMiddleware struct {
+	maxSize  int64
+	maxRatio float64
+}
+
+type DecompressionMiddlewareOption func(m *decompressionMiddleware)
+
+// WithDecompressionMaxSize sets the maximum size in bytes of the decompressed
+// request bodies (10MiB by default). 0 disables the limit.
+func WithDecompressionMaxSize(size int64) DecompressionMiddlewareOption {
+	return func(m *decompressionMiddleware) {
+		m.maxSize = size
+	}
+}
+
+// WithDecompressionMaxRatio sets the maximum ratio between the decompressed and
+// the compressed sizes of the request bodies (100 by default). The ratio is
+// only checked once 1MiB has been decompressed. 0 disables the limit.
+func WithDecompressionMaxRatio(ratio float64) DecompressionMiddlewareOption {
+	return func(m *decompressionMiddleware) {
+		m.maxRatio = ratio
+	}
+}
+
+// NewDecompressionMiddleware initializes a middleware decoding the request
+// bodies encoded with gzip, deflate or zstd according to their
+// Content-Encoding header. The handlers read the decoded body, and the
+// Content-Encoding and Content-Length headers are removed from the request.
+//
+// A request with an unsupported encoding is rejected with an
+// *UnsupportedContentEncodingError (415). Reading a body which cannot be decoded
+// returns an *InvalidContentEncodingError (400), and reading a body exceeding
+// the maximum size or ratio a *PayloadTooLargeError or a *CompressionRatioError
+// (413). The errors are rendered by the ErrorMiddleware.
+func NewDecompressionMiddleware(options ...DecompressionMiddlewareOption) Middleware {
+	m := &decompressionMiddleware{
+		maxSize:  decompressionDefaultMaxSize,
+		maxRatio: decompressionDefaultMaxRatio,
+	}
+	for _, opt := range options {
+		opt(m)
+	}
+	return m
+}
+
+func (m *decompressionMiddleware) Apply(next HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		contentEncoding := r.Header.Get("Content-Encoding")
+		if contentEncoding == "" || r.Body == nil || r.Body == http.NoBody {
+			return next(w, r, vars)
+		}
+
+		var encodings []CompressionEncoding
+		for _, value := range splitHeaderValues(r.Header.Values("Content-Encoding")) {
+			value = strings.ToLower(value)
+			switch value {
+			case "identity":
+				continue
+			case "x-gzip":
+				value = string(CompressionGzip)
+			case string(CompressionGzip), string(CompressionDeflate), string(CompressionZstd):
+			default:
+				// RFC 7694: the server lists the encodings it supports
+				w.Header().Set("Accept-Encoding", "gzip, deflate, zstd")
+				return &UnsupportedContentEncodingError{ContentEncoding: contentEncoding}
+			}
+			encodings = append(encodings, CompressionEncoding(value))
+		}
+
+		// The outer middlewares keep the request describing the body they read
+		r = r.Clone(r.Context())
+		r.Body = &decompressedBody{
+			body:       r.Body,
+			compressed: &countingReader{reader: r.Body},
+			encodings:  encodings,
+			maxSize:    m.maxSize,
+			maxRatio:   m.maxRatio,
+		}
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		return next(w, r, vars)
+	}
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+	// err is the last error returned by reader, to tell the errors of the
+	// connection from the errors of the decoders
+	err error
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// decompressedBody decodes the request body on the first read, so that the
+// errors of the decoders are returned to the handler
+type decompressedBody struct {
+	body       io.ReadCloser
+	compressed *countingReader
+	encodings  []CompressionEncoding
+	maxSize    int64
+	maxRatio   float64
+
+	reader       io.Reader
+	closers      []io.Closer
+	decompressed int64
+}
+
+func (b *decompressedBody) Read(p []byte) (int, error) {
+	if b.reader == nil {
+		err := b.init()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := b.reader.Read(p)
+	b.decompressed += int64(n)
+	if b.maxSize > 0 && b.decompressed > b.maxSize {
+		return 0, &PayloadTooLargeError{Limit: b.maxSize}
+	}
+	if b.maxRatio > 0 && b.decompressed > decompressionRatioMinSize &&
+		float64(b.decompressed) > float64(b.compressed.count)*b.maxRatio {
+		return 0, &CompressionRatioError{MaxRatio: b.maxRatio}
+	}
+	if err != nil && err != io.EOF && !b.isBodyError(err) {
+		return n, &InvalidContentEncodingError{ContentEncoding: b.contentEncoding(), Err: err}
+	}
+	return n, err
+}
+
+// isBodyError returns whether err was returned by the encoded body rather than
+// by a decoder
+func (b *decompressedBody) isBodyError(err error) bool {
+	return b.compressed.err != nil && b.compressed.err != io.EOF && errors.Is(err, b.compressed.err)
+}
+
+func (b *decompressedBody) contentEncoding() string {
+	encodings := make([]string, 0, len(b.encodings))
+	for _, encoding := range b.encodings {
+		encodings = append(encodings, string(encoding))
+	}
+	return strings.Join(encodings, ", ")
+}
+
+// init chains the decoders, the last encoding applied being decoded first
+func (b *decompressedBody) init() error {
+	var reader io.Reader = b.compressed
+	for i := len(b.encodings) - 1; i >= 0; i-- {
+		var err error
+		switch b.encodings[i] {
+		case CompressionGzip:
+			var gzipReader *gzip.Reader
+			gzipReader, err = gzip.NewReader(reader)
+			if err == nil {
+				b.closers = append(b.closers, gzipReader)
+				reader = gzipReader
+			}
+		case CompressionDeflate:
+			var zlibReader io.ReadCloser
+			zlibReader, err = zlib.NewReader(reader)
+			if err == nil {
+				b.closers = append(b.closers, zlibReader)
+				reader = zlibReader
+			}
+		case CompressionZstd:
+			var zstdReader *zstd.Decoder
+			zstdReader, err = zstd.NewReader(reader,
+				zstd.WithDecoderConcurrency(1),
+				zstd.WithDecoderMaxWindow(decompressionZstdMaxWindow),
+			)
+			if err == nil {
+				b.closers = append(b.closers, zstdReader.IOReadCloser())
+				reader = zstdReader
+			}
+		}
+		if err != nil && !b.isBodyError(err) {
+			return &InvalidContentEncodingError{ContentEncoding: string(b.encodings[i]), Err: err}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	b.reader = reader
+	return nil
+}
+
+func (b *decompressedBody) Close() error {
+	for _, closer := range b.closers {
+		_ = closer.Close()
+	}
+	return b.body.Close()
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compress(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case "gzip":
+		writer = gzip.NewWriter(&buffer)
+	case "deflate":
+		writer = zlib.NewWriter(&buffer)
+	case "zstd":
+		var err error
+		writer, err = zstd.NewWriter(&buffer)
+		require.NoError(t, err)
+	default:
+		return body
+	}
+	_, err := writer.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+// corrupt flips the bits of the CRC-32 of a gzip body
+func corrupt(body []byte) []byte {
+	body = bytes.Clone(body)
+	body[len(body)-8] ^= 0xff
+	return body
+}
+
+func TestDecompressionMiddleware(t *testing.T) {
+	body := `{"app":{"name":"my-app"}}`
+
+	examples := map[string]struct {
+		options            []DecompressionMiddlewareOption
+		contentEncoding    string
+		body               []byte
+		expectedStatusCode int
+		expectedBody       string
+		expectedHeaders    map[string]string
+	}{
+		"it should pass through a body which is not encoded": {
+			body:               []byte(body),
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       body,
+		},
+		"it should decode a gzip body": {
+			contentEncoding:    "gzip",
+			body:               compress(t, "gzip", []byte(body)),
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       body,
+		},
+		"it should decode a deflate body": {
+			contentEncoding:    "deflate",
+			body:               compress(t, "deflate", []byte(body)),
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       body,
+		},
+		"it should decode a zstd body": {
+			contentEncoding:    "zstd",
+			body:               compress(t, "zstd", []byte(body)),
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       body,
+		},
+		"it should decode a body encoded several times": {
+			contentEncoding:    "gzip, zstd",
+			body:               compress(t, "zstd", compress(t, "gzip", []byte(body))),
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       body,
+		},
+		"it should reject a body which is not encoded as declared": {
+			contentEncoding:    "gzip",
+			body:               []byte(body),
+			expectedStatusCode: http.StatusBadRequest,
+			expectedBody:       "invalid gzip request body: gzip: invalid header\n",
+		},
+		"it should reject a corrupt gzip body": {
+			contentEncoding:    "gzip",
+			body:               corrupt(compress(t, "gzip", []byte(body))),
+			expectedStatusCode: http.StatusBadRequest,
+			expectedBody:       "invalid gzip request body: gzip: invalid checksum\n",
+		},
+		"it should reject an unsupported encoding": {
+			contentEncoding:    "br",
+			body:               []byte(body),
+			expectedStatusCode: http.StatusUnsupportedMediaType,
+			expectedBody:       "unsupported Content-Encoding 'br'\n",
+			expectedHeaders:    map[string]string{"Accept-Encoding": "gzip, deflate, zstd"},
+		},
+		"it should reject a body larger than the maximum size once decoded": {
+			options:            []DecompressionMiddlewareOption{WithDecompressionMaxSize(1024)},
+			contentEncoding:    "gzip",
+			body:               compress(t, "gzip", bytes.Repeat([]byte("a"), 2048)),
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+			expectedBody:       "request body is too large, the limit is 1024 bytes\n",
+		},
+		"it should reject a decompression bomb": {
+			options:            []DecompressionMiddlewareOption{WithDecompressionMaxSize(0)},
+			contentEncoding:    "zstd",
+			body:               compress(t, "zstd", bytes.Repeat([]byte{0}, 4<<20)),
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+			expectedBody:       "request body compression ratio exceeds 100\n",
+		},
+		"it should accept a highly compressible small body": {
+			contentEncoding:    "gzip",
+			body:               compress(t, "gzip", bytes.Repeat([]byte("a"), 100000)),
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       strings.Repeat("a", 100000),
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			log, _ := test.NewNullLogger()
+			router := NewRouter(log, WithoutOtelInstrumentation())
+			router.Use(ErrorMiddleware)
+			router.Use(NewDecompressionMiddleware(example.options...))
+			router.HandleFunc("/apps", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				assert.Empty(t, r.Header.Get("Content-Encoding"))
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					return err
+				}
+				_, err = w.Write(body)
+				return err
+			})
+
+			r := httptest.NewRequest(http.MethodPost, "/apps", bytes.NewReader(example.body))
+			r.Header.Set("Content-Type", "application/json")
+			if example.contentEncoding != "" {
+				r.Header.Set("Content-Encoding", example.contentEncoding)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, example.expectedStatusCode, w.Code)
+			assert.Equal(t, example.expectedBody, w.Body.String())
+			for name, value := range example.expectedHeaders {
+				assert.Equal(t, value, w.Header().Get(name), name)
+			}
+		})
+	}
+}
+
+func TestDecompressionMiddleware_OuterRequest(t *testing.T) {
+	body := compress(t, "gzip", []byte(`{"name":"my-app"}`))
+	r := httptest.NewRequest(http.MethodPost, "/apps", bytes.NewReader(body))
+	r.Header.Set("Content-Encoding", "gzip")
+	r.Header.Set("Content-Length", "42")
+
+	handler := NewDecompressionMiddleware().Apply(func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		assert.Empty(t, r.Header.Get("Content-Encoding"))
+		decompressed, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"name":"my-app"}`, string(decompressed))
+		return nil
+	})
+	require.NoError(t, handler(httptest.NewRecorder(), r, map[string]string{}))
+
+	// The request of the outer middlewares still describes the compressed body
+	assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+	assert.Equal(t, "42", r.Header.Get("Content-Length"))
+	assert.EqualValues(t, len(body), r.ContentLength)
+}
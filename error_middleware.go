@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"net/http"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/negroni/v3"
@@ -20,10 +22,7 @@ import (
 var ErrorMiddleware = MiddlewareFunc(func(handler HandlerFunc) HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 		ctx := r.Context()
-		log, ok := ctx.Value("logger").(logrus.FieldLogger)
-		if !ok {
-			log = logrus.New()
-		}
+		log := LoggerFromContext(ctx)
 
 		defer func() {
 			if rec := recover(); rec != nil {
@@ -57,6 +56,7 @@ func writeError(log logrus.FieldLogger, req *http.Request, w negroni.ResponseWri
 	var validationErrors *errors.ValidationErrors
 	var v2validationErrors *v2errors.ValidationErrors
 	var badRequestError *BadRequestError
+	var httpError HTTPError
 
 	if w.Header().Get("Content-Type") == "" {
 		if req != nil && req.Header != nil && isAcceptingJSON(req.Header.Get("Accept")) {
@@ -81,8 +81,12 @@ func writeError(log logrus.FieldLogger, req *http.Request, w negroni.ResponseWri
 		// If the status is 0, it means WriteHeader has not been called and we've to
 		// write it. Otherwise it has been done in the handler with another response
 		// code.
-		// In this case, we want to return a 401 error if it's an invalid token error and 500 in other cases.
-		if isInvalidTokenError(err) {
+		// In this case, we want to return the status code carried by the error if
+		// any, a 401 error if it's an invalid token error and 500 in other cases.
+		if errors.As(err, &httpError) {
+			setRetryAfter(w.Header(), err)
+			w.WriteHeader(httpError.StatusCode())
+		} else if isInvalidTokenError(err) {
 			w.WriteHeader(401)
 		} else {
 			w.WriteHeader(500)
@@ -91,7 +95,13 @@ func writeError(log logrus.FieldLogger, req *http.Request, w negroni.ResponseWri
 
 	// We log at error level for all 5xx errors as it means there has been an internal service error. With this logging level, we send a Rollbar error.
 	// In all other cases, we log at info level. The status code is most probably a 4xx (i.e. due to a user issue). We don't want a Rollbar error in this case but still want to be informed in the logs.
-	if w.Status()/100 == 5 {
+	var serviceUnavailableError *ServiceUnavailableError
+	if w.Status()/100 == 5 && errors.As(err, &serviceUnavailableError) {
+		// The request has been rejected on purpose, e.g. by the load shedding or
+		// the circuit breaker: a Rollbar error per rejected request would flood
+		// Rollbar while the service is overloaded.
+		log.Warn("Request error")
+	} else if w.Status()/100 == 5 {
 		log.Error("Request error")
 	} else if isCauseValidationErrors {
 		log.Info("Request validation error")
@@ -162,3 +172,21 @@ func isInvalidTokenError(err error) bool {
 		errors.Is(err, security.ErrInvalidTimestamp) ||
 		errors.Is(err, security.ErrTokenExpired)
 }
+
+// setRetryAfter sets the Retry-After header from the delay carried by a
+// *TooManyRequestsError or a *ServiceUnavailableError, unless it is already set
+func setRetryAfter(header http.Header, err error) {
+	var tooManyRequestsError *TooManyRequestsError
+	var serviceUnavailableError *ServiceUnavailableError
+	var retryAfter time.Duration
+	switch {
+	case errors.As(err, &tooManyRequestsError):
+		retryAfter = tooManyRequestsError.RetryAfter
+	case errors.As(err, &serviceUnavailableError):
+		retryAfter = serviceUnavailableError.RetryAfter
+	}
+	if retryAfter <= 0 || header.Get("Retry-After") != "" {
+		return
+	}
+	header.Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+}
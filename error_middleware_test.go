@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	pkgerrors "github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -28,6 +29,7 @@ func TestErrorMiddlware(t *testing.T) {
 		assertLogs         func(*testing.T, *pkgtest.Hook)
 		expectedStatusCode int
 		expectedBody       string
+		expectedHeaders    map[string]string
 	}{
 		"it should set the status code to 500 if there is none": {
 			contentType: "application/json",
@@ -131,6 +133,41 @@ func TestErrorMiddlware(t *testing.T) {
 			expectedStatusCode: 500,
 			expectedBody:       "{\"error\":\"wrapping: error\"}\n",
 		},
+		"it should set the status code of an HTTPError": {
+			contentType: "application/json",
+			handlerFunc: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				return pkgerrors.Wrap(HTTPSRequiredError{}, "biniou")
+			},
+			expectedStatusCode: 400,
+			expectedBody:       "{\"error\":\"biniou: HTTPS is required\"}\n",
+		},
+		"it should set the Retry-After header of a TooManyRequestsError": {
+			handlerFunc: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				return pkgerrors.Wrap(&TooManyRequestsError{RetryAfter: 1500 * time.Millisecond}, "biniou")
+			},
+			expectedStatusCode: 429,
+			expectedHeaders:    map[string]string{"Retry-After": "2"},
+		},
+		"it should set the Retry-After header of a ServiceUnavailableError": {
+			handlerFunc: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				return &ServiceUnavailableError{RetryAfter: 30 * time.Second}
+			},
+			assertLogs: func(t *testing.T, hook *pkgtest.Hook) {
+				require.Equal(t, 1, len(hook.Entries))
+				// The rejected requests must not be sent to Rollbar
+				assert.Equal(t, logrus.WarnLevel, hook.Entries[0].Level)
+			},
+			expectedStatusCode: 503,
+			expectedHeaders:    map[string]string{"Retry-After": "30"},
+		},
+		"it should not override the Retry-After header set by the handler": {
+			handlerFunc: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				w.Header().Set("Retry-After", "60")
+				return &ServiceUnavailableError{RetryAfter: 30 * time.Second}
+			},
+			expectedStatusCode: 503,
+			expectedHeaders:    map[string]string{"Retry-After": "60"},
+		},
 		"it should not write anything in the body if it has already been written": {
 			handlerFunc: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 				w.WriteHeader(500)
@@ -179,6 +216,9 @@ func TestErrorMiddlware(t *testing.T) {
 				assert.Equal(t, test.expectedBody, w.Body.String())
 			}
 			assert.Equal(t, test.expectedStatusCode, w.Code)
+			for name, value := range test.expectedHeaders {
+				assert.Equal(t, value, w.Header().Get(name))
+			}
 		})
 	}
 }
@@ -1,8 +1,10 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"time"
 )
 
 type BadRequestError struct {
@@ -22,3 +24,237 @@ func NewBadRequestErrors() *BadRequestError {
 		Errors: make(map[string][]string),
 	}
 }
+
+// HTTPError is implemented by the errors carrying the status code of the
+// response. The ErrorMiddleware answers with this status code if the handler
+// did not write any.
+type HTTPError interface {
+	error
+	StatusCode() int
+}
+
+// HTTPSRequiredError is returned when a plain HTTP request is received on an
+// HTTPS only endpoint
+type HTTPSRequiredError struct{}
+
+func (err HTTPSRequiredError) Error() string {
+	return "HTTPS is required"
+}
+
+func (err HTTPSRequiredError) StatusCode() int {
+	return 400
+}
+
+// UnsupportedMediaTypeError is returned when the body of a request is not of a
+// supported media type
+type UnsupportedMediaTypeError struct {
+	ContentType string
+}
+
+func (err *UnsupportedMediaTypeError) Error() string {
+	if err.ContentType == "" {
+		return "missing Content-Type"
+	}
+	return fmt.Sprintf("unsupported Content-Type '%s'", err.ContentType)
+}
+
+func (err *UnsupportedMediaTypeError) StatusCode() int {
+	return 415
+}
+
+// NotAcceptableError is returned when the Accept header of a request does not
+// allow any media type produced by the endpoint
+type NotAcceptableError struct {
+	Accept string
+}
+
+func (err *NotAcceptableError) Error() string {
+	return fmt.Sprintf("no acceptable media type for '%s'", err.Accept)
+}
+
+func (err *NotAcceptableError) StatusCode() int {
+	return 406
+}
+
+// PayloadTooLargeError is returned when the body of a request exceeds the limit
+// of the endpoint
+type PayloadTooLargeError struct {
+	Limit int64
+}
+
+func (err *PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("request body is too large, the limit is %d bytes", err.Limit)
+}
+
+func (err *PayloadTooLargeError) StatusCode() int {
+	return 413
+}
+
+// TooManyRequestsError is returned when a client exceeds its rate limit
+type TooManyRequestsError struct {
+	RetryAfter time.Duration
+}
+
+func (err *TooManyRequestsError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, retry in %v", err.RetryAfter.Round(time.Second))
+}
+
+func (err *TooManyRequestsError) StatusCode() int {
+	return 429
+}
+
+// ServiceUnavailableError is returned when the service is too loaded to handle
+// a request
+type ServiceUnavailableError struct {
+	// Reason is an optional explanation sent to the client
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (err *ServiceUnavailableError) Error() string {
+	if err.Reason == "" {
+		return "service unavailable"
+	}
+	return "service unavailable: " + err.Reason
+}
+
+func (err *ServiceUnavailableError) StatusCode() int {
+	return 503
+}
+
+// TimeoutError is returned when a request exceeds its timeout
+type TimeoutError struct {
+	Timeout    time.Duration
+	statusCode int
+}
+
+func (err *TimeoutError) Error() string {
+	return fmt.Sprintf("request timed out after %v", err.Timeout)
+}
+
+// StatusCode is 503 unless another status code has been configured in the
+// timeout middleware
+func (err *TimeoutError) StatusCode() int {
+	if err.statusCode == 0 {
+		return 503
+	}
+	return err.statusCode
+}
+
+// ClientClosedRequestError is returned when the client closes the connection
+// before the response is written. The 499 status code is never received by the
+// client, it is only logged.
+type ClientClosedRequestError struct{}
+
+func (err ClientClosedRequestError) Error() string {
+	return "client closed the request"
+}
+
+func (err ClientClosedRequestError) StatusCode() int {
+	return 499
+}
+
+// Unwrap makes errors.Is(err, context.Canceled) true
+func (err ClientClosedRequestError) Unwrap() error {
+	return context.Canceled
+}
+
+// UnsupportedContentEncodingError is returned when the body of a request is
+// encoded with an unsupported content coding
+type UnsupportedContentEncodingError struct {
+	ContentEncoding string
+}
+
+func (err *UnsupportedContentEncodingError) Error() string {
+	return fmt.Sprintf("unsupported Content-Encoding '%s'", err.ContentEncoding)
+}
+
+func (err *UnsupportedContentEncodingError) StatusCode() int {
+	return 415
+}
+
+// InvalidContentEncodingError is returned when the body of a request cannot be
+// decoded according to its Content-Encoding
+type InvalidContentEncodingError struct {
+	ContentEncoding string
+	Err             error
+}
+
+func (err *InvalidContentEncodingError) Error() string {
+	return fmt.Sprintf("invalid %s request body: %v", err.ContentEncoding, err.Err)
+}
+
+func (err *InvalidContentEncodingError) StatusCode() int {
+	return 400
+}
+
+func (err *InvalidContentEncodingError) Unwrap() error {
+	return err.Err
+}
+
+// CompressionRatioError is returned when the compression ratio of a request
+// body exceeds the limit, which is the sign of a decompression bomb
+type CompressionRatioError struct {
+	MaxRatio float64
+}
+
+func (err *CompressionRatioError) Error() string {
+	return fmt.Sprintf("request body compression ratio exceeds %g", err.MaxRatio)
+}
+
+func (err *CompressionRatioError) StatusCode() int {
+	return 413
+}
+
+// PreconditionFailedError is returned when the If-Match, If-None-Match or
+// If-Unmodified-Since header of a request does not match the current state of
+// the resource
+type PreconditionFailedError struct{}
+
+func (err PreconditionFailedError) Error() string {
+	return "precondition failed"
+}
+
+func (err PreconditionFailedError) StatusCode() int {
+	return 412
+}
+
+// IdempotencyKeyMissingError is returned when a request requiring an
+// Idempotency-Key header is sent without it
+type IdempotencyKeyMissingError struct{}
+
+func (err IdempotencyKeyMissingError) Error() string {
+	return "missing Idempotency-Key header"
+}
+
+func (err IdempotencyKeyMissingError) StatusCode() int {
+	return 400
+}
+
+// IdempotencyConflictError is returned when a request is sent while the
+// request with the same idempotency key is still being processed
+type IdempotencyConflictError struct {
+	Key string
+}
+
+func (err *IdempotencyConflictError) Error() string {
+	return fmt.Sprintf("a request with the Idempotency-Key '%s' is being processed", err.Key)
+}
+
+func (err *IdempotencyConflictError) StatusCode() int {
+	return 409
+}
+
+// IdempotencyKeyReusedError is returned when an idempotency key is reused with
+// a different request payload
+type IdempotencyKeyReusedError struct {
+	Key string
+}
+
+func (err *IdempotencyKeyReusedError) Error() string {
+	return fmt.Sprintf("the Idempotency-Key '%s' has already been used for another request", err.Key)
+}
+
+func (err *IdempotencyKeyReusedError) StatusCode() int {
+	return 422
+}
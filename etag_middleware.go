@@ -0,0 +1,368 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const etagDefaultMaxBodySize = 4 << 20
+
+type etagMiddleware struct {
+	weak bool
+	// maxBodySize is the maximum size of the buffered bodies. The ETag of a
+	// larger body is not computed.
+	maxBodySize int
+}
+
+type ETagMiddlewareOption func(m *etagMiddleware)
+
+// WithWeakETags computes weak entity tags (W/"...") instead of strong ones, for
+// the responses which are semantically equivalent but not byte-for-byte
+// identical
+func WithWeakETags() ETagMiddlewareOption {
+	return func(m *etagMiddleware) {
+		m.weak = true
+	}
+}
+
+// WithETagMaxBodySize sets the maximum size in bytes of the buffered response
+// bodies (4MiB by default). The larger responses are streamed without ETag.
+func WithETagMaxBodySize(size int) ETagMiddlewareOption {
+	return func(m *etagMiddleware) {
+		m.maxBodySize = size
+	}
+}
+
+// NewETagMiddleware initializes a middleware handling the conditional requests.
+// The successful responses to GET and HEAD requests are buffered to compute
+// their ETag, unless the handler provides it with SetResponseETag or the ETag
+// header. The If-None-Match, If-Match, If-Modified-Since and
+// If-Unmodified-Since headers are then evaluated: the response is replaced by a
+// 304 Not Modified, or by a PreconditionFailedError rendered as 412 by the
+// ErrorMiddleware.
+//
+// The handlers of state-changing requests call CheckPreconditions before
+// modifying the resource.
+func NewETagMiddleware(options ...ETagMiddlewareOption) Middleware {
+	m := &etagMiddleware{
+		maxBodySize: etagDefaultMaxBodySize,
+	}
+	for _, opt := range options {
+		opt(m)
+	}
+	return m
+}
+
+func (m *etagMiddleware) Apply(next HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		conditional := &conditionalRequest{method: r.Method, header: r.Header}
+		r = r.WithContext(context.WithValue(r.Context(), conditionalRequestContextKey, conditional))
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			return next(w, r, vars)
+		}
+
+		ew := &etagWriter{ResponseWriter: w, m: m, conditional: conditional}
+		err := next(ew, r, vars)
+		if err != nil {
+			// The error response is written by the ErrorMiddleware, unless the
+			// handler already started writing its response
+			ew.flushBuffer()
+			return err
+		}
+		return ew.finish()
+	}
+}
+
+// CheckPreconditions evaluates the If-Match, If-None-Match and
+// If-Unmodified-Since headers against the validators of the current state of
+// the resource, set with SetResponseETag and SetResponseLastModified. The
+// handlers of PUT, PATCH and DELETE requests call it before modifying the
+// resource, to prevent lost updates. It returns a PreconditionFailedError if a
+// precondition fails, and nil if the request is not handled by an
+// ETagMiddleware.
+func CheckPreconditions(ctx context.Context) error {
+	conditional, ok := ctx.Value(conditionalRequestContextKey).(*conditionalRequest)
+	if !ok {
+		return nil
+	}
+	etag, lastModified := conditional.validators()
+	if conditional.evaluate(etag, lastModified) == http.StatusPreconditionFailed {
+		return PreconditionFailedError{}
+	}
+	return nil
+}
+
+// conditionalRequest holds the conditional headers of the request and the
+// validators set by the handler
+type conditionalRequest struct {
+	method string
+	header http.Header
+
+	mutex        sync.Mutex
+	etag         string
+	lastModified time.Time
+}
+
+func (c *conditionalRequest) validators() (string, time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.etag, c.lastModified
+}
+
+// evaluate returns 304 or 412 if the response must be replaced, following the
+// order of RFC 9110 section 13.2.2, or 0 otherwise
+func (c *conditionalRequest) evaluate(etag string, lastModified time.Time) int {
+	safe := c.method == http.MethodGet || c.method == http.MethodHead
+	lastModified = lastModified.Truncate(time.Second)
+
+	if ifMatch := c.header.Values("If-Match"); len(ifMatch) > 0 {
+		if !matchETags(ifMatch, etag, true) {
+			return http.StatusPreconditionFailed
+		}
+	} else if date, ok := parseHTTPDate(c.header.Get("If-Unmodified-Since")); ok && !lastModified.IsZero() {
+		if lastModified.After(date) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch := c.header.Values("If-None-Match"); len(ifNoneMatch) > 0 {
+		if matchETags(ifNoneMatch, etag, false) {
+			if safe {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if date, ok := parseHTTPDate(c.header.Get("If-Modified-Since")); ok && safe && !lastModified.IsZero() {
+		if !lastModified.After(date) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+func parseHTTPDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	date, err := http.ParseTime(value)
+	return date, err == nil
+}
+
+// matchETags returns true if etag is listed in the If-Match or If-None-Match
+// header values, using the strong or the weak comparison
+func matchETags(values []string, etag string, strong bool) bool {
+	if len(values) == 1 && strings.TrimSpace(values[0]) == "*" {
+		// The resource exists
+		return true
+	}
+	if etag == "" || (strong && strings.HasPrefix(etag, "W/")) {
+		return false
+	}
+	for _, candidate := range parseETags(values) {
+		if strong && strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseETags returns the entity tags of a list. An entity tag may contain
+// commas, so the list cannot be split on them.
+func parseETags(values []string) []string {
+	var etags []string
+	for _, value := range values {
+		for {
+			value = strings.TrimLeft(value, " \t,")
+			if value == "" {
+				break
+			}
+			prefix := ""
+			if strings.HasPrefix(value, "W/") {
+				prefix, value = "W/", value[2:]
+			}
+			end := -1
+			if strings.HasPrefix(value, `"`) {
+				end = strings.IndexByte(value[1:], '"')
+			}
+			if end < 0 {
+				// Invalid entity tag, skip to the next one
+				next := strings.IndexByte(value, ',')
+				if next < 0 {
+					break
+				}
+				value = value[next:]
+				continue
+			}
+			etags = append(etags, prefix+value[:end+2])
+			value = value[end+2:]
+		}
+	}
+	return etags
+}
+
+// quoteETag quotes etag if it is not already a quoted entity tag
+func quoteETag(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, `W/"`) {
+		return etag
+	}
+	return `"` + etag + `"`
+}
+
+// etagWriter buffers the body of a successful response if its ETag is not known
+// when the headers are written
+type etagWriter struct {
+	http.ResponseWriter
+	m           *etagMiddleware
+	conditional *conditionalRequest
+
+	statusCode int
+	buffer     bytes.Buffer
+	buffering  bool
+	// discard is true if the response has been replaced by a 304 or a 412
+	discard bool
+	err     error
+}
+
+func (ew *etagWriter) WriteHeader(statusCode int) {
+	if ew.statusCode != 0 {
+		return
+	}
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		ew.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	ew.statusCode = statusCode
+	if statusCode != http.StatusOK {
+		ew.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	etag, lastModified := ew.validators()
+	if etag == "" {
+		ew.buffering = true
+		return
+	}
+	if !ew.conclude(etag, lastModified) {
+		ew.ResponseWriter.WriteHeader(statusCode)
+	}
+}
+
+func (ew *etagWriter) Write(b []byte) (int, error) {
+	if ew.statusCode == 0 {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.discard {
+		return len(b), nil
+	}
+	if !ew.buffering {
+		return ew.ResponseWriter.Write(b)
+	}
+	ew.buffer.Write(b)
+	if ew.buffer.Len() > ew.m.maxBodySize {
+		ew.flushBuffer()
+	}
+	return len(b), nil
+}
+
+// Flush sends the buffered body without ETag
+func (ew *etagWriter) Flush() {
+	if ew.statusCode == 0 {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.discard {
+		return
+	}
+	ew.flushBuffer()
+	if flusher, ok := ew.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap is used by http.ResponseController
+func (ew *etagWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// validators returns the ETag and the modification date set by the handler,
+// with SetResponseETag and SetResponseLastModified or in the headers
+func (ew *etagWriter) validators() (string, time.Time) {
+	etag, lastModified := ew.conditional.validators()
+	header := ew.Header()
+	if etag == "" {
+		etag = header.Get("ETag")
+	}
+	if lastModified.IsZero() {
+		lastModified, _ = parseHTTPDate(header.Get("Last-Modified"))
+	}
+	return etag, lastModified
+}
+
+// conclude sets the validators headers and evaluates the conditional headers.
+// It returns true if the response has been replaced.
+func (ew *etagWriter) conclude(etag string, lastModified time.Time) bool {
+	header := ew.Header()
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	switch ew.conditional.evaluate(etag, lastModified) {
+	case http.StatusNotModified:
+		ew.discard = true
+		header.Del("Content-Type")
+		header.Del("Content-Length")
+		ew.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return true
+	case http.StatusPreconditionFailed:
+		ew.discard = true
+		ew.err = PreconditionFailedError{}
+		return true
+	}
+	return false
+}
+
+// flushBuffer stops buffering and writes the buffered response
+func (ew *etagWriter) flushBuffer() {
+	if !ew.buffering {
+		return
+	}
+	ew.buffering = false
+	ew.ResponseWriter.WriteHeader(ew.statusCode)
+	if ew.buffer.Len() > 0 {
+		_, _ = ew.ResponseWriter.Write(ew.buffer.Bytes())
+	}
+	ew.buffer = bytes.Buffer{}
+}
+
+// finish computes the ETag of the buffered body and evaluates the conditional
+// headers once the handler returned
+func (ew *etagWriter) finish() error {
+	if !ew.buffering {
+		return ew.err
+	}
+	etag, lastModified := ew.validators()
+	if etag == "" && ew.buffer.Len() > 0 {
+		sum := sha256.Sum256(ew.buffer.Bytes())
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+		if ew.m.weak {
+			etag = "W/" + etag
+		}
+	}
+	if ew.conclude(etag, lastModified) {
+		ew.buffering = false
+		return ew.err
+	}
+	ew.flushBuffer()
+	return nil
+}
@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestETagMiddleware(t *testing.T) {
+	body := `{"app":{"name":"my-app"}}`
+	// First 16 bytes of the SHA-256 of body
+	computedETag := `"d165d110c8c38bf6beb532dea7cb2caa"`
+	lastModified := time.Date(2024, 3, 12, 10, 0, 0, 0, time.UTC)
+
+	writeBody := func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		w.Header().Set("Content-Type", "application/json")
+		_, err := io.WriteString(w, body)
+		return err
+	}
+	writeVersionedBody := func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		SetResponseETag(r.Context(), "v42")
+		SetResponseLastModified(r.Context(), lastModified)
+		return writeBody(w, r, vars)
+	}
+
+	examples := map[string]struct {
+		options            []ETagMiddlewareOption
+		method             string
+		handler            HandlerFunc
+		headers            map[string]string
+		expectedStatusCode int
+		expectedBody       string
+		expectedHeaders    map[string]string
+	}{
+		"it should compute the ETag of the response": {
+			handler:            writeBody,
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       body,
+			expectedHeaders:    map[string]string{"ETag": computedETag, "Content-Type": "application/json"},
+		},
+		"it should compute a weak ETag": {
+			options:            []ETagMiddlewareOption{WithWeakETags()},
+			handler:            writeBody,
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       body,
+			expectedHeaders:    map[string]string{"ETag": "W/" + computedETag},
+		},
+		"it should answer 304 if the computed ETag matches If-None-Match": {
+			handler:            writeBody,
+			headers:            map[string]string{"If-None-Match": `"other", ` + computedETag},
+			expectedStatusCode: http.StatusNotModified,
+			expectedHeaders:    map[string]string{"ETag": computedETag, "Content-Type": ""},
+		},
+		"it should use the weak comparison for If-None-Match": {
+			handler:            writeBody,
+			headers:            map[string]string{"If-None-Match": "W/" + computedETag},
+			expectedStatusCode: http.StatusNotModified,
+		},
+		"it should send the response if the ETag does not match If-None-Match": {
+			handler:            writeBody,
+			headers:            map[string]string{"If-None-Match": `"other"`},
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       body,
+		},
+		"it should use the ETag set by the handler": {
+			handler:            writeVersionedBody,
+			headers:            map[string]string{"If-None-Match": `"v42"`},
+			expectedStatusCode: http.StatusNotModified,
+			expectedHeaders:    map[string]string{"ETag": `"v42"`, "Last-Modified": "Tue, 12 Mar 2024 10:00:00 GMT"},
+		},
+		"it should use the ETag header set by the handler": {
+			handler: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				w.Header().Set("ETag", `W/"v42"`)
+				return writeBody(w, r, vars)
+			},
+			headers:            map[string]string{"If-None-Match": `"v42"`},
+			expectedStatusCode: http.StatusNotModified,
+			expectedHeaders:    map[string]string{"ETag": `W/"v42"`},
+		},
+		"it should answer 304 if the resource has not been modified since If-Modified-Since": {
+			handler:            writeVersionedBody,
+			headers:            map[string]string{"If-Modified-Since": "Tue, 12 Mar 2024 10:00:00 GMT"},
+			expectedStatusCode: http.StatusNotModified,
+		},
+		"it should send the response if the resource has been modified since If-Modified-Since": {
+			handler:            writeVersionedBody,
+			headers:            map[string]string{"If-Modified-Since": "Tue, 12 Mar 2024 09:59:59 GMT"},
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       body,
+		},
+		"it should ignore If-Modified-Since if If-None-Match is present": {
+			handler: writeVersionedBody,
+			headers: map[string]string{
+				"If-None-Match":     `"v41"`,
+				"If-Modified-Since": "Tue, 12 Mar 2024 10:00:00 GMT",
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       body,
+		},
+		"it should answer 412 if the ETag does not match If-Match": {
+			handler:            writeVersionedBody,
+			headers:            map[string]string{"If-Match": `"v41"`},
+			expectedStatusCode: http.StatusPreconditionFailed,
+			expectedBody:       `{"error":"precondition failed"}` + "\n",
+		},
+		"it should use the strong comparison for If-Match": {
+			handler:            writeBody,
+			headers:            map[string]string{"If-Match": "W/" + computedETag},
+			expectedStatusCode: http.StatusPreconditionFailed,
+		},
+		"it should send the response if the ETag matches If-Match": {
+			handler:            writeBody,
+			headers:            map[string]string{"If-Match": computedETag},
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       body,
+		},
+		"it should answer 412 if the resource has been modified since If-Unmodified-Since": {
+			handler:            writeVersionedBody,
+			headers:            map[string]string{"If-Unmodified-Since": "Tue, 12 Mar 2024 09:00:00 GMT"},
+			expectedStatusCode: http.StatusPreconditionFailed,
+		},
+		"it should not handle the error responses": {
+			handler: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				w.WriteHeader(http.StatusNotFound)
+				_, err := io.WriteString(w, "not found")
+				return err
+			},
+			headers:            map[string]string{"If-Match": `"v41"`},
+			expectedStatusCode: http.StatusNotFound,
+			expectedBody:       "not found",
+			expectedHeaders:    map[string]string{"ETag": ""},
+		},
+		"it should not buffer the responses larger than the limit": {
+			options:            []ETagMiddlewareOption{WithETagMaxBodySize(10)},
+			handler:            writeBody,
+			headers:            map[string]string{"If-None-Match": computedETag},
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       body,
+			expectedHeaders:    map[string]string{"ETag": ""},
+		},
+		"it should not compute the ETag of the responses to other methods": {
+			method:             http.MethodPost,
+			handler:            writeBody,
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       body,
+			expectedHeaders:    map[string]string{"ETag": ""},
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			log, _ := test.NewNullLogger()
+			router := NewRouter(log, WithoutOtelInstrumentation())
+			router.Use(ErrorMiddleware)
+			router.Use(NewETagMiddleware(example.options...))
+			router.HandleFunc("/apps/{app}", example.handler)
+
+			method := example.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "/apps/my-app", nil)
+			r.Header.Set("Accept", "application/json")
+			for name, value := range example.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, example.expectedStatusCode, w.Code)
+			if example.expectedBody != "" || example.expectedStatusCode == http.StatusNotModified {
+				assert.Equal(t, example.expectedBody, w.Body.String())
+			}
+			for name, value := range example.expectedHeaders {
+				assert.Equal(t, value, w.Header().Get(name), name)
+			}
+		})
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	examples := map[string]struct {
+		headers       map[string]string
+		expectedError error
+	}{
+		"it should succeed without conditional header": {},
+		"it should succeed if the ETag matches If-Match": {
+			headers: map[string]string{"If-Match": `"v41", "v42"`},
+		},
+		"it should succeed if If-Match is a wildcard": {
+			headers: map[string]string{"If-Match": "*"},
+		},
+		"it should fail if the ETag does not match If-Match": {
+			headers:       map[string]string{"If-Match": `"v41"`},
+			expectedError: PreconditionFailedError{},
+		},
+		"it should fail if the ETag matches If-None-Match": {
+			headers:       map[string]string{"If-None-Match": `"v42"`},
+			expectedError: PreconditionFailedError{},
+		},
+		"it should fail if the resource has been modified since If-Unmodified-Since": {
+			headers:       map[string]string{"If-Unmodified-Since": "Mon, 11 Mar 2024 10:00:00 GMT"},
+			expectedError: PreconditionFailedError{},
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			var err error
+			handler := NewETagMiddleware().Apply(func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				require.True(t, SetResponseETag(r.Context(), `"v42"`))
+				require.True(t, SetResponseLastModified(r.Context(), time.Date(2024, 3, 12, 10, 0, 0, 0, time.UTC)))
+				err = CheckPreconditions(r.Context())
+				return nil
+			})
+
+			r := httptest.NewRequest(http.MethodPut, "/apps/my-app", nil)
+			for name, value := range example.headers {
+				r.Header.Set(name, value)
+			}
+			require.NoError(t, handler(httptest.NewRecorder(), r, map[string]string{}))
+
+			if example.expectedError != nil {
+				assert.Equal(t, example.expectedError, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	t.Run("it should succeed without ETagMiddleware", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPut, "/apps/my-app", nil)
+		r.Header.Set("If-Match", `"v41"`)
+		assert.False(t, SetResponseETag(r.Context(), "v42"))
+		assert.NoError(t, CheckPreconditions(r.Context()))
+	})
+}
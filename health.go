@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+	"github.com/Scalingo/go-utils/logger"
+)
+
+const (
+	HealthLivenessPath  = "/health/live"
+	HealthReadinessPath = "/health/ready"
+
+	healthCheckDefaultTimeout = 5 * time.Second
+)
+
+type HealthStatus string
+
+const (
+	HealthStatusOK HealthStatus = "ok"
+	// HealthStatusDegraded means a non critical check is failing, the service is
+	// still able to serve requests
+	HealthStatusDegraded HealthStatus = "degraded"
+	HealthStatusFailing  HealthStatus = "failing"
+	// HealthStatusShuttingDown means the server is shutting down and should not
+	// receive new requests
+	HealthStatusShuttingDown HealthStatus = "shutting_down"
+)
+
+// HealthChecker checks the health of a dependency of the service. It returns an
+// error if the dependency is unhealthy.
+type HealthChecker interface {
+	Check(ctx context.Context) error
+}
+
+type HealthCheckerFunc func(ctx context.Context) error
+
+func (f HealthCheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+type HealthCheckResult struct {
+	Status   HealthStatus `json:"status"`
+	Error    string       `json:"error,omitempty"`
+	Duration float64      `json:"duration"`
+	// CheckedAt is the time of the check, it is older than the request if the
+	// result comes from the cache
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type HealthReport struct {
+	Status HealthStatus                 `json:"status"`
+	Checks map[string]HealthCheckResult `json:"checks,omitempty"`
+}
+
+type healthCheck struct {
+	name    string
+	checker HealthChecker
+	timeout time.Duration
+	// cacheDuration is the duration during which the last result is reused
+	// instead of running the check again
+	cacheDuration time.Duration
+	// critical checks make the service failing, the others only degrade it
+	critical bool
+	liveness bool
+
+	mutex      sync.Mutex
+	lastResult *HealthCheckResult
+}
+
+type HealthCheckOption func(c *healthCheck)
+
+// WithHealthCheckTimeout sets the maximum duration of the check (5 seconds by
+// default)
+func WithHealthCheckTimeout(timeout time.Duration) HealthCheckOption {
+	return func(c *healthCheck) {
+		c.timeout = timeout
+	}
+}
+
+// WithHealthCheckCacheDuration reuses the result of the check during the given
+// duration. It prevents an aggressive prober from overloading a dependency.
+func WithHealthCheckCacheDuration(duration time.Duration) HealthCheckOption {
+	return func(c *healthCheck) {
+		c.cacheDuration = duration
+	}
+}
+
+// WithHealthCheckNonCritical makes a failure of the check degrade the service
+// instead of marking it as failing
+func WithHealthCheckNonCritical() HealthCheckOption {
+	return func(c *healthCheck) {
+		c.critical = false
+	}
+}
+
+// WithHealthCheckLiveness also runs the check on the liveness endpoint. Only
+// checks whose failure requires a restart of the service should use it.
+func WithHealthCheckLiveness() HealthCheckOption {
+	return func(c *healthCheck) {
+		c.liveness = true
+	}
+}
+
+// Health aggregates the health checks of a service and exposes them through a
+// liveness and a readiness endpoint
+type Health struct {
+	checksMutex  sync.RWMutex
+	checks       []*healthCheck
+	shuttingDown atomic.Bool
+}
+
+func NewHealth() *Health {
+	return &Health{}
+}
+
+// AddCheck registers a named checker. Checks are run on the readiness endpoint.
+func (h *Health) AddCheck(name string, checker HealthChecker, options ...HealthCheckOption) {
+	c := &healthCheck{
+		name:     name,
+		checker:  checker,
+		timeout:  healthCheckDefaultTimeout,
+		critical: true,
+	}
+	for _, opt := range options {
+		opt(c)
+	}
+
+	h.checksMutex.Lock()
+	defer h.checksMutex.Unlock()
+	h.checks = append(h.checks, c)
+}
+
+// Shutdown makes the readiness endpoint report the service as unhealthy. It is
+// meant to be called when the graceful shutdown starts, e.g. with
+// WithOnShutdown(health.Shutdown).
+func (h *Health) Shutdown() {
+	h.shuttingDown.Store(true)
+}
+
+// Liveness runs the liveness checks and returns the aggregated report
+func (h *Health) Liveness(ctx context.Context) HealthReport {
+	return h.report(ctx, true)
+}
+
+// Readiness runs all the checks and returns the aggregated report
+func (h *Health) Readiness(ctx context.Context) HealthReport {
+	report := h.report(ctx, false)
+	if h.shuttingDown.Load() {
+		report.Status = HealthStatusShuttingDown
+	}
+	return report
+}
+
+func (h *Health) report(ctx context.Context, livenessOnly bool) HealthReport {
+	h.checksMutex.RLock()
+	checks := make([]*healthCheck, 0, len(h.checks))
+	for _, c := range h.checks {
+		if !livenessOnly || c.liveness {
+			checks = append(checks, c)
+		}
+	}
+	h.checksMutex.RUnlock()
+
+	report := HealthReport{
+		Status: HealthStatusOK,
+		Checks: make(map[string]HealthCheckResult, len(checks)),
+	}
+	results := make([]HealthCheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = c.run(ctx)
+		}()
+	}
+	wg.Wait()
+
+	for i, c := range checks {
+		result := results[i]
+		report.Checks[c.name] = result
+		if result.Status == HealthStatusFailing && c.critical {
+			report.Status = HealthStatusFailing
+		} else if result.Status != HealthStatusOK && report.Status == HealthStatusOK {
+			report.Status = HealthStatusDegraded
+		}
+	}
+	return report
+}
+
+func (c *healthCheck) run(ctx context.Context) HealthCheckResult {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.lastResult != nil && time.Since(c.lastResult.CheckedAt) < c.cacheDuration {
+		return *c.lastResult
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	before := time.Now()
+	// The checker is run in its own goroutine so that a checker ignoring the
+	// context cannot exceed the timeout
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.checker.Check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = errors.Wrapf(ctx, ctx.Err(), "check %s timed out after %s", c.name, c.timeout)
+	}
+
+	result := HealthCheckResult{
+		Status:    HealthStatusOK,
+		Duration:  time.Since(before).Seconds(),
+		CheckedAt: before,
+	}
+	if err != nil {
+		result.Status = HealthStatusFailing
+		if !c.critical {
+			result.Status = HealthStatusDegraded
+		}
+		result.Error = err.Error()
+	}
+	c.lastResult = &result
+	return result
+}
+
+// LivenessHandler answers 200 unless a liveness check is failing
+func (h *Health) LivenessHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return writeHealthReport(w, r, h.Liveness(r.Context()))
+}
+
+// ReadinessHandler answers 200 if the service is healthy or degraded and 503 if
+// a critical check is failing or if the service is shutting down
+func (h *Health) ReadinessHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return writeHealthReport(w, r, h.Readiness(r.Context()))
+}
+
+func writeHealthReport(w http.ResponseWriter, r *http.Request, report HealthReport) error {
+	status := http.StatusOK
+	if report.Status == HealthStatusFailing || report.Status == HealthStatusShuttingDown {
+		status = http.StatusServiceUnavailable
+
+		log := logger.Get(r.Context())
+		for name, result := range report.Checks {
+			if result.Status != HealthStatusOK {
+				log = log.WithField("check_"+name, result.Error)
+			}
+		}
+		log.WithField("health_status", report.Status).Info("Service is not healthy")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		return errors.Wrap(r.Context(), err, "encode health report")
+	}
+	return nil
+}
+
+// NewHealthRouter initializes a router exposing the liveness and readiness
+// endpoints of the given Health
+func NewHealthRouter(log logrus.FieldLogger, health *Health, options ...RouterOption) *Router {
+	router := NewRouter(log, options...)
+	router.HandleFunc(HealthLivenessPath, health.LivenessHandler).Methods(http.MethodGet, http.MethodHead)
+	router.HandleFunc(HealthReadinessPath, health.ReadinessHandler).Methods(http.MethodGet, http.MethodHead)
+	return router
+}
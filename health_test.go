@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func healthyChecker(ctx context.Context) error {
+	return nil
+}
+
+func failingChecker(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func TestHealth_ReadinessHandler(t *testing.T) {
+	tests := map[string]struct {
+		setup              func(h *Health)
+		expectedStatusCode int
+		expectedStatus     HealthStatus
+		expectedChecks     map[string]HealthStatus
+	}{
+		"it should be ok without any check": {
+			expectedStatusCode: http.StatusOK,
+			expectedStatus:     HealthStatusOK,
+			expectedChecks:     map[string]HealthStatus{},
+		},
+		"it should be ok if all the checks succeed": {
+			setup: func(h *Health) {
+				h.AddCheck("database", HealthCheckerFunc(healthyChecker))
+				h.AddCheck("cache", HealthCheckerFunc(healthyChecker))
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedStatus:     HealthStatusOK,
+			expectedChecks:     map[string]HealthStatus{"database": HealthStatusOK, "cache": HealthStatusOK},
+		},
+		"it should be degraded if a non critical check fails": {
+			setup: func(h *Health) {
+				h.AddCheck("database", HealthCheckerFunc(healthyChecker))
+				h.AddCheck("cache", HealthCheckerFunc(failingChecker), WithHealthCheckNonCritical())
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedStatus:     HealthStatusDegraded,
+			expectedChecks:     map[string]HealthStatus{"database": HealthStatusOK, "cache": HealthStatusDegraded},
+		},
+		"it should be failing if a critical check fails": {
+			setup: func(h *Health) {
+				h.AddCheck("database", HealthCheckerFunc(failingChecker))
+				h.AddCheck("cache", HealthCheckerFunc(failingChecker), WithHealthCheckNonCritical())
+			},
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedStatus:     HealthStatusFailing,
+			expectedChecks:     map[string]HealthStatus{"database": HealthStatusFailing, "cache": HealthStatusDegraded},
+		},
+		"it should be failing if a check times out": {
+			setup: func(h *Health) {
+				h.AddCheck("database", HealthCheckerFunc(func(ctx context.Context) error {
+					time.Sleep(time.Second)
+					return nil
+				}), WithHealthCheckTimeout(10*time.Millisecond))
+			},
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedStatus:     HealthStatusFailing,
+			expectedChecks:     map[string]HealthStatus{"database": HealthStatusFailing},
+		},
+		"it should be shutting down once the shutdown started": {
+			setup: func(h *Health) {
+				h.AddCheck("database", HealthCheckerFunc(healthyChecker))
+				h.Shutdown()
+			},
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedStatus:     HealthStatusShuttingDown,
+			expectedChecks:     map[string]HealthStatus{"database": HealthStatusOK},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			health := NewHealth()
+			if test.setup != nil {
+				test.setup(health)
+			}
+			router := NewHealthRouter(logrus.New(), health, WithoutOtelInstrumentation())
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, HealthReadinessPath, nil)
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, test.expectedStatusCode, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+			var report HealthReport
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+			assert.Equal(t, test.expectedStatus, report.Status)
+			checks := map[string]HealthStatus{}
+			for name, result := range report.Checks {
+				checks[name] = result.Status
+			}
+			assert.Equal(t, test.expectedChecks, checks)
+		})
+	}
+}
+
+func TestHealth_LivenessHandler(t *testing.T) {
+	t.Run("it should only run the liveness checks", func(t *testing.T) {
+		health := NewHealth()
+		health.AddCheck("database", HealthCheckerFunc(failingChecker))
+		health.AddCheck("deadlock", HealthCheckerFunc(healthyChecker), WithHealthCheckLiveness())
+		health.Shutdown()
+		router := NewHealthRouter(logrus.New(), health, WithoutOtelInstrumentation())
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, HealthLivenessPath, nil)
+		router.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var report HealthReport
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+		assert.Equal(t, HealthStatusOK, report.Status)
+		assert.Len(t, report.Checks, 1)
+		assert.Contains(t, report.Checks, "deadlock")
+	})
+}
+
+func TestHealth_Readiness(t *testing.T) {
+	t.Run("it should reuse the cached result of a check", func(t *testing.T) {
+		var calls atomic.Int32
+		health := NewHealth()
+		health.AddCheck("database", HealthCheckerFunc(func(ctx context.Context) error {
+			calls.Add(1)
+			return nil
+		}), WithHealthCheckCacheDuration(time.Minute))
+
+		first := health.Readiness(context.Background())
+		second := health.Readiness(context.Background())
+
+		assert.Equal(t, int32(1), calls.Load())
+		assert.Equal(t, first.Checks["database"].CheckedAt, second.Checks["database"].CheckedAt)
+	})
+
+	t.Run("it should run the check again without cache", func(t *testing.T) {
+		var calls atomic.Int32
+		health := NewHealth()
+		health.AddCheck("database", HealthCheckerFunc(func(ctx context.Context) error {
+			calls.Add(1)
+			return nil
+		}))
+
+		health.Readiness(context.Background())
+		health.Readiness(context.Background())
+
+		assert.Equal(t, int32(2), calls.Load())
+	})
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+)
+
+// maxErrorResponseBodySize is the maximum size of a remote error response body
+// read by ParseErrorResponse
+const maxErrorResponseBodySize = 64 * 1024
+
+// Transport is an http.RoundTripper propagating the request ID, the trace
+// context and the logger of the incoming request to the outgoing requests made
+// with the same context.
+type Transport struct {
+	base            http.RoundTripper
+	requestIDHeader string
+	propagator      propagation.TextMapPropagator
+	logLevel        logrus.Level
+}
+
+type TransportOption func(t *Transport)
+
+// WithTransportRequestIDHeader sets the header used to send the request ID
+// ("X-Request-ID" by default)
+func WithTransportRequestIDHeader(header string) TransportOption {
+	return func(t *Transport) {
+		t.requestIDHeader = header
+	}
+}
+
+// WithTransportPropagator sets the propagator injecting the trace context in
+// the outgoing requests (W3C Trace Context by default)
+func WithTransportPropagator(propagator propagation.TextMapPropagator) TransportOption {
+	return func(t *Transport) {
+		t.propagator = propagator
+	}
+}
+
+// WithTransportLogLevel sets the level of the outgoing request logs (info by
+// default)
+func WithTransportLogLevel(level logrus.Level) TransportOption {
+	return func(t *Transport) {
+		t.logLevel = level
+	}
+}
+
+// NewTransport wraps the base RoundTripper, http.DefaultTransport is used if it
+// is nil
+func NewTransport(base http.RoundTripper, options ...TransportOption) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &Transport{
+		base:            base,
+		requestIDHeader: requestIDDefaultHeader,
+		propagator:      propagation.TraceContext{},
+		logLevel:        logrus.InfoLevel,
+	}
+	for _, opt := range options {
+		opt(t)
+	}
+	return t
+}
+
+// NewHTTPClient returns an HTTP client using a Transport wrapping
+// http.DefaultTransport
+func NewHTTPClient(options ...TransportOption) *http.Client {
+	return &http.Client{Transport: NewTransport(nil, options...)}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	before := time.Now()
+
+	// The RoundTripper must not modify the original request
+	req = req.Clone(ctx)
+	id, ok := RequestIDFromContext(ctx)
+	if ok && req.Header.Get(t.requestIDHeader) == "" {
+		req.Header.Set(t.requestIDHeader, id)
+	}
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	// Use the same field layout as the LoggingMiddleware
+	log := LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"method":   req.Method,
+		"path":     req.URL.Path,
+		"host":     req.URL.Host,
+		"outgoing": true,
+	})
+	log.Log(t.logLevel, "starting outgoing request")
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		log.WithError(err).WithField("duration", time.Since(before).Seconds()).Log(t.logLevel, "outgoing request failed")
+		return nil, err
+	}
+
+	fields := logrus.Fields{
+		"status":   res.StatusCode,
+		"duration": time.Since(before).Seconds(),
+	}
+	// The length of a chunked response is unknown
+	if res.ContentLength >= 0 {
+		fields["bytes"] = res.ContentLength
+	}
+	log.WithFields(fields).Log(t.logLevel, "outgoing request completed")
+
+	return res, nil
+}
+
+// RemoteError is an error response returned by a remote service
+type RemoteError struct {
+	StatusCode int
+	// Message is the error message sent by the remote service
+	Message string
+}
+
+func (err *RemoteError) Error() string {
+	if err.Message == "" {
+		return fmt.Sprintf("remote service responded with %d %s", err.StatusCode, http.StatusText(err.StatusCode))
+	}
+	return fmt.Sprintf("remote service responded with %d: %s", err.StatusCode, err.Message)
+}
+
+// ParseErrorResponse returns nil if the response status is not an error. It
+// otherwise maps the response written by the ErrorMiddleware of the remote
+// service back into a typed error: a validation error is returned as
+// *errors.ValidationErrors and any other error as *RemoteError. The response
+// body is read but not closed.
+func ParseErrorResponse(res *http.Response) error {
+	if res.StatusCode < 400 {
+		return nil
+	}
+	ctx := context.Background()
+	if res.Request != nil {
+		ctx = res.Request.Context()
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxErrorResponseBodySize))
+	if err != nil {
+		return errors.Wrapf(ctx, &RemoteError{StatusCode: res.StatusCode}, "read error response body: %v", err)
+	}
+
+	contentType := strings.TrimSpace(strings.Split(res.Header.Get("Content-Type"), ";")[0])
+	if !isContentTypeJSON(contentType) {
+		return &RemoteError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+
+	var payload struct {
+		Error  string              `json:"error"`
+		Errors map[string][]string `json:"errors"`
+	}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		return &RemoteError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+	if res.StatusCode == http.StatusUnprocessableEntity && len(payload.Errors) > 0 {
+		return &errors.ValidationErrors{Errors: payload.Errors}
+	}
+	return &RemoteError{StatusCode: res.StatusCode, Message: payload.Error}
+}
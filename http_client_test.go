@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	errorutils "github.com/Scalingo/go-utils/errors/v3"
+)
+
+func TestTransport_RoundTrip(t *testing.T) {
+	var received http.Header
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer remote.Close()
+
+	tp := sdktrace.NewTracerProvider()
+	defer tp.Shutdown(context.Background())
+	ctx, span := tp.Tracer("test").Start(context.Background(), "incoming")
+	defer span.End()
+
+	log, hook := test.NewNullLogger()
+	ctx = ContextWithLogger(ctx, log.WithField("request_id", "my-request-id"))
+	ctx = ContextWithRequestID(ctx, "my-request-id")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, remote.URL+"/apps?token=secret", nil)
+	require.NoError(t, err)
+	res, err := NewHTTPClient().Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	t.Run("it should propagate the request ID and the trace context", func(t *testing.T) {
+		assert.Equal(t, "my-request-id", received.Get("X-Request-ID"))
+		assert.Contains(t, received.Get("traceparent"), span.SpanContext().TraceID().String())
+		assert.Empty(t, req.Header.Get("X-Request-ID"), "the original request must not be modified")
+	})
+
+	t.Run("it should log the outgoing request with the request logger", func(t *testing.T) {
+		require.Len(t, hook.Entries, 2)
+		assert.Equal(t, "outgoing request completed", hook.Entries[1].Message)
+		assert.Equal(t, logrus.Fields{
+			"request_id": "my-request-id",
+			"method":     http.MethodPost,
+			"path":       "/apps",
+			"host":       strings.TrimPrefix(remote.URL, "http://"),
+			"outgoing":   true,
+			"status":     http.StatusCreated,
+			"duration":   hook.Entries[1].Data["duration"],
+			"bytes":      int64(0),
+		}, hook.Entries[1].Data)
+	})
+}
+
+func TestTransport_RoundTripLogLevel(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before writing the body sends a chunked response
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte("deployments"))
+	}))
+	defer remote.Close()
+
+	log, hook := test.NewNullLogger()
+	log.SetLevel(logrus.TraceLevel)
+	ctx := ContextWithLogger(context.Background(), log)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, remote.URL+"/deployments", nil)
+	require.NoError(t, err)
+	res, err := NewHTTPClient(WithTransportLogLevel(logrus.TraceLevel)).Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	require.Len(t, hook.Entries, 2)
+	for _, entry := range hook.Entries {
+		assert.Equal(t, logrus.TraceLevel, entry.Level)
+	}
+	assert.Equal(t, "outgoing request completed", hook.Entries[1].Message)
+	assert.NotContains(t, hook.Entries[1].Data, "bytes")
+}
+
+func TestParseErrorResponse(t *testing.T) {
+	examples := map[string]struct {
+		statusCode    int
+		contentType   string
+		body          string
+		expectedError error
+	}{
+		"it should not return any error for a successful response": {
+			statusCode: http.StatusOK,
+		},
+		"it should return a validation error": {
+			statusCode:    http.StatusUnprocessableEntity,
+			contentType:   "application/json",
+			body:          `{"errors":{"name":["is required"]}}`,
+			expectedError: &errorutils.ValidationErrors{Errors: map[string][]string{"name": {"is required"}}},
+		},
+		"it should return a remote error with the JSON message": {
+			statusCode:    http.StatusNotFound,
+			contentType:   "application/json; charset=utf-8",
+			body:          `{"error":"app not found"}`,
+			expectedError: &RemoteError{StatusCode: http.StatusNotFound, Message: "app not found"},
+		},
+		"it should return a remote error with the plain text message": {
+			statusCode:    http.StatusInternalServerError,
+			contentType:   "text/plain",
+			body:          "boom\n",
+			expectedError: &RemoteError{StatusCode: http.StatusInternalServerError, Message: "boom"},
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			res := &http.Response{
+				StatusCode: example.statusCode,
+				Header:     http.Header{"Content-Type": []string{example.contentType}},
+				Body:       http.NoBody,
+			}
+			if example.body != "" {
+				res.Body = io.NopCloser(strings.NewReader(example.body))
+			}
+
+			err := ParseErrorResponse(res)
+			assert.Equal(t, example.expectedError, err)
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Scalingo/go-utils/logger"
+)
+
+// HSTSPolicy is the policy sent in the Strict-Transport-Security header
+type HSTSPolicy struct {
+	MaxAge            time.Duration
+	IncludeSubDomains bool
+	// Preload requires a max age of at least one year to be accepted by the
+	// browsers preload lists
+	Preload bool
+}
+
+func (p HSTSPolicy) String() string {
+	value := "max-age=" + strconv.Itoa(int(p.MaxAge.Seconds()))
+	if p.IncludeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if p.Preload {
+		value += "; preload"
+	}
+	return value
+}
+
+type httpsMiddleware struct {
+	// redirectStatusCode is the status code of the redirection to HTTPS. Plain
+	// HTTP requests are rejected if it is 0.
+	redirectStatusCode int
+	// allowedHosts are the hosts to which requests can be redirected
+	allowedHosts map[string]bool
+	hsts         *HSTSPolicy
+}
+
+type HTTPSMiddlewareOption func(m *httpsMiddleware)
+
+// WithHTTPSRedirect redirects plain HTTP requests to HTTPS with the given status
+// code instead of rejecting them. 308 should be preferred as it preserves the
+// method and the body of the request. A status code other than 301, 302, 307
+// and 308 is replaced by 308.
+func WithHTTPSRedirect(statusCode int) HTTPSMiddlewareOption {
+	return func(m *httpsMiddleware) {
+		switch statusCode {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			m.redirectStatusCode = statusCode
+		default:
+			m.redirectStatusCode = http.StatusPermanentRedirect
+		}
+	}
+}
+
+// WithHTTPSAllowedHosts restricts the redirections to the given hosts. The Host
+// header being controlled by the client, it prevents the middleware from being
+// used as an open redirect. Requests for other hosts are rejected.
+func WithHTTPSAllowedHosts(hosts ...string) HTTPSMiddlewareOption {
+	return func(m *httpsMiddleware) {
+		if m.allowedHosts == nil {
+			m.allowedHosts = map[string]bool{}
+		}
+		for _, host := range hosts {
+			m.allowedHosts[strings.ToLower(host)] = true
+		}
+	}
+}
+
+// WithHSTS adds the Strict-Transport-Security header to the HTTPS responses
+func WithHSTS(policy HSTSPolicy) HTTPSMiddlewareOption {
+	return func(m *httpsMiddleware) {
+		m.hsts = &policy
+	}
+}
+
+// NewHTTPSMiddleware initializes a middleware enforcing HTTPS. A request is
+// considered as HTTPS if the TLS connection is terminated by the server or if
+// a trusted proxy states it (see TrustedProxies). By default, plain HTTP
+// requests are rejected with an HTTPSRequiredError rendered by the
+// ErrorMiddleware.
+func NewHTTPSMiddleware(options ...HTTPSMiddlewareOption) Middleware {
+	m := &httpsMiddleware{}
+	for _, opt := range options {
+		opt(m)
+	}
+	return m
+}
+
+func (m *httpsMiddleware) Apply(next HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		if clientOrigin(r).Scheme == "https" {
+			if m.hsts != nil {
+				w.Header().Set("Strict-Transport-Security", m.hsts.String())
+			}
+			return next(w, r, vars)
+		}
+
+		log := logger.Get(r.Context())
+		host := requestHostname(r.Host)
+		if m.redirectStatusCode == 0 || host == "" || (m.allowedHosts != nil && !m.allowedHosts[host]) {
+			log.Info("HTTP request received on HTTPS only endpoint")
+			return HTTPSRequiredError{}
+		}
+
+		if strings.Contains(host, ":") {
+			// IPv6 address
+			host = "[" + host + "]"
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		log.WithField("location", target).Info("Redirect HTTP request to HTTPS")
+		http.Redirect(w, r, target, m.redirectStatusCode)
+		return nil
+	}
+}
+
+// requestHostname returns the lowercased host without port
+func requestHostname(host string) string {
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	return strings.ToLower(hostname)
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHTTPSMiddleware(t *testing.T) {
+	hsts := HSTSPolicy{MaxAge: 365 * 24 * time.Hour, IncludeSubDomains: true, Preload: true}
+
+	examples := map[string]struct {
+		options            []HTTPSMiddlewareOption
+		url                string
+		tls                bool
+		forwardedProto     string
+		expectedStatusCode int
+		expectedLocation   string
+		expectedHSTS       string
+		expectedBody       string
+	}{
+		"it should reject a plain HTTP request by default": {
+			url:                "http://example.dev/apps",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedBody:       "HTTPS is required\n",
+		},
+		"it should accept a request with a TLS connection": {
+			url:                "https://example.dev/apps",
+			tls:                true,
+			expectedStatusCode: http.StatusOK,
+		},
+		"it should accept a request forwarded over HTTPS by a trusted proxy": {
+			url:                "http://example.dev/apps",
+			forwardedProto:     "https",
+			expectedStatusCode: http.StatusOK,
+		},
+		"it should add the HSTS header to HTTPS responses": {
+			options:            []HTTPSMiddlewareOption{WithHSTS(hsts)},
+			url:                "https://example.dev/apps",
+			tls:                true,
+			expectedStatusCode: http.StatusOK,
+			expectedHSTS:       "max-age=31536000; includeSubDomains; preload",
+		},
+		"it should not add the HSTS header to plain HTTP responses": {
+			options:            []HTTPSMiddlewareOption{WithHSTS(hsts), WithHTTPSRedirect(http.StatusPermanentRedirect)},
+			url:                "http://example.dev/apps",
+			expectedStatusCode: http.StatusPermanentRedirect,
+			expectedLocation:   "https://example.dev/apps",
+		},
+		"it should redirect to HTTPS preserving the path and the query": {
+			options:            []HTTPSMiddlewareOption{WithHTTPSRedirect(http.StatusMovedPermanently)},
+			url:                "http://example.dev:8080/apps/my-app?page=2",
+			expectedStatusCode: http.StatusMovedPermanently,
+			expectedLocation:   "https://example.dev/apps/my-app?page=2",
+		},
+		"it should redirect with 308 if the status code is not a redirection": {
+			options:            []HTTPSMiddlewareOption{WithHTTPSRedirect(http.StatusOK)},
+			url:                "http://example.dev/apps",
+			expectedStatusCode: http.StatusPermanentRedirect,
+			expectedLocation:   "https://example.dev/apps",
+		},
+		"it should redirect to an allowed host": {
+			options: []HTTPSMiddlewareOption{
+				WithHTTPSRedirect(http.StatusPermanentRedirect), WithHTTPSAllowedHosts("example.dev"),
+			},
+			url:                "http://EXAMPLE.dev/apps",
+			expectedStatusCode: http.StatusPermanentRedirect,
+			expectedLocation:   "https://example.dev/apps",
+		},
+		"it should not redirect to a host which is not allowed": {
+			options: []HTTPSMiddlewareOption{
+				WithHTTPSRedirect(http.StatusPermanentRedirect), WithHTTPSAllowedHosts("example.dev"),
+			},
+			url:                "http://evil.dev/apps",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedBody:       "HTTPS is required\n",
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, example.url, nil)
+			r.RemoteAddr = "10.0.0.1:1234"
+			if example.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if example.forwardedProto != "" {
+				r.Header.Set("X-Forwarded-Proto", example.forwardedProto)
+			}
+			w := httptest.NewRecorder()
+
+			handler := ErrorMiddleware.Apply(NewHTTPSMiddleware(example.options...).Apply(
+				func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+					return nil
+				},
+			))
+			_ = handler(w, r, map[string]string{})
+
+			assert.Equal(t, example.expectedStatusCode, w.Code)
+			assert.Equal(t, example.expectedLocation, w.Header().Get("Location"))
+			assert.Equal(t, example.expectedHSTS, w.Header().Get("Strict-Transport-Security"))
+			if example.expectedBody != "" {
+				assert.Equal(t, example.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+	"github.com/Scalingo/go-utils/logger"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// idempotencyMaxKeyLength is the maximum length of the idempotency keys
+	idempotencyMaxKeyLength = 255
+
+	idempotencyDefaultTTL             = 24 * time.Hour
+	idempotencyDefaultLockTTL         = time.Minute
+	idempotencyDefaultMaxBodySize     = 1 << 20
+	idempotencyDefaultMaxResponseSize = 1 << 20
+)
+
+type idempotencyMiddleware struct {
+	store     IdempotencyStore
+	ttl       time.Duration
+	lockTTL   time.Duration
+	principal func(r *http.Request) string
+	required  bool
+	// maxBodySize is the maximum size of the request bodies, which are read to
+	// be fingerprinted
+	maxBodySize int64
+	// maxResponseSize is the maximum size of the stored response bodies
+	maxResponseSize int
+}
+
+type IdempotencyMiddlewareOption func(m *idempotencyMiddleware)
+
+// WithIdempotencyStore sets the store of the idempotency keys (in memory by
+// default)
+func WithIdempotencyStore(store IdempotencyStore) IdempotencyMiddlewareOption {
+	return func(m *idempotencyMiddleware) {
+		m.store = store
+	}
+}
+
+// WithIdempotencyTTL sets the duration during which the responses are replayed
+// (24 hours by default)
+func WithIdempotencyTTL(ttl time.Duration) IdempotencyMiddlewareOption {
+	return func(m *idempotencyMiddleware) {
+		m.ttl = ttl
+	}
+}
+
+// WithIdempotencyLockTTL sets the maximum duration during which a request is
+// considered in flight (1 minute by default), so that the key can be retried if
+// the instance handling the request crashed
+func WithIdempotencyLockTTL(ttl time.Duration) IdempotencyMiddlewareOption {
+	return func(m *idempotencyMiddleware) {
+		m.lockTTL = ttl
+	}
+}
+
+// WithIdempotencyPrincipal sets the function returning the authenticated
+// principal (user, API token...) of the request. The idempotency keys of the
+// different principals are independent. By default, the principal is a hash of
+// the Authorization header.
+func WithIdempotencyPrincipal(principal func(r *http.Request) string) IdempotencyMiddlewareOption {
+	return func(m *idempotencyMiddleware) {
+		m.principal = principal
+	}
+}
+
+// WithIdempotencyKeyRequired rejects the POST and PATCH requests without
+// Idempotency-Key header with an IdempotencyKeyMissingError (400)
+func WithIdempotencyKeyRequired() IdempotencyMiddlewareOption {
+	return func(m *idempotencyMiddleware) {
+		m.required = true
+	}
+}
+
+// WithIdempotencyMaxBodySize sets the maximum size in bytes of the bodies of the
+// requests with an idempotency key (1MiB by default). The bodies are read in
+// memory to be fingerprinted, and the larger ones are rejected with a
+// *PayloadTooLargeError (413).
+func WithIdempotencyMaxBodySize(size int64) IdempotencyMiddlewareOption {
+	return func(m *idempotencyMiddleware) {
+		m.maxBodySize = size
+	}
+}
+
+// WithIdempotencyMaxResponseSize sets the maximum size in bytes of the stored
+// response bodies (1MiB by default). The larger responses are not stored and
+// the key is released, so that the retries are handled again.
+func WithIdempotencyMaxResponseSize(size int) IdempotencyMiddlewareOption {
+	return func(m *idempotencyMiddleware) {
+		m.maxResponseSize = size
+	}
+}
+
+// NewIdempotencyMiddleware initializes a middleware implementing the
+// Idempotency-Key header of the POST and PATCH requests (IETF
+// draft-ietf-httpapi-idempotency-key-header). The first response for a key is
+// stored and replayed to the retries with the Idempotent-Replayed header.
+//
+// A retry sent while the first request is in flight is rejected with an
+// *IdempotencyConflictError (409), and a request reusing a key with another
+// payload with an *IdempotencyKeyReusedError (422). The errors are rendered by
+// the ErrorMiddleware. The responses to the requests failing with an error or a
+// 5xx status code are not stored, so that they can be retried.
+func NewIdempotencyMiddleware(options ...IdempotencyMiddlewareOption) Middleware {
+	m := &idempotencyMiddleware{
+		ttl:             idempotencyDefaultTTL,
+		lockTTL:         idempotencyDefaultLockTTL,
+		principal:       authorizationPrincipal,
+		maxBodySize:     idempotencyDefaultMaxBodySize,
+		maxResponseSize: idempotencyDefaultMaxResponseSize,
+	}
+	for _, opt := range options {
+		opt(m)
+	}
+	if m.store == nil {
+		m.store = NewMemoryIdempotencyStore(0)
+	}
+	return m
+}
+
+func (m *idempotencyMiddleware) Apply(next HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		if r.Method != http.MethodPost && r.Method != http.MethodPatch {
+			return next(w, r, vars)
+		}
+		ctx := r.Context()
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			if m.required {
+				return IdempotencyKeyMissingError{}
+			}
+			return next(w, r, vars)
+		}
+		if len(key) > idempotencyMaxKeyLength {
+			return &BadRequestError{Errors: map[string][]string{
+				IdempotencyKeyHeader: {fmt.Sprintf("must be at most %d characters long", idempotencyMaxKeyLength)},
+			}}
+		}
+
+		fingerprint, err := requestFingerprint(r, m.maxBodySize)
+		if err != nil {
+			var payloadTooLargeError *PayloadTooLargeError
+			if errors.As(err, &payloadTooLargeError) {
+				// Close the connection rather than reading the remaining of the
+				// oversized body, which would be needed to reuse it
+				w.Header().Set("Connection", "close")
+			}
+			return errors.Wrap(ctx, err, "read request body")
+		}
+		storeKey := m.principal(r) + "|" + key
+
+		record, err := m.store.Lock(ctx, storeKey, fingerprint, m.lockTTL)
+		if err != nil {
+			return errors.Wrap(ctx, err, "lock idempotency key")
+		}
+		if record != nil {
+			if record.Fingerprint != fingerprint {
+				return &IdempotencyKeyReusedError{Key: key}
+			}
+			if record.Response == nil {
+				return &IdempotencyConflictError{Key: key}
+			}
+			replayIdempotentResponse(w, record.Response)
+			return nil
+		}
+
+		saved := false
+		defer func() {
+			if saved {
+				return
+			}
+			// The request can be retried, even if the handler panicked
+			err := m.store.Unlock(ctx, storeKey)
+			if err != nil {
+				logger.Get(ctx).WithError(err).Error("Fail to unlock idempotency key")
+			}
+		}()
+
+		cw := newCacheWriter(w, m.maxResponseSize)
+		err = next(cw, r, vars)
+		if err != nil {
+			return err
+		}
+		statusCode := cw.statusCode
+		if statusCode == 0 {
+			statusCode = http.StatusOK
+		}
+		if statusCode >= 500 {
+			return nil
+		}
+		if cw.tooLarge {
+			logger.Get(ctx).WithField("idempotency_key", key).Warn("Idempotent response too large to be stored")
+			return nil
+		}
+
+		response := &IdempotentResponse{
+			StatusCode: statusCode,
+			Header:     cw.handlerHeader(),
+			Body:       cw.body.Bytes(),
+		}
+		err = m.store.Save(ctx, storeKey, fingerprint, response, m.ttl)
+		if err != nil {
+			logger.Get(ctx).WithError(err).Error("Fail to save idempotent response")
+			return nil
+		}
+		saved = true
+		return nil
+	}
+}
+
+// requestFingerprint hashes the method, the URL and the body of the request.
+// The body is replaced so that the handler can read it. A
+// *PayloadTooLargeError is returned if the body is larger than maxBodySize.
+func requestFingerprint(r *http.Request, maxBodySize int64) (string, error) {
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	if r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > maxBodySize {
+			return "", &PayloadTooLargeError{Limit: maxBodySize}
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		if err != nil {
+			return "", err
+		}
+		if int64(len(body)) > maxBodySize {
+			return "", &PayloadTooLargeError{Limit: maxBodySize}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash.Write(body)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// authorizationPrincipal identifies the principal by a hash of the
+// Authorization header, which is not stored as is
+func authorizationPrincipal(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(authorization))
+	return hex.EncodeToString(sum[:16])
+}
+
+func replayIdempotentResponse(w http.ResponseWriter, response *IdempotentResponse) {
+	header := w.Header()
+	for name, values := range response.Header {
+		header[name] = slices.Clone(values)
+	}
+	header.Set("Idempotent-Replayed", "true")
+	w.WriteHeader(response.StatusCode)
+	_, _ = w.Write(response.Body)
+}
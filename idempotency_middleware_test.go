@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	type request struct {
+		method                 string
+		path                   string
+		body                   string
+		headers                map[string]string
+		expectedStatusCode     int
+		expectedBody           string
+		expectedReplayed       bool
+		expectedHandlerReached bool
+	}
+
+	examples := map[string]struct {
+		options    []IdempotencyMiddlewareOption
+		statusCode int
+		requests   []request
+	}{
+		"it should replay the response to a retry": {
+			requests: []request{
+				{headers: map[string]string{"Idempotency-Key": "key-1"}, expectedStatusCode: 201, expectedBody: "app 1", expectedHandlerReached: true},
+				{headers: map[string]string{"Idempotency-Key": "key-1"}, expectedStatusCode: 201, expectedBody: "app 1", expectedReplayed: true},
+			},
+		},
+		"it should handle the requests with different keys": {
+			requests: []request{
+				{headers: map[string]string{"Idempotency-Key": "key-1"}, expectedStatusCode: 201, expectedBody: "app 1", expectedHandlerReached: true},
+				{headers: map[string]string{"Idempotency-Key": "key-2"}, expectedStatusCode: 201, expectedBody: "app 2", expectedHandlerReached: true},
+			},
+		},
+		"it should handle the requests without key": {
+			requests: []request{
+				{expectedStatusCode: 201, expectedBody: "app 1", expectedHandlerReached: true},
+				{expectedStatusCode: 201, expectedBody: "app 2", expectedHandlerReached: true},
+			},
+		},
+		"it should reject the requests without key if it is required": {
+			options: []IdempotencyMiddlewareOption{WithIdempotencyKeyRequired()},
+			requests: []request{
+				{expectedStatusCode: 400, expectedBody: "missing Idempotency-Key header\n"},
+				{method: http.MethodGet, expectedStatusCode: 201, expectedBody: "app 1", expectedHandlerReached: true},
+			},
+		},
+		"it should reject a key reused with another payload": {
+			requests: []request{
+				{headers: map[string]string{"Idempotency-Key": "key-1"}, expectedStatusCode: 201, expectedBody: "app 1", expectedHandlerReached: true},
+				{
+					body:               `{"name":"other-app"}`,
+					headers:            map[string]string{"Idempotency-Key": "key-1"},
+					expectedStatusCode: 422,
+					expectedBody:       "the Idempotency-Key 'key-1' has already been used for another request\n",
+				},
+			},
+		},
+		"it should reject a key reused on another path": {
+			requests: []request{
+				{headers: map[string]string{"Idempotency-Key": "key-1"}, expectedStatusCode: 201, expectedBody: "app 1", expectedHandlerReached: true},
+				{path: "/apps?force=true", headers: map[string]string{"Idempotency-Key": "key-1"}, expectedStatusCode: 422},
+			},
+		},
+		"it should scope the keys by principal": {
+			requests: []request{
+				{headers: map[string]string{"Idempotency-Key": "key-1", "Authorization": "Bearer token-1"}, expectedStatusCode: 201, expectedBody: "app 1", expectedHandlerReached: true},
+				{headers: map[string]string{"Idempotency-Key": "key-1", "Authorization": "Bearer token-2"}, expectedStatusCode: 201, expectedBody: "app 2", expectedHandlerReached: true},
+				{headers: map[string]string{"Idempotency-Key": "key-1", "Authorization": "Bearer token-1"}, expectedStatusCode: 201, expectedBody: "app 1", expectedReplayed: true},
+			},
+		},
+		"it should not store the server errors": {
+			statusCode: http.StatusServiceUnavailable,
+			requests: []request{
+				{headers: map[string]string{"Idempotency-Key": "key-1"}, expectedStatusCode: 503, expectedBody: "app 1", expectedHandlerReached: true},
+				{headers: map[string]string{"Idempotency-Key": "key-1"}, expectedStatusCode: 503, expectedBody: "app 2", expectedHandlerReached: true},
+			},
+		},
+		"it should reject the bodies larger than the maximum size": {
+			options: []IdempotencyMiddlewareOption{WithIdempotencyMaxBodySize(8)},
+			requests: []request{
+				{headers: map[string]string{"Idempotency-Key": "key-1"}, expectedStatusCode: 413},
+				{expectedStatusCode: 201, expectedBody: "app 1", expectedHandlerReached: true},
+			},
+		},
+		"it should not store the responses larger than the maximum size": {
+			options: []IdempotencyMiddlewareOption{WithIdempotencyMaxResponseSize(4)},
+			requests: []request{
+				{headers: map[string]string{"Idempotency-Key": "key-1"}, expectedStatusCode: 201, expectedBody: "app 1", expectedHandlerReached: true},
+				{headers: map[string]string{"Idempotency-Key": "key-1"}, expectedStatusCode: 201, expectedBody: "app 2", expectedHandlerReached: true},
+			},
+		},
+		"it should reject a key longer than 255 characters": {
+			requests: []request{
+				{headers: map[string]string{"Idempotency-Key": strings.Repeat("a", 256)}, expectedStatusCode: 400},
+			},
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			log, _ := test.NewNullLogger()
+			router := NewRouter(log, WithoutOtelInstrumentation())
+			router.Use(ErrorMiddleware)
+			router.Use(NewIdempotencyMiddleware(example.options...))
+
+			calls := 0
+			router.HandleFunc("/apps", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				calls++
+				body, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				require.NotEmpty(t, body)
+
+				w.Header().Set("Location", fmt.Sprintf("/apps/%d", calls))
+				statusCode := example.statusCode
+				if statusCode == 0 {
+					statusCode = http.StatusCreated
+				}
+				w.WriteHeader(statusCode)
+				_, err = fmt.Fprintf(w, "app %d", calls)
+				return err
+			})
+
+			for i, request := range example.requests {
+				method := request.method
+				if method == "" {
+					method = http.MethodPost
+				}
+				path := request.path
+				if path == "" {
+					path = "/apps"
+				}
+				body := request.body
+				if body == "" {
+					body = `{"name":"my-app"}`
+				}
+				r := httptest.NewRequest(method, path, strings.NewReader(body))
+				for name, value := range request.headers {
+					r.Header.Set(name, value)
+				}
+				w := httptest.NewRecorder()
+				callsBefore := calls
+				router.ServeHTTP(w, r)
+
+				assert.Equal(t, request.expectedStatusCode, w.Code, "request %d", i)
+				if request.expectedBody != "" {
+					assert.Equal(t, request.expectedBody, w.Body.String(), "request %d", i)
+				}
+				assert.Equal(t, request.expectedHandlerReached, calls > callsBefore, "request %d", i)
+				if request.expectedReplayed {
+					assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"), "request %d", i)
+					assert.NotEmpty(t, w.Header().Get("Location"), "request %d", i)
+				} else {
+					assert.Empty(t, w.Header().Get("Idempotent-Replayed"), "request %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestIdempotencyMiddleware_Concurrent(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	router := NewRouter(log, WithoutOtelInstrumentation())
+	router.Use(ErrorMiddleware)
+	router.Use(NewIdempotencyMiddleware())
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	router.HandleFunc("/apps", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	})
+
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/apps", strings.NewReader(`{"name":"my-app"}`))
+		r.Header.Set("Idempotency-Key", "key-1")
+		return r
+	}
+
+	inFlight := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.ServeHTTP(inFlight, newRequest())
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newRequest())
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "a request with the Idempotency-Key 'key-1' is being processed\n", w.Body.String())
+
+	close(release)
+	<-done
+	assert.Equal(t, http.StatusCreated, inFlight.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newRequest())
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// idempotencyStoreSweepInterval is the minimum interval between two removals
+	// of the expired records of the memory store
+	idempotencyStoreSweepInterval  = time.Minute
+	idempotencyStoreDefaultMaxKeys = 10000
+)
+
+// IdempotentResponse is the response replayed to the retries of a request
+type IdempotentResponse struct {
+	StatusCode int
+	// Header contains the headers set by the handler
+	Header http.Header
+	Body   []byte
+}
+
+// IdempotencyRecord is the state of the request sent with an idempotency key
+type IdempotencyRecord struct {
+	// Fingerprint identifies the payload of the request
+	Fingerprint string
+	// Response is nil while the request is in flight
+	Response  *IdempotentResponse
+	ExpiresAt time.Time
+}
+
+// IdempotencyStore stores the state of the requests sent with an idempotency
+// key. It can be implemented on top of an external backend to share the keys
+// between several instances of a service, in which case Lock must be atomic.
+type IdempotencyStore interface {
+	// Lock records the request with key as in flight until lockTTL, unless a
+	// record exists for key. In this case, the existing record is returned.
+	Lock(ctx context.Context, key, fingerprint string, lockTTL time.Duration) (*IdempotencyRecord, error)
+	// Save stores the response of the request with key during ttl
+	Save(ctx context.Context, key, fingerprint string, response *IdempotentResponse, ttl time.Duration) error
+	// Unlock removes the record of a request in flight, so that it can be
+	// retried
+	Unlock(ctx context.Context, key string) error
+}
+
+// MemoryIdempotencyStore stores the idempotency keys in memory, evicting the
+// oldest ones when the maximum number of keys is reached. The keys are not
+// shared between the instances of a service.
+type MemoryIdempotencyStore struct {
+	mutex   sync.Mutex
+	maxKeys int
+	records map[string]*list.Element
+	// order contains the records from the most to the least recently locked
+	order     *list.List
+	lastSweep time.Time
+	// now is overridden in tests
+	now func() time.Time
+}
+
+type memoryIdempotencyEntry struct {
+	key    string
+	record *IdempotencyRecord
+}
+
+// NewMemoryIdempotencyStore initializes a store keeping at most maxKeys keys. A
+// maxKeys lower or equal to 0 uses the default of 10000 keys.
+func NewMemoryIdempotencyStore(maxKeys int) *MemoryIdempotencyStore {
+	if maxKeys <= 0 {
+		maxKeys = idempotencyStoreDefaultMaxKeys
+	}
+	return &MemoryIdempotencyStore{
+		maxKeys: maxKeys,
+		records: map[string]*list.Element{},
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryIdempotencyStore) Lock(ctx context.Context, key, fingerprint string, lockTTL time.Duration) (*IdempotencyRecord, error) {
+	now := s.now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sweep(now)
+	element, ok := s.records[key]
+	if ok {
+		record := element.Value.(*memoryIdempotencyEntry).record
+		if now.Before(record.ExpiresAt) {
+			existing := *record
+			return &existing, nil
+		}
+		s.remove(element)
+	}
+	s.add(key, &IdempotencyRecord{Fingerprint: fingerprint, ExpiresAt: now.Add(lockTTL)})
+	return nil, nil
+}
+
+func (s *MemoryIdempotencyStore) Save(ctx context.Context, key, fingerprint string, response *IdempotentResponse, ttl time.Duration) error {
+	now := s.now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record := &IdempotencyRecord{Fingerprint: fingerprint, Response: response, ExpiresAt: now.Add(ttl)}
+	if element, ok := s.records[key]; ok {
+		element.Value.(*memoryIdempotencyEntry).record = record
+		return nil
+	}
+	s.add(key, record)
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Unlock(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	element, ok := s.records[key]
+	if ok && element.Value.(*memoryIdempotencyEntry).record.Response == nil {
+		s.remove(element)
+	}
+	return nil
+}
+
+// Len returns the number of keys in the store, including the expired ones which
+// have not been removed yet
+func (s *MemoryIdempotencyStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.order.Len()
+}
+
+// add stores a new record, evicting the oldest ones above the maximum number of
+// keys. The mutex must be held.
+func (s *MemoryIdempotencyStore) add(key string, record *IdempotencyRecord) {
+	s.records[key] = s.order.PushFront(&memoryIdempotencyEntry{key: key, record: record})
+	for s.order.Len() > s.maxKeys {
+		s.remove(s.order.Back())
+	}
+}
+
+// remove removes a record. The mutex must be held.
+func (s *MemoryIdempotencyStore) remove(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.records, element.Value.(*memoryIdempotencyEntry).key)
+}
+
+// sweep removes the expired records
+func (s *MemoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < idempotencyStoreSweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for element := s.order.Front(); element != nil; {
+		next := element.Next()
+		if !now.Before(element.Value.(*memoryIdempotencyEntry).record.ExpiresAt) {
+			s.remove(element)
+		}
+		element = next
+	}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	response := &IdempotentResponse{StatusCode: 201, Body: []byte("created")}
+
+	t.Run("it should lock a key until the response is saved", func(t *testing.T) {
+		store := NewMemoryIdempotencyStore(0)
+		store.now = func() time.Time { return start }
+
+		record, err := store.Lock(ctx, "key", "fingerprint", time.Minute)
+		require.NoError(t, err)
+		assert.Nil(t, record)
+
+		record, err = store.Lock(ctx, "key", "fingerprint", time.Minute)
+		require.NoError(t, err)
+		require.NotNil(t, record)
+		assert.Equal(t, "fingerprint", record.Fingerprint)
+		assert.Nil(t, record.Response)
+
+		require.NoError(t, store.Save(ctx, "key", "fingerprint", response, time.Hour))
+		record, err = store.Lock(ctx, "key", "fingerprint", time.Minute)
+		require.NoError(t, err)
+		require.NotNil(t, record)
+		assert.Equal(t, response, record.Response)
+	})
+
+	t.Run("it should release a key once the lock or the record expire", func(t *testing.T) {
+		now := start
+		store := NewMemoryIdempotencyStore(0)
+		store.now = func() time.Time { return now }
+
+		_, err := store.Lock(ctx, "in-flight", "fingerprint", time.Minute)
+		require.NoError(t, err)
+		require.NoError(t, store.Save(ctx, "saved", "fingerprint", response, time.Hour))
+
+		now = now.Add(time.Minute)
+		record, err := store.Lock(ctx, "in-flight", "fingerprint", time.Minute)
+		require.NoError(t, err)
+		assert.Nil(t, record)
+		record, err = store.Lock(ctx, "saved", "fingerprint", time.Minute)
+		require.NoError(t, err)
+		assert.NotNil(t, record)
+
+		now = now.Add(time.Hour)
+		record, err = store.Lock(ctx, "saved", "fingerprint", time.Minute)
+		require.NoError(t, err)
+		assert.Nil(t, record)
+	})
+
+	t.Run("it should only unlock the keys in flight", func(t *testing.T) {
+		store := NewMemoryIdempotencyStore(0)
+
+		_, err := store.Lock(ctx, "in-flight", "fingerprint", time.Minute)
+		require.NoError(t, err)
+		require.NoError(t, store.Save(ctx, "saved", "fingerprint", response, time.Hour))
+		require.NoError(t, store.Unlock(ctx, "in-flight"))
+		require.NoError(t, store.Unlock(ctx, "saved"))
+
+		record, err := store.Lock(ctx, "in-flight", "fingerprint", time.Minute)
+		require.NoError(t, err)
+		assert.Nil(t, record)
+		record, err = store.Lock(ctx, "saved", "fingerprint", time.Minute)
+		require.NoError(t, err)
+		assert.NotNil(t, record)
+	})
+
+	t.Run("it should evict the oldest keys above the maximum number of keys", func(t *testing.T) {
+		store := NewMemoryIdempotencyStore(2)
+
+		for _, key := range []string{"key-1", "key-2", "key-3"} {
+			_, err := store.Lock(ctx, key, "fingerprint", time.Minute)
+			require.NoError(t, err)
+		}
+		assert.Equal(t, 2, store.Len())
+
+		record, err := store.Lock(ctx, "key-3", "fingerprint", time.Minute)
+		require.NoError(t, err)
+		assert.NotNil(t, record)
+		record, err = store.Lock(ctx, "key-1", "fingerprint", time.Minute)
+		require.NoError(t, err)
+		assert.Nil(t, record)
+	})
+}
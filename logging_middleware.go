@@ -1,9 +1,9 @@
 package handlers
 
 import (
-	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"sync"
@@ -11,6 +11,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/negroni/v3"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -34,14 +35,46 @@ type LoggingMiddleware struct {
 	filtersEnabledInit sync.Once
 	filtersEnabled     bool
 	filters            []patternInfo
+	// withoutQueryString removes the query string from the logged path
+	withoutQueryString bool
+	// redactedQueryParameters are the query parameters whose value is replaced
+	// in the logged path
+	redactedQueryParameters map[string]bool
+	// bodyLogging is set if the request and response bodies are logged
+	bodyLogging *bodyLogging
 }
 
-func NewLoggingMiddleware(logger logrus.FieldLogger) Middleware {
+type LoggingMiddlewareOption func(l *LoggingMiddleware)
+
+// WithoutQueryString removes the query string from the logged path
+func WithoutQueryString() LoggingMiddlewareOption {
+	return func(l *LoggingMiddleware) {
+		l.withoutQueryString = true
+	}
+}
+
+// WithRedactedQueryParameters replaces the value of the given query parameters
+// in the logged path
+func WithRedactedQueryParameters(names ...string) LoggingMiddlewareOption {
+	return func(l *LoggingMiddleware) {
+		if l.redactedQueryParameters == nil {
+			l.redactedQueryParameters = map[string]bool{}
+		}
+		for _, name := range names {
+			l.redactedQueryParameters[name] = true
+		}
+	}
+}
+
+func NewLoggingMiddleware(logger logrus.FieldLogger, options ...LoggingMiddlewareOption) Middleware {
 	m := &LoggingMiddleware{logger: logger, filters: []patternInfo{}}
+	for _, opt := range options {
+		opt(m)
+	}
 	return m
 }
 
-func NewLoggingMiddlewareWithFilters(logger logrus.FieldLogger, filters map[string]logrus.Level) (*LoggingMiddleware, error) {
+func NewLoggingMiddlewareWithFilters(logger logrus.FieldLogger, filters map[string]logrus.Level, options ...LoggingMiddlewareOption) (*LoggingMiddleware, error) {
 	refilters := []patternInfo{}
 	for pattern, level := range filters {
 		re, err := regexp.Compile(pattern)
@@ -51,6 +84,9 @@ func NewLoggingMiddlewareWithFilters(logger logrus.FieldLogger, filters map[stri
 		refilters = append(refilters, patternInfo{re: re, level: level})
 	}
 	m := &LoggingMiddleware{logger: logger, filters: refilters}
+	for _, opt := range options {
+		opt(m)
+	}
 	return m, nil
 }
 
@@ -59,25 +95,34 @@ func (l *LoggingMiddleware) Apply(next HandlerFunc) HandlerFunc {
 		logger := l.logger
 		before := time.Now()
 
-		id, ok := r.Context().Value("request_id").(string)
+		id, ok := RequestIDFromContext(r.Context())
 		if ok {
 			logger = logger.WithField("request_id", id)
 		}
-
-		from := r.RemoteAddr
-		if r.Header.Get("X-Forwarded-For") != "" {
-			from = r.Header.Get("X-Forwarded-For")
+		spanContext := oteltrace.SpanContextFromContext(r.Context())
+		if spanContext.IsValid() {
+			logger = logger.WithFields(logrus.Fields{
+				"trace_id": spanContext.TraceID().String(),
+				"span_id":  spanContext.SpanID().String(),
+			})
 		}
+
+		origin := clientOrigin(r)
+		from := origin.IP
 		proto := r.Proto
-		if r.Header.Get("X-Forwarded-Proto") != "" {
-			proto = r.Header.Get("X-Forwarded-Proto")
+		if origin.schemeForwarded {
+			proto = origin.Scheme
 		}
 
-		r = r.WithContext(context.WithValue(r.Context(), "logger", logger))
+		ctx, logFields := contextWithRequestLogFields(ContextWithLogger(r.Context(), logger))
+		r = r.WithContext(ctx)
 
+		route, routeName := currentRoute(r)
 		fields := logrus.Fields{
 			"method":     r.Method,
-			"path":       r.URL.String(),
+			"path":       l.loggedPath(r.URL),
+			"route":      route,
+			"route_name": routeName,
 			"host":       r.Host,
 			"from":       from,
 			"protocol":   proto,
@@ -105,6 +150,13 @@ func (l *LoggingMiddleware) Apply(next HandlerFunc) HandlerFunc {
 		}
 		loggerFuncMap[loglevel](logger, "starting request")
 
+		var bodyWriter *bodyCaptureWriter
+		var bodyReader *bodyCaptureReader
+		if l.bodyLogging != nil && l.bodyLogging.isEnabled(r) {
+			bodyWriter, bodyReader = l.bodyLogging.capture(w, r)
+			w = bodyWriter
+		}
+
 		rw := negroni.NewResponseWriter(w)
 		err := next(rw, r, vars)
 		after := time.Now()
@@ -114,6 +166,12 @@ func (l *LoggingMiddleware) Apply(next HandlerFunc) HandlerFunc {
 			status = 200
 		}
 
+		// The fields added with AddRequestLogFields cannot override the status,
+		// duration and bytes of the response
+		logger = logger.WithFields(logFields.get())
+		if bodyWriter != nil {
+			logger = logger.WithFields(l.bodyLogging.fields(bodyWriter, bodyReader))
+		}
 		logger = logger.WithFields(logrus.Fields{
 			"status":   status,
 			"duration": after.Sub(before).Seconds(),
@@ -125,6 +183,27 @@ func (l *LoggingMiddleware) Apply(next HandlerFunc) HandlerFunc {
 	}
 }
 
+func (l *LoggingMiddleware) loggedPath(u *url.URL) string {
+	if u.RawQuery == "" || (!l.withoutQueryString && len(l.redactedQueryParameters) == 0) {
+		return u.String()
+	}
+
+	loggedURL := *u
+	if l.withoutQueryString {
+		loggedURL.RawQuery = ""
+		return loggedURL.String()
+	}
+
+	query := loggedURL.Query()
+	for name := range query {
+		if l.redactedQueryParameters[name] {
+			query[name] = []string{"REDACTED"}
+		}
+	}
+	loggedURL.RawQuery = query.Encode()
+	return loggedURL.String()
+}
+
 func (l *LoggingMiddleware) isFiltersEnabled() bool {
 	l.filtersEnabledInit.Do(func() {
 		if os.Getenv("HANDLERS_LOG_FILTERS") == "true" {
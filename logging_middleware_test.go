@@ -21,6 +21,7 @@ func TestLoggingMiddleware_Apply(t *testing.T) {
 		Path                string
 		Method              string
 		Host                string
+		RemoteAddr          string
 		Headers             map[string]string
 		Context             func(context.Context) context.Context
 		Env                 map[string]string
@@ -35,18 +36,29 @@ func TestLoggingMiddleware_Apply(t *testing.T) {
 			Host:           "example.dev",
 			ExpectedFields: []string{"path", "host", "method"},
 		}, {
-			Name:                "HTTP GET / on example.dev with X-Forwarded-Proto",
+			Name:                "HTTP GET / on example.dev with X-Forwarded-For from a trusted proxy",
 			Path:                "/",
 			Method:              "GET",
 			Host:                "example.dev",
+			RemoteAddr:          "10.0.0.1:12345",
 			Headers:             map[string]string{"X-Forwarded-For": "10.11.12.13"},
 			ExpectedFieldValues: map[string]string{"from": "10.11.12.13"},
 			ExpectedFields:      []string{"path", "host", "method", "from"},
+		}, {
+			Name:                "HTTP GET / on example.dev with X-Forwarded-For from an untrusted client",
+			Path:                "/",
+			Method:              "GET",
+			Host:                "example.dev",
+			RemoteAddr:          "203.0.113.1:12345",
+			Headers:             map[string]string{"X-Forwarded-For": "10.11.12.13"},
+			ExpectedFieldValues: map[string]string{"from": "203.0.113.1"},
+			ExpectedFields:      []string{"path", "host", "method", "from"},
 		}, {
 			Name:                "HTTP GET / on example.dev with X-Forwarded-Proto",
 			Path:                "/",
 			Method:              "GET",
 			Host:                "example.dev",
+			RemoteAddr:          "10.0.0.1:12345",
 			Headers:             map[string]string{"X-Forwarded-Proto": "https"},
 			ExpectedFieldValues: map[string]string{"protocol": "https"},
 			ExpectedFields:      []string{"path", "host", "method", "protocol"},
@@ -73,6 +85,15 @@ func TestLoggingMiddleware_Apply(t *testing.T) {
 			Context: func(ctx context.Context) context.Context {
 				return context.WithValue(ctx, "request_id", "0")
 			},
+		}, {
+			Name:           "with request_id stored with ContextWithRequestID",
+			Path:           "/",
+			Method:         "GET",
+			Host:           "example.dev",
+			ExpectedFields: []string{"path", "host", "method", "request_id"},
+			Context: func(ctx context.Context) context.Context {
+				return ContextWithRequestID(ctx, "0")
+			},
 		}, {
 			Name:           "with request_id in context",
 			Path:           "/",
@@ -81,6 +102,7 @@ func TestLoggingMiddleware_Apply(t *testing.T) {
 			ExpectedFields: []string{"path", "host", "method"},
 			Handler: func(t *testing.T) HandlerFunc {
 				return HandlerFunc(func(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+					// The logger must be stored under the key read by logger.Get from go-utils
 					logger, ok := r.Context().Value("logger").(logrus.FieldLogger)
 					assert.True(t, ok)
 					assert.NotNil(t, logger)
@@ -161,6 +183,7 @@ func TestLoggingMiddleware_Apply(t *testing.T) {
 			}
 
 			r.Host = example.Host
+			r.RemoteAddr = example.RemoteAddr
 			if example.Headers != nil {
 				for k, v := range example.Headers {
 					r.Header.Add(k, v)
@@ -211,3 +234,67 @@ func TestLoggingMiddleware_Apply(t *testing.T) {
 		})
 	}
 }
+
+func TestLoggingMiddleware_Route(t *testing.T) {
+	examples := map[string]struct {
+		options      []LoggingMiddlewareOption
+		path         string
+		expectedPath string
+	}{
+		"it should log the path with its query string by default": {
+			path:         "/apps/my-app?token=secret&page=2",
+			expectedPath: "/apps/my-app?token=secret&page=2",
+		},
+		"it should remove the query string": {
+			options:      []LoggingMiddlewareOption{WithoutQueryString()},
+			path:         "/apps/my-app?token=secret&page=2",
+			expectedPath: "/apps/my-app",
+		},
+		"it should redact the given query parameters": {
+			options:      []LoggingMiddlewareOption{WithRedactedQueryParameters("token")},
+			path:         "/apps/my-app?token=secret&page=2",
+			expectedPath: "/apps/my-app?page=2&token=REDACTED",
+		},
+		"it should not modify a path without query string": {
+			options:      []LoggingMiddlewareOption{WithRedactedQueryParameters("token")},
+			path:         "/apps/my-app",
+			expectedPath: "/apps/my-app",
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			logger, hook := test.NewNullLogger()
+			router := NewRouter(logger, WithoutOtelInstrumentation(), WithLoggingOptions(example.options...))
+			router.HandleFunc("/apps/{app_id}", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				return nil
+			}).Name("apps-show")
+
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, example.path, nil))
+
+			require.Len(t, hook.Entries, 2)
+			for _, entry := range hook.Entries {
+				assert.Equal(t, "/apps/{app_id}", entry.Data["route"])
+				assert.Equal(t, "apps-show", entry.Data["route_name"])
+				assert.Equal(t, example.expectedPath, entry.Data["path"])
+			}
+		})
+	}
+}
+
+func TestLoggingMiddleware_RequestLogFields(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	router := NewRouter(logger, WithoutOtelInstrumentation())
+	router.HandleFunc("/apps", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		assert.True(t, AddRequestLogFields(r.Context(), logrus.Fields{"apps_count": 3, "status": 999}))
+		return nil
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/apps", nil))
+
+	require.Len(t, hook.Entries, 2)
+	assert.NotContains(t, hook.Entries[0].Data, "apps_count")
+	assert.Equal(t, "request completed", hook.Entries[1].Message)
+	assert.Equal(t, 3, hook.Entries[1].Data["apps_count"])
+	assert.Equal(t, 200, hook.Entries[1].Data["status"])
+}
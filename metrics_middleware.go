@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/urfave/negroni/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+)
+
+const (
+	metricsInstrumentationName = "github.com/Scalingo/go-handlers"
+	// metricsUnmatchedRoute is the route label of requests which did not match
+	// any route template
+	metricsUnmatchedRoute = "unmatched"
+	// metricsOtherMethod is the method label of requests with a non standard
+	// method, to bound the cardinality of the metrics
+	metricsOtherMethod = "_OTHER"
+)
+
+// Duration buckets recommended by the OpenTelemetry semantic conventions for
+// the HTTP server request duration
+var metricsDurationBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10,
+}
+
+// MetricsMiddleware records HTTP server metrics through the OpenTelemetry
+// metric API. The metrics are labelled by route template, method and status
+// class so that their cardinality does not depend on the requested URLs.
+type MetricsMiddleware struct {
+	meterProvider metric.MeterProvider
+
+	requestCount metric.Int64Counter
+	duration     metric.Float64Histogram
+	inFlight     metric.Int64UpDownCounter
+	requestSize  metric.Int64Histogram
+	responseSize metric.Int64Histogram
+}
+
+type MetricsMiddlewareOption func(m *MetricsMiddleware)
+
+// WithMeterProvider sets the meter provider used to create the instruments. The
+// global meter provider is used by default.
+func WithMeterProvider(provider metric.MeterProvider) MetricsMiddlewareOption {
+	return func(m *MetricsMiddleware) {
+		m.meterProvider = provider
+	}
+}
+
+// NewMetricsMiddleware initializes the middleware and its instruments. To
+// record the status code written by the ErrorMiddleware, the metrics middleware
+// must wrap it, i.e. be added to the router before the ErrorMiddleware.
+func NewMetricsMiddleware(ctx context.Context, options ...MetricsMiddlewareOption) (*MetricsMiddleware, error) {
+	m := &MetricsMiddleware{}
+	for _, opt := range options {
+		opt(m)
+	}
+	if m.meterProvider == nil {
+		m.meterProvider = otel.GetMeterProvider()
+	}
+	meter := m.meterProvider.Meter(metricsInstrumentationName)
+
+	var err error
+	m.requestCount, err = meter.Int64Counter("http.server.request.count",
+		metric.WithDescription("Number of HTTP requests handled by the server."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, errors.Wrap(ctx, err, "create request count counter")
+	}
+	m.duration, err = meter.Float64Histogram("http.server.request.duration",
+		metric.WithDescription("Duration of HTTP server requests."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(metricsDurationBuckets...),
+	)
+	if err != nil {
+		return nil, errors.Wrap(ctx, err, "create request duration histogram")
+	}
+	m.inFlight, err = meter.Int64UpDownCounter("http.server.active_requests",
+		metric.WithDescription("Number of HTTP requests currently handled by the server."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, errors.Wrap(ctx, err, "create active requests counter")
+	}
+	m.requestSize, err = meter.Int64Histogram("http.server.request.body.size",
+		metric.WithDescription("Size of HTTP server request bodies."),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return nil, errors.Wrap(ctx, err, "create request body size histogram")
+	}
+	m.responseSize, err = meter.Int64Histogram("http.server.response.body.size",
+		metric.WithDescription("Size of HTTP server response bodies."),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return nil, errors.Wrap(ctx, err, "create response body size histogram")
+	}
+
+	return m, nil
+}
+
+func (m *MetricsMiddleware) Apply(next HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		ctx := r.Context()
+		before := time.Now()
+
+		requestAttributes := []attribute.KeyValue{
+			attribute.String("http.request.method", metricsMethod(r.Method)),
+			attribute.String("http.route", metricsRoute(r)),
+		}
+		m.inFlight.Add(ctx, 1, metric.WithAttributes(requestAttributes...))
+		defer m.inFlight.Add(ctx, -1, metric.WithAttributes(requestAttributes...))
+
+		var body *countingReadCloser
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingReadCloser{ReadCloser: r.Body}
+			r.Body = body
+		}
+
+		rw := negroni.NewResponseWriter(w)
+		err := next(rw, r, vars)
+
+		status := rw.Status()
+		if status == 0 {
+			// Nothing has been written, the response is written later on by a
+			// middleware wrapping this one
+			status = http.StatusOK
+			if err != nil {
+				status = http.StatusInternalServerError
+			}
+		}
+
+		attributes := metric.WithAttributes(append(requestAttributes,
+			attribute.String("http.response.status_class", strconv.Itoa(status/100)+"xx"),
+		)...)
+		m.requestCount.Add(ctx, 1, attributes)
+		m.duration.Record(ctx, time.Since(before).Seconds(), attributes)
+		m.responseSize.Record(ctx, int64(rw.Size()), attributes)
+		requestSize := int64(0)
+		if body != nil {
+			requestSize = body.count.Load()
+		}
+		m.requestSize.Record(ctx, requestSize, attributes)
+
+		return err
+	}
+}
+
+func metricsRoute(r *http.Request) string {
+	template, _ := currentRoute(r)
+	if template == "" {
+		return metricsUnmatchedRoute
+	}
+	return template
+}
+
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return metricsOtherMethod
+}
+
+// countingReadCloser counts the bytes read from the request body
+type countingReadCloser struct {
+	io.ReadCloser
+	count atomic.Int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.count.Add(int64(n))
+	return n, err
+}
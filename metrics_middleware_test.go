@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func collectMetrics(t *testing.T, reader *sdkmetric.ManualReader) map[string]metricdata.Aggregation {
+	t.Helper()
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	metrics := map[string]metricdata.Aggregation{}
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			metrics[m.Name] = m.Data
+		}
+	}
+	return metrics
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	middleware, err := NewMetricsMiddleware(context.Background(), WithMeterProvider(provider))
+	require.NoError(t, err)
+
+	router := NewRouter(logrus.New(), WithoutOtelInstrumentation())
+	router.Use(middleware)
+	router.Use(ErrorMiddleware)
+	router.HandleFunc("/apps/{app_id}", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) == "fail" {
+			return errors.New("fail")
+		}
+		_, _ = io.WriteString(w, "hello")
+		return nil
+	})
+
+	for _, appID := range []string{"app-1", "app-2"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/apps/"+appID+"?page=1", strings.NewReader("body")))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/apps/app-3", strings.NewReader("fail")))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+
+	metrics := collectMetrics(t, reader)
+
+	t.Run("it should count requests by route template, method and status class", func(t *testing.T) {
+		count, ok := metrics["http.server.request.count"].(metricdata.Sum[int64])
+		require.True(t, ok)
+		counts := map[string]int64{}
+		for _, point := range count.DataPoints {
+			route, _ := point.Attributes.Value("http.route")
+			method, _ := point.Attributes.Value("http.request.method")
+			class, _ := point.Attributes.Value("http.response.status_class")
+			counts[route.AsString()+" "+method.AsString()+" "+class.AsString()] = point.Value
+		}
+		assert.Equal(t, map[string]int64{
+			"/apps/{app_id} POST 2xx": 2,
+			"/apps/{app_id} POST 5xx": 1,
+		}, counts)
+	})
+
+	t.Run("it should record the duration and the sizes", func(t *testing.T) {
+		duration, ok := metrics["http.server.request.duration"].(metricdata.Histogram[float64])
+		require.True(t, ok)
+		require.Len(t, duration.DataPoints, 2)
+
+		requestSize, ok := metrics["http.server.request.body.size"].(metricdata.Histogram[int64])
+		require.True(t, ok)
+		responseSize, ok := metrics["http.server.response.body.size"].(metricdata.Histogram[int64])
+		require.True(t, ok)
+		success := attribute.NewSet(
+			attribute.String("http.request.method", "POST"),
+			attribute.String("http.route", "/apps/{app_id}"),
+			attribute.String("http.response.status_class", "2xx"),
+		)
+		for _, point := range requestSize.DataPoints {
+			if point.Attributes.Equals(&success) {
+				assert.Equal(t, int64(8), point.Sum)
+			}
+		}
+		for _, point := range responseSize.DataPoints {
+			if point.Attributes.Equals(&success) {
+				assert.Equal(t, int64(10), point.Sum)
+			}
+		}
+	})
+
+	t.Run("it should not have any request in flight once the requests are completed", func(t *testing.T) {
+		inFlight, ok := metrics["http.server.active_requests"].(metricdata.Sum[int64])
+		require.True(t, ok)
+		for _, point := range inFlight.DataPoints {
+			assert.Equal(t, int64(0), point.Value)
+		}
+	})
+}
+
+func TestMetricsMiddleware_Method(t *testing.T) {
+	assert.Equal(t, "GET", metricsMethod("GET"))
+	assert.Equal(t, metricsOtherMethod, metricsMethod("BREW"))
+}
+
+func TestPrometheusMetrics_Handler(t *testing.T) {
+	metrics, err := NewPrometheusMetrics(context.Background())
+	require.NoError(t, err)
+	middleware, err := NewMetricsMiddleware(context.Background(), WithMeterProvider(metrics))
+	require.NoError(t, err)
+
+	router := NewRouter(logrus.New(), WithoutOtelInstrumentation())
+	router.Use(middleware)
+	router.HandleFunc("/apps/{app_id}", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		return nil
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/apps/app-1", nil))
+
+	w := httptest.NewRecorder()
+	NewMetricsRouter(logrus.New(), metrics, WithoutOtelInstrumentation()).ServeHTTP(w, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `http_server_request_count_total{`)
+	assert.Contains(t, w.Body.String(), `http_route="/apps/{app_id}"`)
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+)
+
+const MetricsPath = "/metrics"
+
+// PrometheusMetrics is an OpenTelemetry meter provider whose metrics are
+// exposed in the Prometheus format. It is meant to be given to
+// NewMetricsMiddleware with WithMeterProvider.
+type PrometheusMetrics struct {
+	*sdkmetric.MeterProvider
+	handler http.Handler
+}
+
+// NewPrometheusMetrics initializes a meter provider exporting its metrics to a
+// dedicated Prometheus registry, hence the metrics of other libraries
+// registered in the default registry are not exposed.
+func NewPrometheusMetrics(ctx context.Context) (*PrometheusMetrics, error) {
+	registry := prometheus.NewRegistry()
+	exporter, err := otelprometheus.New(otelprometheus.WithRegisterer(registry))
+	if err != nil {
+		return nil, errors.Wrap(ctx, err, "create Prometheus exporter")
+	}
+
+	return &PrometheusMetrics{
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(exporter)),
+		handler:       promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+	}, nil
+}
+
+// Handler serves the metrics for Prometheus scraping
+func (p *PrometheusMetrics) Handler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	p.handler.ServeHTTP(w, r)
+	return nil
+}
+
+// NewMetricsRouter initializes a router exposing the metrics on MetricsPath. It
+// is meant to be served on a private address, e.g. with a ServerGroup.
+func NewMetricsRouter(log logrus.FieldLogger, metrics *PrometheusMetrics, options ...RouterOption) *Router {
+	router := NewRouter(log, options...)
+	router.HandleFunc(MetricsPath, metrics.Handler).Methods(http.MethodGet)
+	return router
+}
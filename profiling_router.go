@@ -11,7 +11,11 @@ import (
 	"github.com/Scalingo/go-utils/logger"
 )
 
-const PprofRoutePrefix = "/debug/pprof"
+const (
+	PprofRoutePrefix = "/debug/pprof"
+
+	pprofDefaultAddress = ":6060"
+)
 
 type profiling struct {
 	enable bool
@@ -64,6 +68,33 @@ func NewProfilingRouter(ctx context.Context) (*Router, error) {
 	return pprofRouter, nil
 }
 
+// NewProfilingServer initializes a server dedicated to the profiling router,
+// listening on the address set in the PPROF_ADDRESS environment variable
+// (":6060" by default). It returns a nil server if profiling is not activable,
+// which can be given as is to NewServerGroup.
+func NewProfilingServer(ctx context.Context, options ...ServerOption) (*Server, error) {
+	prof := profiling{}
+	err := prof.initializeFromEnv(ctx)
+	if err != nil {
+		return nil, errors.Wrap(ctx, err, "initialize pprof profiling")
+	}
+	if !prof.isActivable() {
+		return nil, nil
+	}
+
+	pprofRouter, err := NewProfilingRouter(ctx)
+	if err != nil {
+		return nil, errors.Wrap(ctx, err, "create profiling router")
+	}
+
+	address := os.Getenv("PPROF_ADDRESS")
+	if address == "" {
+		address = pprofDefaultAddress
+	}
+	options = append([]ServerOption{WithServerName("profiling"), WithAddress(address)}, options...)
+	return NewServer(pprofRouter, options...), nil
+}
+
 func (prof *profiling) initializeFromEnv(ctx context.Context) error {
 	pprofEnable := os.Getenv("PPROF_ENABLED")
 	if pprofEnable == "" {
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Scalingo/go-utils/logger"
+)
+
+// RateLimitKeyFunc returns the key identifying the client of the request. The
+// requests with an empty key are not limited.
+type RateLimitKeyFunc func(r *http.Request) string
+
+// RateLimitByIP identifies the clients by IP address. The IP address is
+// resolved through the trusted proxies.
+func RateLimitByIP(r *http.Request) string {
+	return "ip:" + clientOrigin(r).IP
+}
+
+// RateLimitByPrincipal identifies the clients by the authenticated principal
+// (user, API token...) returned by principal. The anonymous requests, for which
+// principal returns an empty string, are identified by IP address.
+func RateLimitByPrincipal(principal func(r *http.Request) string) RateLimitKeyFunc {
+	return func(r *http.Request) string {
+		p := principal(r)
+		if p == "" {
+			return RateLimitByIP(r)
+		}
+		return "principal:" + p
+	}
+}
+
+type rateLimitMiddleware struct {
+	limit RateLimit
+	// routeLimits are the limits of specific routes, by path template or route
+	// name
+	routeLimits map[string]RateLimit
+	key         RateLimitKeyFunc
+	store       RateLimitStore
+}
+
+type RateLimitMiddlewareOption func(m *rateLimitMiddleware)
+
+// WithRateLimitKey sets the function identifying the clients (RateLimitByIP by
+// default)
+func WithRateLimitKey(key RateLimitKeyFunc) RateLimitMiddlewareOption {
+	return func(m *rateLimitMiddleware) {
+		m.key = key
+	}
+}
+
+// WithRateLimitStore sets the store of the rate limits (in memory by default)
+func WithRateLimitStore(store RateLimitStore) RateLimitMiddlewareOption {
+	return func(m *rateLimitMiddleware) {
+		m.store = store
+	}
+}
+
+// WithRouteRateLimit sets the limit of a route, identified by its path template
+// (e.g. /apps/{app_id}/deployments) or its name. The requests to this route are
+// counted separately from the other routes.
+func WithRouteRateLimit(route string, limit RateLimit) RateLimitMiddlewareOption {
+	return func(m *rateLimitMiddleware) {
+		m.routeLimits[route] = limit
+	}
+}
+
+// NewRateLimitMiddleware initializes a middleware limiting the number of
+// requests of each client. The RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers are set on the responses. A request over the limit
+// is rejected with a *TooManyRequestsError, rendered as 429 with a Retry-After
+// header by the ErrorMiddleware. If the store fails, the request is allowed.
+func NewRateLimitMiddleware(limit RateLimit, options ...RateLimitMiddlewareOption) Middleware {
+	m := &rateLimitMiddleware{
+		limit:       limit,
+		routeLimits: map[string]RateLimit{},
+		key:         RateLimitByIP,
+	}
+	for _, opt := range options {
+		opt(m)
+	}
+	if m.store == nil {
+		m.store = NewMemoryRateLimitStore()
+	}
+	return m
+}
+
+func (m *rateLimitMiddleware) Apply(next HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		limit, route := m.routeLimit(r)
+		if limit.Limit <= 0 || limit.Period <= 0 {
+			return next(w, r, vars)
+		}
+		key := m.key(r)
+		if key == "" {
+			return next(w, r, vars)
+		}
+		if route != "" {
+			key = key + "|" + route
+		}
+
+		result, err := m.store.Take(r.Context(), key, limit)
+		if err != nil {
+			logger.Get(r.Context()).WithError(err).Error("Fail to check rate limit, request allowed")
+			return next(w, r, vars)
+		}
+
+		header := w.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(limit.Limit))
+		header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+		header.Set("RateLimit-Policy", strconv.Itoa(limit.Limit)+";w="+strconv.Itoa(ceilSeconds(limit.Period)))
+		if !result.Allowed {
+			return &TooManyRequestsError{RetryAfter: result.RetryAfter}
+		}
+		return next(w, r, vars)
+	}
+}
+
+// routeLimit returns the limit of the request, and the route it is specific to
+// if any
+func (m *rateLimitMiddleware) routeLimit(r *http.Request) (RateLimit, string) {
+	if len(m.routeLimits) == 0 {
+		return m.limit, ""
+	}
+	template, name := currentRoute(r)
+	if limit, ok := m.routeLimits[template]; ok && template != "" {
+		return limit, template
+	}
+	if limit, ok := m.routeLimits[name]; ok && name != "" {
+		return limit, name
+	}
+	return m.limit, ""
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+)
+
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New(ctx, "store unavailable")
+}
+
+func TestNewRateLimitMiddleware(t *testing.T) {
+	limit := RateLimit{Limit: 2, Period: time.Minute}
+
+	type request struct {
+		path               string
+		remoteAddr         string
+		user               string
+		expectedStatusCode int
+		expectedRemaining  string
+	}
+
+	examples := map[string]struct {
+		options  []RateLimitMiddlewareOption
+		requests []request
+	}{
+		"it should limit the requests by IP address": {
+			requests: []request{
+				{path: "/apps", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusOK, expectedRemaining: "1"},
+				{path: "/apps", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusOK, expectedRemaining: "0"},
+				{path: "/apps", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusTooManyRequests, expectedRemaining: "0"},
+				{path: "/apps", remoteAddr: "203.0.113.2:1234", expectedStatusCode: http.StatusOK, expectedRemaining: "1"},
+			},
+		},
+		"it should limit the requests by principal": {
+			options: []RateLimitMiddlewareOption{WithRateLimitKey(RateLimitByPrincipal(func(r *http.Request) string {
+				return r.Header.Get("X-User")
+			}))},
+			requests: []request{
+				{path: "/apps", remoteAddr: "203.0.113.1:1234", user: "alice", expectedStatusCode: http.StatusOK, expectedRemaining: "1"},
+				{path: "/apps", remoteAddr: "203.0.113.2:1234", user: "alice", expectedStatusCode: http.StatusOK, expectedRemaining: "0"},
+				{path: "/apps", remoteAddr: "203.0.113.3:1234", user: "alice", expectedStatusCode: http.StatusTooManyRequests, expectedRemaining: "0"},
+				{path: "/apps", remoteAddr: "203.0.113.1:1234", user: "bob", expectedStatusCode: http.StatusOK, expectedRemaining: "1"},
+				// Anonymous requests are limited by IP address
+				{path: "/apps", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusOK, expectedRemaining: "1"},
+			},
+		},
+		"it should count the routes with a specific limit separately": {
+			options: []RateLimitMiddlewareOption{WithRouteRateLimit("/apps/{app}/deployments", RateLimit{Limit: 1, Period: time.Minute})},
+			requests: []request{
+				{path: "/apps/my-app/deployments", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusOK, expectedRemaining: "0"},
+				{path: "/apps/other-app/deployments", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusTooManyRequests, expectedRemaining: "0"},
+				{path: "/apps", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusOK, expectedRemaining: "1"},
+			},
+		},
+		"it should not limit a route with a disabled limit": {
+			options: []RateLimitMiddlewareOption{WithRouteRateLimit("/apps/{app}/deployments", RateLimit{})},
+			requests: []request{
+				{path: "/apps/my-app/deployments", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusOK},
+				{path: "/apps/my-app/deployments", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusOK},
+				{path: "/apps/my-app/deployments", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusOK},
+			},
+		},
+		"it should not limit a request with an empty key": {
+			options: []RateLimitMiddlewareOption{WithRateLimitKey(func(r *http.Request) string { return "" })},
+			requests: []request{
+				{path: "/apps", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusOK},
+				{path: "/apps", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusOK},
+				{path: "/apps", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusOK},
+			},
+		},
+		"it should allow the requests if the store fails": {
+			options: []RateLimitMiddlewareOption{WithRateLimitStore(failingRateLimitStore{})},
+			requests: []request{
+				{path: "/apps", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusOK},
+				{path: "/apps", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusOK},
+				{path: "/apps", remoteAddr: "203.0.113.1:1234", expectedStatusCode: http.StatusOK},
+			},
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			log, _ := test.NewNullLogger()
+			router := NewRouter(log, WithoutOtelInstrumentation())
+			router.Use(ErrorMiddleware)
+			router.Use(NewRateLimitMiddleware(limit, example.options...))
+			handler := func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				return nil
+			}
+			router.HandleFunc("/apps", handler)
+			router.HandleFunc("/apps/{app}/deployments", handler)
+
+			for i, request := range example.requests {
+				r := httptest.NewRequest(http.MethodGet, request.path, nil)
+				r.RemoteAddr = request.remoteAddr
+				r.Header.Set("X-User", request.user)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r)
+
+				require.Equal(t, request.expectedStatusCode, w.Code, "request %d", i)
+				assert.Equal(t, request.expectedRemaining, w.Header().Get("RateLimit-Remaining"), "request %d", i)
+				if request.expectedStatusCode == http.StatusTooManyRequests {
+					assert.NotEmpty(t, w.Header().Get("Retry-After"))
+					assert.Contains(t, w.Body.String(), "rate limit exceeded")
+				} else {
+					assert.Empty(t, w.Header().Get("Retry-After"))
+				}
+			}
+		})
+	}
+}
+
+func TestNewRateLimitMiddleware_Headers(t *testing.T) {
+	middleware := NewRateLimitMiddleware(RateLimit{Limit: 1, Period: time.Minute})
+	handler := ErrorMiddleware.Apply(middleware.Apply(func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		return nil
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, handler(w, r, map[string]string{}))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "1;w=60", w.Header().Get("RateLimit-Policy"))
+
+	w = httptest.NewRecorder()
+	err := handler(w, r, map[string]string{})
+	var tooManyRequestsError *TooManyRequestsError
+	require.ErrorAs(t, err, &tooManyRequestsError)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+}
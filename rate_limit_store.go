@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimitStoreSweepInterval is the minimum interval between two removals of
+// the expired keys of the memory store
+const rateLimitStoreSweepInterval = time.Minute
+
+type RateLimitAlgorithm int
+
+const (
+	// RateLimitTokenBucket allows bursts of Limit requests, the tokens being
+	// refilled continuously at the rate of Limit per Period
+	RateLimitTokenBucket RateLimitAlgorithm = iota
+	// RateLimitSlidingWindow allows Limit requests over any window of Period. The
+	// count is approximated from the counts of the current and previous fixed
+	// windows.
+	RateLimitSlidingWindow
+)
+
+// RateLimit allows Limit requests per Period. A Limit or a Period lower or
+// equal to 0 disables the rate limiting.
+type RateLimit struct {
+	Limit     int
+	Period    time.Duration
+	Algorithm RateLimitAlgorithm
+}
+
+type RateLimitResult struct {
+	Allowed bool
+	// Remaining is the number of requests which can still be done immediately
+	Remaining int
+	// ResetAfter is the duration after which the quota is fully available again
+	ResetAfter time.Duration
+	// RetryAfter is the duration after which the next request is allowed, it is
+	// only set if the request is not allowed
+	RetryAfter time.Duration
+}
+
+// RateLimitStore stores the state of the rate limits. It can be implemented on
+// top of an external backend to share the limits between several instances of
+// a service.
+type RateLimitStore interface {
+	// Take consumes one request of the quota of the key and returns whether it
+	// is allowed
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+// MemoryRateLimitStore stores the rate limits in memory. The limits are not
+// shared between the instances of a service.
+type MemoryRateLimitStore struct {
+	mutex     sync.Mutex
+	entries   map[string]*rateLimitEntry
+	lastSweep time.Time
+	// now is overridden in tests
+	now func() time.Time
+}
+
+type rateLimitEntry struct {
+	expiresAt time.Time
+
+	// Token bucket state
+	tokens     float64
+	lastRefill time.Time
+
+	// Sliding window state
+	windowStart   time.Time
+	currentCount  int
+	previousCount int
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		entries: map[string]*rateLimitEntry{},
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	now := s.now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sweep(now)
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &rateLimitEntry{
+			tokens:     float64(limit.Limit),
+			lastRefill: now,
+		}
+		s.entries[key] = entry
+	}
+
+	var result RateLimitResult
+	if limit.Algorithm == RateLimitSlidingWindow {
+		result = entry.takeSlidingWindow(now, limit)
+		// The count of the current window is used during the next one
+		entry.expiresAt = entry.windowStart.Add(2 * limit.Period)
+	} else {
+		result = entry.takeTokenBucket(now, limit)
+		entry.expiresAt = now.Add(result.ResetAfter)
+	}
+	return result, nil
+}
+
+// sweep removes the expired entries
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < rateLimitStoreSweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, entry := range s.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+func (e *rateLimitEntry) takeTokenBucket(now time.Time, limit RateLimit) RateLimitResult {
+	capacity := float64(limit.Limit)
+	// Tokens per nanosecond
+	rate := capacity / float64(limit.Period)
+
+	e.tokens = math.Min(capacity, e.tokens+float64(now.Sub(e.lastRefill))*rate)
+	e.lastRefill = now
+
+	result := RateLimitResult{}
+	if e.tokens >= 1 {
+		e.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration(math.Ceil((1 - e.tokens) / rate))
+	}
+	result.Remaining = int(math.Floor(e.tokens))
+	result.ResetAfter = time.Duration(math.Ceil((capacity - e.tokens) / rate))
+	return result
+}
+
+func (e *rateLimitEntry) takeSlidingWindow(now time.Time, limit RateLimit) RateLimitResult {
+	period := limit.Period
+	windowStart := now.Truncate(period)
+	if !windowStart.Equal(e.windowStart) {
+		if windowStart.Sub(e.windowStart) == period {
+			e.previousCount = e.currentCount
+		} else {
+			e.previousCount = 0
+		}
+		e.currentCount = 0
+		e.windowStart = windowStart
+	}
+
+	elapsed := now.Sub(windowStart)
+	windowEnd := period - elapsed
+	// Weight of the previous window in the sliding window ending now
+	weight := 1 - float64(elapsed)/float64(period)
+	count := float64(e.previousCount)*weight + float64(e.currentCount)
+
+	result := RateLimitResult{ResetAfter: windowEnd}
+	if count+1 > float64(limit.Limit) {
+		result.RetryAfter = e.slidingWindowRetryAfter(elapsed, limit)
+		return result
+	}
+
+	e.currentCount++
+	result.Allowed = true
+	result.Remaining = int(math.Floor(float64(limit.Limit) - count - 1))
+	return result
+}
+
+// slidingWindowRetryAfter returns the duration after which the approximated
+// count of the sliding window drops enough to allow one more request
+func (e *rateLimitEntry) slidingWindowRetryAfter(elapsed time.Duration, limit RateLimit) time.Duration {
+	period := float64(limit.Period)
+	allowed := float64(limit.Limit - 1)
+
+	if float64(e.currentCount) > allowed {
+		// The current window is full, wait for the next one in which the current
+		// count becomes the previous count
+		// currentCount × (1 - t/period) ≤ allowed
+		t := period * (1 - allowed/float64(e.currentCount))
+		return limit.Period - elapsed + time.Duration(math.Ceil(t))
+	}
+	// previousCount × (1 - (elapsed+t)/period) + currentCount ≤ allowed
+	t := period*(1-(allowed-float64(e.currentCount))/float64(e.previousCount)) - float64(elapsed)
+	return time.Duration(math.Ceil(math.Max(t, 1)))
+}
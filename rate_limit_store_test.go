@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryRateLimitStore_Take(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("with the token bucket algorithm", func(t *testing.T) {
+		limit := RateLimit{Limit: 3, Period: 3 * time.Second, Algorithm: RateLimitTokenBucket}
+
+		t.Run("it should allow a burst up to the limit", func(t *testing.T) {
+			now := start
+			store := NewMemoryRateLimitStore()
+			store.now = func() time.Time { return now }
+
+			for i := 2; i >= 0; i-- {
+				result, err := store.Take(ctx, "client", limit)
+				require.NoError(t, err)
+				assert.True(t, result.Allowed)
+				assert.Equal(t, i, result.Remaining)
+			}
+			result, err := store.Take(ctx, "client", limit)
+			require.NoError(t, err)
+			assert.False(t, result.Allowed)
+			assert.Equal(t, 0, result.Remaining)
+			assert.Equal(t, time.Second, result.RetryAfter)
+			assert.Equal(t, 3*time.Second, result.ResetAfter)
+
+			// One token is refilled every second
+			now = now.Add(time.Second)
+			result, err = store.Take(ctx, "client", limit)
+			require.NoError(t, err)
+			assert.True(t, result.Allowed)
+			result, err = store.Take(ctx, "client", limit)
+			require.NoError(t, err)
+			assert.False(t, result.Allowed)
+		})
+
+		t.Run("it should count the keys separately", func(t *testing.T) {
+			store := NewMemoryRateLimitStore()
+			for i := 0; i < 3; i++ {
+				_, err := store.Take(ctx, "client-1", limit)
+				require.NoError(t, err)
+			}
+			result, err := store.Take(ctx, "client-2", limit)
+			require.NoError(t, err)
+			assert.True(t, result.Allowed)
+		})
+	})
+
+	t.Run("with the sliding window algorithm", func(t *testing.T) {
+		limit := RateLimit{Limit: 4, Period: time.Minute, Algorithm: RateLimitSlidingWindow}
+
+		t.Run("it should allow the limit over the window", func(t *testing.T) {
+			now := start
+			store := NewMemoryRateLimitStore()
+			store.now = func() time.Time { return now }
+
+			for i := 3; i >= 0; i-- {
+				result, err := store.Take(ctx, "client", limit)
+				require.NoError(t, err)
+				assert.True(t, result.Allowed)
+				assert.Equal(t, i, result.Remaining)
+			}
+
+			now = now.Add(30 * time.Second)
+			result, err := store.Take(ctx, "client", limit)
+			require.NoError(t, err)
+			assert.False(t, result.Allowed)
+			// In the next window, the 4 requests count for 3 after 15 seconds
+			assert.Equal(t, 45*time.Second, result.RetryAfter)
+			assert.Equal(t, 30*time.Second, result.ResetAfter)
+		})
+
+		t.Run("it should weight the previous window", func(t *testing.T) {
+			now := start
+			store := NewMemoryRateLimitStore()
+			store.now = func() time.Time { return now }
+
+			for i := 0; i < 4; i++ {
+				_, err := store.Take(ctx, "client", limit)
+				require.NoError(t, err)
+			}
+
+			// Half of the previous window is in the sliding window: 2 requests
+			now = now.Add(90 * time.Second)
+			for i := 0; i < 2; i++ {
+				result, err := store.Take(ctx, "client", limit)
+				require.NoError(t, err)
+				assert.True(t, result.Allowed)
+			}
+			result, err := store.Take(ctx, "client", limit)
+			require.NoError(t, err)
+			assert.False(t, result.Allowed)
+			// The previous window must count for 1 request
+			assert.Equal(t, 15*time.Second, result.RetryAfter)
+		})
+
+		t.Run("it should reset the count after two windows", func(t *testing.T) {
+			now := start
+			store := NewMemoryRateLimitStore()
+			store.now = func() time.Time { return now }
+
+			for i := 0; i < 4; i++ {
+				_, err := store.Take(ctx, "client", limit)
+				require.NoError(t, err)
+			}
+			now = now.Add(2 * time.Minute)
+			result, err := store.Take(ctx, "client", limit)
+			require.NoError(t, err)
+			assert.True(t, result.Allowed)
+			assert.Equal(t, 3, result.Remaining)
+		})
+	})
+
+	t.Run("it should remove the expired keys", func(t *testing.T) {
+		now := start
+		store := NewMemoryRateLimitStore()
+		store.now = func() time.Time { return now }
+
+		_, err := store.Take(ctx, "client-1", RateLimit{Limit: 10, Period: time.Second})
+		require.NoError(t, err)
+		now = now.Add(2 * time.Minute)
+		_, err = store.Take(ctx, "client-2", RateLimit{Limit: 10, Period: time.Second})
+		require.NoError(t, err)
+
+		assert.NotContains(t, store.entries, "client-1")
+		assert.Contains(t, store.entries, "client-2")
+	})
+}
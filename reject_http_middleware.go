@@ -6,10 +6,11 @@ import (
 	"github.com/Scalingo/go-utils/logger"
 )
 
+// RejectHTTPMiddleware answers 400 with an empty body to plain HTTP requests.
+// NewHTTPSMiddleware provides a configurable alternative.
 var RejectHTTPMiddleware = MiddlewareFunc(func(handler HandlerFunc) HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
-		forwardedProto := r.Header.Get("X-Forwarded-Proto")
-		if forwardedProto != "https" {
+		if clientOrigin(r).Scheme != "https" {
 			w.WriteHeader(400)
 			log := logger.Get(r.Context())
 			log.Info("HTTP request received on HTTPS only endpoint")
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRejectHTTPMiddleware(t *testing.T) {
+	examples := map[string]struct {
+		remoteAddr         string
+		forwardedProto     string
+		expectedStatusCode int
+	}{
+		"it should accept an HTTPS request forwarded by a trusted proxy": {
+			remoteAddr:         "10.0.0.1:1234",
+			forwardedProto:     "https",
+			expectedStatusCode: http.StatusOK,
+		},
+		"it should reject an HTTP request forwarded by a trusted proxy": {
+			remoteAddr:         "10.0.0.1:1234",
+			forwardedProto:     "http",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		"it should not trust X-Forwarded-Proto sent by an untrusted client": {
+			remoteAddr:         "203.0.113.1:1234",
+			forwardedProto:     "https",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = example.remoteAddr
+			r.Header.Set("X-Forwarded-Proto", example.forwardedProto)
+			w := httptest.NewRecorder()
+
+			handler := RejectHTTPMiddleware(func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				return nil
+			})
+			require.NoError(t, handler(w, r, map[string]string{}))
+			assert.Equal(t, example.expectedStatusCode, w.Code)
+		})
+	}
+}
@@ -1,25 +1,213 @@
 package handlers
 
 import (
-	"context"
 	"fmt"
 	"net/http"
+	"regexp"
 
 	"github.com/gofrs/uuid/v5"
+	"github.com/oklog/ulid/v2"
+	"github.com/segmentio/ksuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
+const (
+	requestIDDefaultHeader    = "X-Request-ID"
+	requestIDDefaultMaxLength = 200
+)
+
+// requestIDDefaultFormat accepts the characters found in the usual ID formats
+// (UUID, ULID, KSUID, W3C trace IDs...) and rejects anything which could be
+// used to forge log lines
+var requestIDDefaultFormat = regexp.MustCompile(`^[a-zA-Z0-9._:+=/@-]+$`)
+
+// RequestIDGenerator generates a new request ID
+type RequestIDGenerator func() (string, error)
+
+func UUIDv4RequestIDGenerator() (string, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// UUIDv7RequestIDGenerator generates time ordered UUIDs
+func UUIDv7RequestIDGenerator() (string, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+func ULIDRequestIDGenerator() (string, error) {
+	return ulid.Make().String(), nil
+}
+
+func KSUIDRequestIDGenerator() (string, error) {
+	id, err := ksuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+type requestIDMiddleware struct {
+	// headers are the request headers from which the request ID is read, in
+	// order of preference. The first one is also used to send the request ID
+	// back to the client.
+	headers   []string
+	generator RequestIDGenerator
+	validate  func(id string) bool
+	maxLength int
+	// trusted indicates if the request ID sent by the client is used. It should
+	// be disabled for services directly exposed to untrusted clients.
+	trusted bool
+	// responseHeader indicates if the request ID is set on the response
+	responseHeader bool
+	// fromTraceparent indicates if the trace ID of the W3C traceparent header is
+	// used as request ID when no request ID header is present
+	fromTraceparent bool
+}
+
+type RequestIDMiddlewareOption func(m *requestIDMiddleware)
+
+// WithRequestIDHeaders sets the headers from which the request ID is read, in
+// order of preference ("X-Request-ID" by default). The first header is used to
+// forward the request ID and to send it back to the client.
+func WithRequestIDHeaders(headers ...string) RequestIDMiddlewareOption {
+	return func(m *requestIDMiddleware) {
+		if len(headers) > 0 {
+			m.headers = headers
+		}
+	}
+}
+
+// WithRequestIDGenerator sets the generator of new request IDs (UUIDv4 by
+// default)
+func WithRequestIDGenerator(generator RequestIDGenerator) RequestIDMiddlewareOption {
+	return func(m *requestIDMiddleware) {
+		m.generator = generator
+	}
+}
+
+// WithRequestIDValidation sets the function validating the request ID sent by
+// the client. An invalid request ID is replaced by a new one. By default, only
+// alphanumeric characters and ._:+=/@- are accepted.
+func WithRequestIDValidation(validate func(id string) bool) RequestIDMiddlewareOption {
+	return func(m *requestIDMiddleware) {
+		m.validate = validate
+	}
+}
+
+// WithRequestIDMaxLength sets the maximum length of the request ID sent by the
+// client (200 by default)
+func WithRequestIDMaxLength(maxLength int) RequestIDMiddlewareOption {
+	return func(m *requestIDMiddleware) {
+		m.maxLength = maxLength
+	}
+}
+
+// WithUntrustedRequestID ignores the request ID sent by the client and always
+// generates a new one
+func WithUntrustedRequestID() RequestIDMiddlewareOption {
+	return func(m *requestIDMiddleware) {
+		m.trusted = false
+	}
+}
+
+// WithoutRequestIDResponseHeader does not send the request ID back to the
+// client
+func WithoutRequestIDResponseHeader() RequestIDMiddlewareOption {
+	return func(m *requestIDMiddleware) {
+		m.responseHeader = false
+	}
+}
+
+// WithRequestIDFromTraceparent uses the trace ID of the incoming W3C
+// traceparent header as request ID if the request does not contain any request
+// ID header. It makes the request ID identical across services instrumented
+// with OpenTelemetry.
+func WithRequestIDFromTraceparent() RequestIDMiddlewareOption {
+	return func(m *requestIDMiddleware) {
+		m.fromTraceparent = true
+	}
+}
+
+// NewRequestIDMiddleware initializes a middleware reading the request ID from
+// the request headers, or generating a new one, and storing it in the request
+// context
+func NewRequestIDMiddleware(options ...RequestIDMiddlewareOption) Middleware {
+	m := &requestIDMiddleware{
+		headers:        []string{requestIDDefaultHeader},
+		generator:      UUIDv4RequestIDGenerator,
+		validate:       requestIDDefaultFormat.MatchString,
+		maxLength:      requestIDDefaultMaxLength,
+		trusted:        true,
+		responseHeader: true,
+	}
+	for _, opt := range options {
+		opt(m)
+	}
+	return m
+}
+
+var defaultRequestIDMiddleware = NewRequestIDMiddleware()
+
+// RequestIDMiddleware is the request ID middleware with the default options
 func RequestIDMiddleware(next HandlerFunc) HandlerFunc {
+	return defaultRequestIDMiddleware.Apply(next)
+}
+
+func (m *requestIDMiddleware) Apply(next HandlerFunc) HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
-		id := r.Header.Get("X-Request-ID")
+		id := m.requestID(r)
 		if id == "" {
-			uuid, err := uuid.NewV4()
+			var err error
+			id, err = m.generator()
 			if err != nil {
-				return fmt.Errorf("fail to generate UUID for X-Request-ID: %v", err)
+				return fmt.Errorf("fail to generate request ID: %v", err)
 			}
-			id = uuid.String()
-			r.Header.Set("X-Request-ID", id)
 		}
-		r = r.WithContext(context.WithValue(r.Context(), "request_id", id))
+
+		r.Header.Set(m.headers[0], id)
+		if m.responseHeader {
+			w.Header().Set(m.headers[0], id)
+		}
+		// Link the request ID to the span created by the OpenTelemetry
+		// instrumentation of the router
+		oteltrace.SpanFromContext(r.Context()).SetAttributes(attribute.String("request_id", id))
+		r = r.WithContext(ContextWithRequestID(r.Context(), id))
 		return next(w, r, vars)
 	}
 }
+
+// requestID returns the valid request ID sent by the client, or an empty
+// string if there is none
+func (m *requestIDMiddleware) requestID(r *http.Request) string {
+	if !m.trusted {
+		return ""
+	}
+	for _, header := range m.headers {
+		id := r.Header.Get(header)
+		if id == "" {
+			continue
+		}
+		if len(id) > m.maxLength || (m.validate != nil && !m.validate(id)) {
+			return ""
+		}
+		return id
+	}
+
+	if m.fromTraceparent {
+		ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		spanContext := oteltrace.SpanContextFromContext(ctx)
+		if spanContext.IsRemote() && spanContext.TraceID().IsValid() {
+			return spanContext.TraceID().String()
+		}
+	}
+	return ""
+}
@@ -55,7 +55,7 @@ func TestRequestIDMiddleware(t *testing.T) {
 					assert.Equal(t, expectedUUID, id)
 				}
 				assert.NotEmpty(t, id)
-				ctxValue, ok := r.Context().Value("request_id").(string)
+				ctxValue, ok := RequestIDFromContext(r.Context())
 				require.True(t, ok)
 				assert.Equal(t, id, ctxValue)
 
@@ -68,3 +68,103 @@ func TestRequestIDMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func TestNewRequestIDMiddleware(t *testing.T) {
+	uuidPattern := `^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`
+
+	examples := map[string]struct {
+		options         []RequestIDMiddlewareOption
+		headers         map[string]string
+		expectedID      string
+		expectedPattern string
+		responseHeader  string
+	}{
+		"it should use the X-Request-ID header and set it on the response": {
+			headers:        map[string]string{"X-Request-ID": "my-request-id"},
+			expectedID:     "my-request-id",
+			responseHeader: "X-Request-ID",
+		},
+		"it should regenerate a request ID with invalid characters": {
+			headers:         map[string]string{"X-Request-ID": "id\nlevel=error"},
+			expectedPattern: uuidPattern,
+			responseHeader:  "X-Request-ID",
+		},
+		"it should regenerate a too long request ID": {
+			options:         []RequestIDMiddlewareOption{WithRequestIDMaxLength(8)},
+			headers:         map[string]string{"X-Request-ID": "123456789"},
+			expectedPattern: uuidPattern,
+			responseHeader:  "X-Request-ID",
+		},
+		"it should use a custom validation": {
+			options: []RequestIDMiddlewareOption{WithRequestIDValidation(func(id string) bool {
+				return id == "valid"
+			})},
+			headers:         map[string]string{"X-Request-ID": "invalid"},
+			expectedPattern: uuidPattern,
+			responseHeader:  "X-Request-ID",
+		},
+		"it should read the headers in order of preference": {
+			options:        []RequestIDMiddlewareOption{WithRequestIDHeaders("X-Correlation-ID", "X-Request-ID")},
+			headers:        map[string]string{"X-Request-ID": "request-id"},
+			expectedID:     "request-id",
+			responseHeader: "X-Correlation-ID",
+		},
+		"it should ignore the client request ID if it is not trusted": {
+			options:         []RequestIDMiddlewareOption{WithUntrustedRequestID()},
+			headers:         map[string]string{"X-Request-ID": "my-request-id"},
+			expectedPattern: uuidPattern,
+			responseHeader:  "X-Request-ID",
+		},
+		"it should generate a UUIDv7": {
+			options:         []RequestIDMiddlewareOption{WithRequestIDGenerator(UUIDv7RequestIDGenerator)},
+			expectedPattern: `^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[0-9a-f]{4}-[0-9a-f]{12}$`,
+			responseHeader:  "X-Request-ID",
+		},
+		"it should generate a ULID": {
+			options:         []RequestIDMiddlewareOption{WithRequestIDGenerator(ULIDRequestIDGenerator)},
+			expectedPattern: `^[0-9A-HJKMNP-TV-Z]{26}$`,
+			responseHeader:  "X-Request-ID",
+		},
+		"it should generate a KSUID": {
+			options:         []RequestIDMiddlewareOption{WithRequestIDGenerator(KSUIDRequestIDGenerator)},
+			expectedPattern: `^[0-9a-zA-Z]{27}$`,
+			responseHeader:  "X-Request-ID",
+		},
+		"it should not set the request ID on the response": {
+			options:         []RequestIDMiddlewareOption{WithoutRequestIDResponseHeader()},
+			expectedPattern: uuidPattern,
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range example.headers {
+				req.Header.Set(k, v)
+			}
+
+			var id string
+			handler := NewRequestIDMiddleware(example.options...).Apply(func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				var ok bool
+				id, ok = RequestIDFromContext(r.Context())
+				require.True(t, ok)
+				return nil
+			})
+
+			res := httptest.NewRecorder()
+			require.NoError(t, handler(res, req, map[string]string{}))
+
+			if example.expectedID != "" {
+				assert.Equal(t, example.expectedID, id)
+			}
+			if example.expectedPattern != "" {
+				assert.Regexp(t, example.expectedPattern, id)
+			}
+			if example.responseHeader != "" {
+				assert.Equal(t, id, res.Header().Get(example.responseHeader))
+			} else {
+				assert.Empty(t, res.Header().Get("X-Request-ID"))
+			}
+		})
+	}
+}
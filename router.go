@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"net/http"
 	"os"
 
 	"github.com/gorilla/mux"
@@ -19,6 +20,12 @@ type Router struct {
 	otelServiceName string
 	// otelEnabled indicates if OpenTelemetry instrumentation is enabled (true by default)
 	otelEnabled bool
+	// loggingOptions are the options of the default logging middleware
+	loggingOptions []LoggingMiddlewareOption
+	// requestIDOptions are the options of the default request ID middleware
+	requestIDOptions []RequestIDMiddlewareOption
+	// trustedProxies are the proxies allowed to set the forwarding headers
+	trustedProxies *TrustedProxies
 }
 
 const (
@@ -45,6 +52,29 @@ func WithoutOtelInstrumentation() RouterOption {
 	}
 }
 
+// WithLoggingOptions sets the options of the logging middleware added by default
+func WithLoggingOptions(opts ...LoggingMiddlewareOption) RouterOption {
+	return func(r *Router) {
+		r.loggingOptions = append(r.loggingOptions, opts...)
+	}
+}
+
+// WithRequestIDOptions sets the options of the request ID middleware added by
+// default
+func WithRequestIDOptions(opts ...RequestIDMiddlewareOption) RouterOption {
+	return func(r *Router) {
+		r.requestIDOptions = append(r.requestIDOptions, opts...)
+	}
+}
+
+// WithTrustedProxies sets the proxies allowed to set the forwarding headers used
+// to resolve the client IP and scheme (DefaultTrustedProxies by default)
+func WithTrustedProxies(proxies *TrustedProxies) RouterOption {
+	return func(r *Router) {
+		r.trustedProxies = proxies
+	}
+}
+
 // NewRouter initializes a router. In containers 3 middleware by default, error
 // catching, logging and OpenTelemetry instrumentation
 func NewRouter(logger logrus.FieldLogger, options ...RouterOption) *Router {
@@ -57,14 +87,16 @@ func NewRouter(logger logrus.FieldLogger, options ...RouterOption) *Router {
 		Router:          mux.NewRouter(),
 		otelServiceName: otelServiceName,
 		otelEnabled:     true,
-		middlewares: []Middleware{
-			NewLoggingMiddleware(logger),
-			MiddlewareFunc(RequestIDMiddleware),
-		},
+		trustedProxies:  DefaultTrustedProxies,
 	}
 	for _, opt := range options {
 		opt(r)
 	}
+	r.middlewares = []Middleware{
+		NewLoggingMiddleware(logger, r.loggingOptions...),
+		NewRequestIDMiddleware(r.requestIDOptions...),
+		NewClientOriginMiddleware(r.trustedProxies),
+	}
 	if r.otelEnabled {
 		r.Router.Use(otelmux.Middleware(r.otelServiceName, r.otelOptions...))
 	}
@@ -96,3 +128,17 @@ func (r *Router) Use(m Middleware) {
 	r.middlewares = append([]Middleware(nil), m)
 	r.middlewares = append(r.middlewares, middlewares...)
 }
+
+// currentRoute returns the path template (e.g. /apps/{app_id}) and the name of
+// the route matched by the request. Both are empty if no route matched.
+func currentRoute(r *http.Request) (string, string) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "", ""
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		template = ""
+	}
+	return template, route.GetName()
+}
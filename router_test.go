@@ -6,8 +6,12 @@ import (
 	"testing"
 
 	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
@@ -50,3 +54,55 @@ func TestNewRouter_OtelMiddleware(t *testing.T) {
 	require.NotEmpty(t, metrics.ScopeMetrics)
 	require.NotEmpty(t, metrics.ScopeMetrics[0].Metrics)
 }
+
+func TestNewRouter_TraceCorrelation(t *testing.T) {
+	spanRecorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder))
+	t.Cleanup(func() {
+		_ = tp.Shutdown(t.Context())
+	})
+
+	t.Run("it should link the request ID, the logs and the span", func(t *testing.T) {
+		logger, hook := test.NewNullLogger()
+		router := NewRouter(logger, WithOtelOptions(otelmux.WithTracerProvider(tp)))
+		router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+			return nil
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Request-ID", "my-request-id")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		spans := spanRecorder.Ended()
+		require.NotEmpty(t, spans)
+		span := spans[len(spans)-1]
+		assert.Contains(t, span.Attributes(), attribute.String("request_id", "my-request-id"))
+
+		require.Len(t, hook.Entries, 2)
+		for _, entry := range hook.Entries {
+			assert.Equal(t, "my-request-id", entry.Data["request_id"])
+			assert.Equal(t, span.SpanContext().TraceID().String(), entry.Data["trace_id"])
+			assert.Equal(t, span.SpanContext().SpanID().String(), entry.Data["span_id"])
+		}
+	})
+
+	t.Run("it should use the trace ID of the traceparent header as request ID", func(t *testing.T) {
+		logger, hook := test.NewNullLogger()
+		router := NewRouter(logger,
+			WithOtelOptions(otelmux.WithTracerProvider(tp)),
+			WithRequestIDOptions(WithRequestIDFromTraceparent()),
+		)
+		router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+			return nil
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", res.Header().Get("X-Request-ID"))
+		require.Len(t, hook.Entries, 2)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", hook.Entries[0].Data["request_id"])
+	})
+}
@@ -1,15 +1,296 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 )
 
+// CSPDirective is a directive of a Content-Security-Policy
+type CSPDirective string
+
+const (
+	CSPDefaultSrc              CSPDirective = "default-src"
+	CSPScriptSrc               CSPDirective = "script-src"
+	CSPStyleSrc                CSPDirective = "style-src"
+	CSPImgSrc                  CSPDirective = "img-src"
+	CSPConnectSrc              CSPDirective = "connect-src"
+	CSPFontSrc                 CSPDirective = "font-src"
+	CSPObjectSrc               CSPDirective = "object-src"
+	CSPMediaSrc                CSPDirective = "media-src"
+	CSPFrameSrc                CSPDirective = "frame-src"
+	CSPWorkerSrc               CSPDirective = "worker-src"
+	CSPManifestSrc             CSPDirective = "manifest-src"
+	CSPFrameAncestors          CSPDirective = "frame-ancestors"
+	CSPFormAction              CSPDirective = "form-action"
+	CSPBaseURI                 CSPDirective = "base-uri"
+	CSPReportURI               CSPDirective = "report-uri"
+	CSPReportTo                CSPDirective = "report-to"
+	CSPUpgradeInsecureRequests CSPDirective = "upgrade-insecure-requests"
+)
+
+// Sources of a Content-Security-Policy directive. Hosts and schemes (e.g.
+// https://cdn.example.com, data:) can be used as is.
+const (
+	CSPSelf           = "'self'"
+	CSPNone           = "'none'"
+	CSPUnsafeInline   = "'unsafe-inline'"
+	CSPUnsafeEval     = "'unsafe-eval'"
+	CSPStrictDynamic  = "'strict-dynamic'"
+	CSPReportSample   = "'report-sample'"
+	CSPUnsafeHashes   = "'unsafe-hashes'"
+	CSPWasmUnsafeEval = "'wasm-unsafe-eval'"
+	// CSPNonce is replaced by the nonce generated for each request. The nonce is
+	// available to the handler with CSPNonceFromContext.
+	CSPNonce = "'nonce'"
+)
+
+// ContentSecurityPolicy builds the value of the Content-Security-Policy header.
+// The directives are rendered in the order in which they have been added.
+type ContentSecurityPolicy struct {
+	directives []cspDirective
+}
+
+type cspDirective struct {
+	name    CSPDirective
+	sources []string
+}
+
+func NewContentSecurityPolicy() *ContentSecurityPolicy {
+	return &ContentSecurityPolicy{}
+}
+
+// Add adds sources to a directive. Calling it several times with the same
+// directive appends the sources. Directives without source such as
+// upgrade-insecure-requests are added without any.
+func (p *ContentSecurityPolicy) Add(directive CSPDirective, sources ...string) *ContentSecurityPolicy {
+	for i := range p.directives {
+		if p.directives[i].name == directive {
+			p.directives[i].sources = append(p.directives[i].sources, sources...)
+			return p
+		}
+	}
+	p.directives = append(p.directives, cspDirective{name: directive, sources: sources})
+	return p
+}
+
+func (p *ContentSecurityPolicy) String() string {
+	return p.render("")
+}
+
+func (p *ContentSecurityPolicy) usesNonce() bool {
+	for _, directive := range p.directives {
+		for _, source := range directive.sources {
+			if source == CSPNonce {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// render returns the value of the header, the CSPNonce sources being replaced
+// by the nonce if it is not empty
+func (p *ContentSecurityPolicy) render(nonce string) string {
+	directives := make([]string, 0, len(p.directives))
+	for _, directive := range p.directives {
+		values := []string{string(directive.name)}
+		for _, source := range directive.sources {
+			if source == CSPNonce && nonce != "" {
+				source = "'nonce-" + nonce + "'"
+			}
+			values = append(values, source)
+		}
+		directives = append(directives, strings.Join(values, " "))
+	}
+	return strings.Join(directives, "; ")
+}
+
+// PermissionsPolicy is the value of the Permissions-Policy header. The keys are
+// the features (e.g. camera, geolocation) and the values the allowed origins.
+// "self" and "*" are keywords, the other values are quoted origins. A feature
+// without any origin is disabled.
+type PermissionsPolicy map[string][]string
+
+func (p PermissionsPolicy) String() string {
+	features := make([]string, 0, len(p))
+	for feature := range p {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+
+	directives := make([]string, 0, len(features))
+	for _, feature := range features {
+		value := permissionsPolicyAllowlist(p[feature])
+		directives = append(directives, feature+"="+value)
+	}
+	return strings.Join(directives, ", ")
+}
+
+func permissionsPolicyAllowlist(origins []string) string {
+	values := make([]string, 0, len(origins))
+	for _, origin := range origins {
+		if origin == "*" {
+			// The wildcard allows every origin and is not put inside parentheses
+			return "*"
+		}
+		if origin != "self" {
+			origin = `"` + origin + `"`
+		}
+		values = append(values, origin)
+	}
+	return "(" + strings.Join(values, " ") + ")"
+}
+
+type secureHeadersMiddleware struct {
+	csp           *ContentSecurityPolicy
+	cspReportOnly *ContentSecurityPolicy
+	// headers are the static headers set on every response
+	headers map[string]string
+	// hsts is only sent on HTTPS responses
+	hsts *HSTSPolicy
+}
+
+type SecureHeadersMiddlewareOption func(m *secureHeadersMiddleware)
+
+// WithContentSecurityPolicy replaces the default Content-Security-Policy
+// (frame-ancestors 'none')
+func WithContentSecurityPolicy(policy *ContentSecurityPolicy) SecureHeadersMiddlewareOption {
+	return func(m *secureHeadersMiddleware) {
+		m.csp = policy
+	}
+}
+
+// WithContentSecurityPolicyReportOnly sends a policy in the
+// Content-Security-Policy-Report-Only header. The violations are reported but
+// not blocked by the browsers, which helps to roll out a new policy. It can be
+// used alongside the enforced policy.
+func WithContentSecurityPolicyReportOnly(policy *ContentSecurityPolicy) SecureHeadersMiddlewareOption {
+	return func(m *secureHeadersMiddleware) {
+		m.cspReportOnly = policy
+	}
+}
+
+// WithReferrerPolicy sets the Referrer-Policy header, e.g.
+// strict-origin-when-cross-origin
+func WithReferrerPolicy(policy string) SecureHeadersMiddlewareOption {
+	return withSecureHeader("Referrer-Policy", policy)
+}
+
+// WithPermissionsPolicy sets the Permissions-Policy header
+func WithPermissionsPolicy(policy PermissionsPolicy) SecureHeadersMiddlewareOption {
+	return withSecureHeader("Permissions-Policy", policy.String())
+}
+
+// WithCrossOriginOpenerPolicy sets the Cross-Origin-Opener-Policy header, e.g.
+// same-origin
+func WithCrossOriginOpenerPolicy(policy string) SecureHeadersMiddlewareOption {
+	return withSecureHeader("Cross-Origin-Opener-Policy", policy)
+}
+
+// WithCrossOriginEmbedderPolicy sets the Cross-Origin-Embedder-Policy header,
+// e.g. require-corp
+func WithCrossOriginEmbedderPolicy(policy string) SecureHeadersMiddlewareOption {
+	return withSecureHeader("Cross-Origin-Embedder-Policy", policy)
+}
+
+// WithCrossOriginResourcePolicy sets the Cross-Origin-Resource-Policy header,
+// e.g. same-site
+func WithCrossOriginResourcePolicy(policy string) SecureHeadersMiddlewareOption {
+	return withSecureHeader("Cross-Origin-Resource-Policy", policy)
+}
+
+// WithFrameOptions sets the X-Frame-Options header (DENY by default). An empty
+// value removes it, the frame-ancestors directive of the Content-Security-Policy
+// superseding it in modern browsers.
+func WithFrameOptions(value string) SecureHeadersMiddlewareOption {
+	return withSecureHeader("X-Frame-Options", value)
+}
+
+// WithSecureHeadersHSTS adds the Strict-Transport-Security header to the HTTPS
+// responses
+func WithSecureHeadersHSTS(policy HSTSPolicy) SecureHeadersMiddlewareOption {
+	return func(m *secureHeadersMiddleware) {
+		m.hsts = &policy
+	}
+}
+
+func withSecureHeader(name, value string) SecureHeadersMiddlewareOption {
+	return func(m *secureHeadersMiddleware) {
+		if value == "" {
+			delete(m.headers, name)
+			return
+		}
+		m.headers[name] = value
+	}
+}
+
+// NewSecureHeadersMiddleware initializes a middleware setting the security
+// headers of the responses. Without option, it sets the same headers as
+// SecureHeadersMiddleware.
+func NewSecureHeadersMiddleware(options ...SecureHeadersMiddlewareOption) Middleware {
+	m := &secureHeadersMiddleware{
+		csp: NewContentSecurityPolicy().Add(CSPFrameAncestors, CSPNone),
+		headers: map[string]string{
+			"X-Content-Type-Options": "nosniff",
+			"X-Frame-Options":        "DENY",
+		},
+	}
+	for _, opt := range options {
+		opt(m)
+	}
+	return m
+}
+
+var defaultSecureHeadersMiddleware = NewSecureHeadersMiddleware()
+
+// SecureHeadersMiddleware is the secure headers middleware with the default
+// options
 // Source: https://cheatsheetseries.owasp.org/cheatsheets/REST_Security_Cheat_Sheet.html#security-headers
 func SecureHeadersMiddleware(next HandlerFunc) HandlerFunc {
+	return defaultSecureHeadersMiddleware.Apply(next)
+}
+
+func (m *secureHeadersMiddleware) Apply(next HandlerFunc) HandlerFunc {
+	usesNonce := (m.csp != nil && m.csp.usesNonce()) || (m.cspReportOnly != nil && m.cspReportOnly.usesNonce())
+
 	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
-		w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("X-Frame-Options", "DENY")
+		var nonce string
+		if usesNonce {
+			var err error
+			nonce, err = generateCSPNonce()
+			if err != nil {
+				return fmt.Errorf("fail to generate CSP nonce: %v", err)
+			}
+			r = r.WithContext(ContextWithCSPNonce(r.Context(), nonce))
+		}
+
+		header := w.Header()
+		if m.csp != nil {
+			header.Set("Content-Security-Policy", m.csp.render(nonce))
+		}
+		if m.cspReportOnly != nil {
+			header.Set("Content-Security-Policy-Report-Only", m.cspReportOnly.render(nonce))
+		}
+		for name, value := range m.headers {
+			header.Set(name, value)
+		}
+		if m.hsts != nil && clientOrigin(r).Scheme == "https" {
+			header.Set("Strict-Transport-Security", m.hsts.String())
+		}
 		return next(w, r, vars)
 	}
 }
+
+// generateCSPNonce returns 128 random bits encoded in base64
+func generateCSPNonce() (string, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
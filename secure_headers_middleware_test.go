@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentSecurityPolicy_String(t *testing.T) {
+	examples := map[string]struct {
+		policy   *ContentSecurityPolicy
+		expected string
+	}{
+		"it should render the directives in order": {
+			policy: NewContentSecurityPolicy().
+				Add(CSPDefaultSrc, CSPSelf).
+				Add(CSPImgSrc, CSPSelf, "data:", "https://cdn.example.com").
+				Add(CSPFrameAncestors, CSPNone),
+			expected: "default-src 'self'; img-src 'self' data: https://cdn.example.com; frame-ancestors 'none'",
+		},
+		"it should append the sources of a directive added twice": {
+			policy:   NewContentSecurityPolicy().Add(CSPScriptSrc, CSPSelf).Add(CSPScriptSrc, CSPStrictDynamic),
+			expected: "script-src 'self' 'strict-dynamic'",
+		},
+		"it should render a directive without source": {
+			policy:   NewContentSecurityPolicy().Add(CSPDefaultSrc, CSPSelf).Add(CSPUpgradeInsecureRequests),
+			expected: "default-src 'self'; upgrade-insecure-requests",
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, example.expected, example.policy.String())
+		})
+	}
+}
+
+func TestPermissionsPolicy_String(t *testing.T) {
+	policy := PermissionsPolicy{
+		"geolocation": {"self", "https://maps.example.com"},
+		"camera":      {},
+		"fullscreen":  {"*"},
+	}
+	assert.Equal(t, `camera=(), fullscreen=*, geolocation=(self "https://maps.example.com")`, policy.String())
+}
+
+func TestNewSecureHeadersMiddleware(t *testing.T) {
+	hsts := HSTSPolicy{MaxAge: 365 * 24 * time.Hour}
+
+	examples := map[string]struct {
+		options         []SecureHeadersMiddlewareOption
+		tls             bool
+		expectedHeaders map[string]string
+	}{
+		"it should set the default headers": {
+			expectedHeaders: map[string]string{
+				"Content-Security-Policy": "frame-ancestors 'none'",
+				"X-Content-Type-Options":  "nosniff",
+				"X-Frame-Options":         "DENY",
+			},
+		},
+		"it should set the configured headers": {
+			options: []SecureHeadersMiddlewareOption{
+				WithContentSecurityPolicy(NewContentSecurityPolicy().Add(CSPDefaultSrc, CSPSelf)),
+				WithContentSecurityPolicyReportOnly(NewContentSecurityPolicy().Add(CSPDefaultSrc, CSPNone).Add(CSPReportTo, "csp")),
+				WithReferrerPolicy("strict-origin-when-cross-origin"),
+				WithPermissionsPolicy(PermissionsPolicy{"camera": {}}),
+				WithCrossOriginOpenerPolicy("same-origin"),
+				WithCrossOriginEmbedderPolicy("require-corp"),
+				WithCrossOriginResourcePolicy("same-site"),
+				WithFrameOptions("SAMEORIGIN"),
+			},
+			expectedHeaders: map[string]string{
+				"Content-Security-Policy":             "default-src 'self'",
+				"Content-Security-Policy-Report-Only": "default-src 'none'; report-to csp",
+				"Referrer-Policy":                     "strict-origin-when-cross-origin",
+				"Permissions-Policy":                  "camera=()",
+				"Cross-Origin-Opener-Policy":          "same-origin",
+				"Cross-Origin-Embedder-Policy":        "require-corp",
+				"Cross-Origin-Resource-Policy":        "same-site",
+				"X-Frame-Options":                     "SAMEORIGIN",
+				"X-Content-Type-Options":              "nosniff",
+			},
+		},
+		"it should remove a header configured with an empty value": {
+			options: []SecureHeadersMiddlewareOption{WithFrameOptions("")},
+			expectedHeaders: map[string]string{
+				"X-Frame-Options": "",
+			},
+		},
+		"it should not send the content security policy if it is nil": {
+			options: []SecureHeadersMiddlewareOption{WithContentSecurityPolicy(nil)},
+			expectedHeaders: map[string]string{
+				"Content-Security-Policy": "",
+			},
+		},
+		"it should add the HSTS header to HTTPS responses": {
+			options: []SecureHeadersMiddlewareOption{WithSecureHeadersHSTS(hsts)},
+			tls:     true,
+			expectedHeaders: map[string]string{
+				"Strict-Transport-Security": "max-age=31536000",
+			},
+		},
+		"it should not add the HSTS header to plain HTTP responses": {
+			options: []SecureHeadersMiddlewareOption{WithSecureHeadersHSTS(hsts)},
+			expectedHeaders: map[string]string{
+				"Strict-Transport-Security": "",
+			},
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if example.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			w := httptest.NewRecorder()
+
+			handler := NewSecureHeadersMiddleware(example.options...).Apply(func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				_, ok := CSPNonceFromContext(r.Context())
+				assert.False(t, ok)
+				return nil
+			})
+			require.NoError(t, handler(w, r, map[string]string{}))
+
+			for header, value := range example.expectedHeaders {
+				assert.Equal(t, value, w.Header().Get(header), header)
+			}
+		})
+	}
+}
+
+func TestNewSecureHeadersMiddleware_Nonce(t *testing.T) {
+	middleware := NewSecureHeadersMiddleware(
+		WithContentSecurityPolicy(NewContentSecurityPolicy().Add(CSPScriptSrc, CSPNonce, CSPStrictDynamic)),
+		WithContentSecurityPolicyReportOnly(NewContentSecurityPolicy().Add(CSPStyleSrc, CSPNonce)),
+	)
+
+	var nonces []string
+	for i := 0; i < 2; i++ {
+		var nonce string
+		handler := middleware.Apply(func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+			var ok bool
+			nonce, ok = CSPNonceFromContext(r.Context())
+			assert.True(t, ok)
+			return nil
+		})
+		w := httptest.NewRecorder()
+		require.NoError(t, handler(w, httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{}))
+
+		require.NotEmpty(t, nonce)
+		assert.False(t, strings.ContainsAny(nonce, "' "))
+		assert.Equal(t, "script-src 'nonce-"+nonce+"' 'strict-dynamic'", w.Header().Get("Content-Security-Policy"))
+		assert.Equal(t, "style-src 'nonce-"+nonce+"'", w.Header().Get("Content-Security-Policy-Report-Only"))
+		nonces = append(nonces, nonce)
+	}
+
+	assert.NotEqual(t, nonces[0], nonces[1], "a new nonce must be generated for each request")
+}
+
+func TestSecureHeadersMiddleware(t *testing.T) {
+	w := httptest.NewRecorder()
+	handler := SecureHeadersMiddleware(func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		return nil
+	})
+	require.NoError(t, handler(w, httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{}))
+
+	assert.Equal(t, "frame-ancestors 'none'", w.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "DENY", w.Header().Get("X-Frame-Options"))
+}
@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+	"github.com/Scalingo/go-utils/logger"
+)
+
+const (
+	SecurityReportsPath = "/security-reports"
+
+	securityReportsDefaultMaxBodySize         = 64 * 1024
+	securityReportsDefaultDeduplicationWindow = time.Minute
+	// securityReportsMaxDeduplicationEntries bounds the memory used to
+	// de-duplicate the reports
+	securityReportsMaxDeduplicationEntries = 10000
+	// securityReportMaxFields and securityReportMaxFieldLength bound the size
+	// of the log entries, the reports being sent by untrusted clients
+	securityReportMaxFields      = 32
+	securityReportMaxFieldLength = 1024
+)
+
+// securityReportFieldAliases maps the fields of the legacy CSP reports to the
+// fields of the Reporting API
+var securityReportFieldAliases = map[string]string{
+	"document_uri":  "document_url",
+	"blocked_uri":   "blocked_url",
+	"script_sample": "sample",
+}
+
+// SecurityReportCollector receives the reports sent by the browsers: the
+// legacy CSP violation reports (application/csp-report, sent to the report-uri
+// directive) and the Reporting API reports (application/reports+json, sent to
+// the report-to directive). The reports are logged with the request logger.
+type SecurityReportCollector struct {
+	path                string
+	maxBodySize         int64
+	deduplicationWindow time.Duration
+	logLevel            logrus.Level
+
+	mutex sync.Mutex
+	// seen contains the reports logged during the de-duplication window
+	seen map[string]*seenSecurityReport
+}
+
+type seenSecurityReport struct {
+	expiresAt time.Time
+	// suppressed is the number of identical reports which have not been logged
+	suppressed int
+}
+
+type SecurityReportCollectorOption func(c *SecurityReportCollector)
+
+// WithSecurityReportsPath sets the path on which Register adds the handler
+// (/security-reports by default)
+func WithSecurityReportsPath(path string) SecurityReportCollectorOption {
+	return func(c *SecurityReportCollector) {
+		c.path = path
+	}
+}
+
+// WithSecurityReportsMaxBodySize sets the maximum size of a payload (64 KiB by
+// default)
+func WithSecurityReportsMaxBodySize(size int64) SecurityReportCollectorOption {
+	return func(c *SecurityReportCollector) {
+		c.maxBodySize = size
+	}
+}
+
+// WithSecurityReportsDeduplicationWindow sets the duration during which
+// identical reports are only logged once (1 minute by default). The number of
+// suppressed reports is logged with the next identical report. 0 disables the
+// de-duplication.
+func WithSecurityReportsDeduplicationWindow(window time.Duration) SecurityReportCollectorOption {
+	return func(c *SecurityReportCollector) {
+		c.deduplicationWindow = window
+	}
+}
+
+// WithSecurityReportsLogLevel sets the level of the report logs (warning by
+// default)
+func WithSecurityReportsLogLevel(level logrus.Level) SecurityReportCollectorOption {
+	return func(c *SecurityReportCollector) {
+		c.logLevel = level
+	}
+}
+
+func NewSecurityReportCollector(options ...SecurityReportCollectorOption) *SecurityReportCollector {
+	c := &SecurityReportCollector{
+		path:                SecurityReportsPath,
+		maxBodySize:         securityReportsDefaultMaxBodySize,
+		deduplicationWindow: securityReportsDefaultDeduplicationWindow,
+		logLevel:            logrus.WarnLevel,
+		seen:                map[string]*seenSecurityReport{},
+	}
+	for _, opt := range options {
+		opt(c)
+	}
+	return c
+}
+
+// Register adds the handler of the collector to the router. The reports being
+// sent cross-origin with a non-simple content type, the router must answer the
+// CORS preflight requests if the pages are not served by the same origin.
+func (c *SecurityReportCollector) Register(router *Router) *mux.Route {
+	return router.HandleFunc(c.path, c.Handler).Methods(http.MethodPost)
+}
+
+// Handler answers 204 if the payload contains valid reports, 400 if it is
+// invalid, 413 if it is too large and 415 if its content type is not
+// supported.
+func (c *SecurityReportCollector) Handler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	log := logger.Get(r.Context())
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "application/csp-report" && mediaType != "application/reports+json" && mediaType != "application/json") {
+		log.WithField("content_type", r.Header.Get("Content-Type")).Info("Invalid security report content type")
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return nil
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, c.maxBodySize))
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			log.Info("Security report payload too large")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		log.WithError(err).Info("Fail to read security report payload")
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+
+	var reports []logrus.Fields
+	if mediaType == "application/reports+json" {
+		reports, err = parseReportingAPIReports(body)
+	} else {
+		// Some browsers send the legacy CSP reports as application/json
+		reports, err = parseCSPReport(body, r.UserAgent())
+	}
+	if err != nil {
+		log.WithError(err).Info("Invalid security report payload")
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+
+	for _, report := range reports {
+		suppressed, ok := c.deduplicate(report)
+		if !ok {
+			continue
+		}
+		if suppressed > 0 {
+			report["report_suppressed"] = suppressed
+		}
+		log.WithFields(report).Log(c.logLevel, "Security report received")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// deduplicate returns false if an identical report has been logged during the
+// de-duplication window. Otherwise it returns the number of identical reports
+// suppressed during the previous window.
+func (c *SecurityReportCollector) deduplicate(report logrus.Fields) (int, bool) {
+	if c.deduplicationWindow <= 0 {
+		return 0, true
+	}
+	// fmt prints the maps with sorted keys
+	key := fmt.Sprint(report)
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	seen, ok := c.seen[key]
+	if ok && now.Before(seen.expiresAt) {
+		seen.suppressed++
+		return 0, false
+	}
+	suppressed := 0
+	if ok {
+		suppressed = seen.suppressed
+	}
+
+	if len(c.seen) >= securityReportsMaxDeduplicationEntries {
+		for k, s := range c.seen {
+			if !now.Before(s.expiresAt) {
+				delete(c.seen, k)
+			}
+		}
+		if len(c.seen) >= securityReportsMaxDeduplicationEntries {
+			// Too many distinct reports, start over rather than growing unbounded
+			c.seen = map[string]*seenSecurityReport{}
+		}
+	}
+	c.seen[key] = &seenSecurityReport{expiresAt: now.Add(c.deduplicationWindow)}
+	return suppressed, true
+}
+
+// parseCSPReport parses a legacy report sent to the report-uri directive:
+// {"csp-report": {"document-uri": "...", "violated-directive": "...", ...}}
+func parseCSPReport(body []byte, userAgent string) ([]logrus.Fields, error) {
+	var payload struct {
+		Report map[string]interface{} `json:"csp-report"`
+	}
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if len(payload.Report) == 0 {
+		return nil, fmt.Errorf("missing csp-report")
+	}
+
+	fields := securityReportFields(payload.Report)
+	fields["report_type"] = "csp-violation"
+	fields["report_user_agent"] = truncateSecurityReportValue(userAgent)
+	return []logrus.Fields{fields}, nil
+}
+
+// parseReportingAPIReports parses the reports sent by the Reporting API:
+// [{"type": "csp-violation", "url": "...", "user_agent": "...", "body": {...}}]
+func parseReportingAPIReports(body []byte) ([]logrus.Fields, error) {
+	var payload []struct {
+		Type      string                 `json:"type"`
+		URL       string                 `json:"url"`
+		UserAgent string                 `json:"user_agent"`
+		Body      map[string]interface{} `json:"body"`
+	}
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	reports := make([]logrus.Fields, 0, len(payload))
+	for _, report := range payload {
+		if report.Type == "" || report.Body == nil {
+			continue
+		}
+		fields := securityReportFields(report.Body)
+		fields["report_type"] = truncateSecurityReportValue(report.Type)
+		fields["report_url"] = truncateSecurityReportValue(report.URL)
+		fields["report_user_agent"] = truncateSecurityReportValue(report.UserAgent)
+		reports = append(reports, fields)
+	}
+	if len(reports) == 0 {
+		return nil, fmt.Errorf("no valid report")
+	}
+	return reports, nil
+}
+
+// securityReportFields converts the body of a report to log fields. The keys
+// are prefixed to prevent a client from overriding the fields of the request
+// logger, and converted to snake case (documentURL and document-uri both
+// become report_document_url).
+func securityReportFields(body map[string]interface{}) logrus.Fields {
+	fields := logrus.Fields{}
+	for key, value := range body {
+		if len(fields) >= securityReportMaxFields {
+			break
+		}
+		key = securityReportFieldName(key)
+		if key == "" {
+			continue
+		}
+		if alias, ok := securityReportFieldAliases[key]; ok {
+			key = alias
+		}
+		switch v := value.(type) {
+		case string:
+			value = truncateSecurityReportValue(v)
+		case float64, bool, nil:
+		default:
+			encoded, _ := json.Marshal(v)
+			value = truncateSecurityReportValue(string(encoded))
+		}
+		fields["report_"+key] = value
+	}
+	return fields
+}
+
+// securityReportFieldName converts camelCase and kebab-case keys to snake case
+// and drops any other character
+func securityReportFieldName(key string) string {
+	if len(key) > 64 {
+		return ""
+	}
+	var name strings.Builder
+	for i, c := range key {
+		switch {
+		case unicode.IsUpper(c) && c < unicode.MaxASCII:
+			if i > 0 && !unicode.IsUpper(rune(key[i-1])) {
+				name.WriteRune('_')
+			}
+			name.WriteRune(unicode.ToLower(c))
+		case (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9'):
+			name.WriteRune(c)
+		case c == '-' || c == '_':
+			name.WriteRune('_')
+		}
+	}
+	return name.String()
+}
+
+// truncateSecurityReportValue truncates value on a rune boundary, so that the
+// logged value remains valid UTF-8
+func truncateSecurityReportValue(value string) string {
+	if len(value) <= securityReportMaxFieldLength {
+		return value
+	}
+	end := securityReportMaxFieldLength
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end]
+}
@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	cspReportPayload = `{"csp-report": {
+		"document-uri": "https://example.dev/apps",
+		"referrer": "",
+		"violated-directive": "script-src-elem",
+		"effective-directive": "script-src-elem",
+		"original-policy": "script-src 'self'",
+		"disposition": "enforce",
+		"blocked-uri": "https://evil.example.com/script.js",
+		"line-number": 12,
+		"status-code": 200
+	}}`
+	reportingAPIPayload = `[{
+		"type": "csp-violation",
+		"age": 10,
+		"url": "https://example.dev/apps",
+		"user_agent": "Mozilla/5.0",
+		"body": {
+			"documentURL": "https://example.dev/apps",
+			"blockedURL": "inline",
+			"effectiveDirective": "style-src-elem",
+			"disposition": "report",
+			"lineNumber": 3
+		}
+	}, {
+		"type": "deprecation",
+		"url": "https://example.dev/apps",
+		"user_agent": "Mozilla/5.0",
+		"body": {"id": "WebSQL", "message": "WebSQL is deprecated"}
+	}]`
+)
+
+func TestSecurityReportCollector_Handler(t *testing.T) {
+	examples := map[string]struct {
+		options            []SecurityReportCollectorOption
+		contentType        string
+		body               string
+		expectedStatusCode int
+		expectedReports    []logrus.Fields
+	}{
+		"it should log a legacy CSP report": {
+			contentType:        "application/csp-report",
+			body:               cspReportPayload,
+			expectedStatusCode: http.StatusNoContent,
+			expectedReports: []logrus.Fields{{
+				"report_type":                "csp-violation",
+				"report_user_agent":          "Mozilla/5.0",
+				"report_document_url":        "https://example.dev/apps",
+				"report_referrer":            "",
+				"report_violated_directive":  "script-src-elem",
+				"report_effective_directive": "script-src-elem",
+				"report_original_policy":     "script-src 'self'",
+				"report_disposition":         "enforce",
+				"report_blocked_url":         "https://evil.example.com/script.js",
+				"report_line_number":         float64(12),
+				"report_status_code":         float64(200),
+			}},
+		},
+		"it should accept a legacy CSP report sent as JSON": {
+			contentType:        "application/json; charset=utf-8",
+			body:               `{"csp-report": {"document-uri": "https://example.dev"}}`,
+			expectedStatusCode: http.StatusNoContent,
+			expectedReports: []logrus.Fields{{
+				"report_type":         "csp-violation",
+				"report_user_agent":   "Mozilla/5.0",
+				"report_document_url": "https://example.dev",
+			}},
+		},
+		"it should log the Reporting API reports": {
+			contentType:        "application/reports+json",
+			body:               reportingAPIPayload,
+			expectedStatusCode: http.StatusNoContent,
+			expectedReports: []logrus.Fields{{
+				"report_type":                "csp-violation",
+				"report_url":                 "https://example.dev/apps",
+				"report_user_agent":          "Mozilla/5.0",
+				"report_document_url":        "https://example.dev/apps",
+				"report_blocked_url":         "inline",
+				"report_effective_directive": "style-src-elem",
+				"report_disposition":         "report",
+				"report_line_number":         float64(3),
+			}, {
+				"report_type":       "deprecation",
+				"report_url":        "https://example.dev/apps",
+				"report_user_agent": "Mozilla/5.0",
+				"report_id":         "WebSQL",
+				"report_message":    "WebSQL is deprecated",
+			}},
+		},
+		"it should prefix the fields so that they cannot override the request fields": {
+			contentType:        "application/reports+json",
+			body:               `[{"type": "intervention", "body": {"request_id": "forged", "nested": {"a": 1}}}]`,
+			expectedStatusCode: http.StatusNoContent,
+			expectedReports: []logrus.Fields{{
+				"report_type":       "intervention",
+				"report_url":        "",
+				"report_user_agent": "",
+				"report_request_id": "forged",
+				"report_nested":     `{"a":1}`,
+			}},
+		},
+		"it should reject an unsupported content type": {
+			contentType:        "text/plain",
+			body:               cspReportPayload,
+			expectedStatusCode: http.StatusUnsupportedMediaType,
+		},
+		"it should reject an invalid JSON payload": {
+			contentType:        "application/csp-report",
+			body:               `{"csp-report":`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		"it should reject a legacy payload without report": {
+			contentType:        "application/csp-report",
+			body:               `{"document-uri": "https://example.dev"}`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		"it should reject a Reporting API payload without valid report": {
+			contentType:        "application/reports+json",
+			body:               `[{"type": "csp-violation"}]`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		"it should reject a payload which is too large": {
+			options:            []SecurityReportCollectorOption{WithSecurityReportsMaxBodySize(16)},
+			contentType:        "application/csp-report",
+			body:               cspReportPayload,
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			log, hook := test.NewNullLogger()
+			collector := NewSecurityReportCollector(example.options...)
+
+			r := httptest.NewRequest(http.MethodPost, SecurityReportsPath, strings.NewReader(example.body))
+			r.Header.Set("Content-Type", example.contentType)
+			r.Header.Set("User-Agent", "Mozilla/5.0")
+			r = r.WithContext(ContextWithLogger(context.Background(), log))
+			w := httptest.NewRecorder()
+
+			err := collector.Handler(w, r, map[string]string{})
+			require.NoError(t, err)
+			assert.Equal(t, example.expectedStatusCode, w.Code)
+
+			var reports []logrus.Fields
+			for _, entry := range hook.AllEntries() {
+				if entry.Message == "Security report received" {
+					assert.Equal(t, logrus.WarnLevel, entry.Level)
+					reports = append(reports, entry.Data)
+				}
+			}
+			assert.Equal(t, example.expectedReports, reports)
+		})
+	}
+}
+
+func TestSecurityReportCollector_Deduplication(t *testing.T) {
+	send := func(collector *SecurityReportCollector, log logrus.FieldLogger) {
+		r := httptest.NewRequest(http.MethodPost, SecurityReportsPath, strings.NewReader(cspReportPayload))
+		r.Header.Set("Content-Type", "application/csp-report")
+		r = r.WithContext(ContextWithLogger(context.Background(), log))
+		w := httptest.NewRecorder()
+		require.NoError(t, collector.Handler(w, r, map[string]string{}))
+		require.Equal(t, http.StatusNoContent, w.Code)
+	}
+
+	t.Run("it should log identical reports once during the window", func(t *testing.T) {
+		log, hook := test.NewNullLogger()
+		collector := NewSecurityReportCollector()
+
+		for i := 0; i < 5; i++ {
+			send(collector, log)
+		}
+		assert.Len(t, hook.AllEntries(), 1)
+	})
+
+	t.Run("it should log the number of suppressed reports once the window expired", func(t *testing.T) {
+		log, hook := test.NewNullLogger()
+		collector := NewSecurityReportCollector()
+
+		for i := 0; i < 3; i++ {
+			send(collector, log)
+		}
+		for _, seen := range collector.seen {
+			seen.expiresAt = seen.expiresAt.Add(-securityReportsDefaultDeduplicationWindow)
+		}
+		send(collector, log)
+
+		require.Len(t, hook.AllEntries(), 2)
+		assert.NotContains(t, hook.AllEntries()[0].Data, "report_suppressed")
+		assert.Equal(t, 2, hook.LastEntry().Data["report_suppressed"])
+	})
+
+	t.Run("it should log every report if the de-duplication is disabled", func(t *testing.T) {
+		log, hook := test.NewNullLogger()
+		collector := NewSecurityReportCollector(WithSecurityReportsDeduplicationWindow(0))
+
+		for i := 0; i < 3; i++ {
+			send(collector, log)
+		}
+		assert.Len(t, hook.AllEntries(), 3)
+	})
+}
+
+func TestSecurityReportCollector_LogLevel(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	log.SetLevel(logrus.TraceLevel)
+	collector := NewSecurityReportCollector(WithSecurityReportsLogLevel(logrus.TraceLevel))
+
+	r := httptest.NewRequest(http.MethodPost, SecurityReportsPath, strings.NewReader(cspReportPayload))
+	r.Header.Set("Content-Type", "application/csp-report")
+	r = r.WithContext(ContextWithLogger(context.Background(), log))
+	w := httptest.NewRecorder()
+	require.NoError(t, collector.Handler(w, r, map[string]string{}))
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	require.NotNil(t, hook.LastEntry())
+	assert.Equal(t, "Security report received", hook.LastEntry().Message)
+	assert.Equal(t, logrus.TraceLevel, hook.LastEntry().Level)
+}
+
+func TestSecurityReportCollector_Register(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	router := NewRouter(log, WithoutOtelInstrumentation())
+	NewSecurityReportCollector(WithSecurityReportsPath("/reports")).Register(router)
+
+	r := httptest.NewRequest(http.MethodPost, "/reports", strings.NewReader(cspReportPayload))
+	r.Header.Set("Content-Type", "application/csp-report")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	var found bool
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Security report received" {
+			found = true
+			// The report is logged with the request logger
+			assert.NotEmpty(t, entry.Data["request_id"])
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestTruncateSecurityReportValue(t *testing.T) {
+	t.Run("it should keep a short value", func(t *testing.T) {
+		assert.Equal(t, "inline", truncateSecurityReportValue("inline"))
+	})
+
+	t.Run("it should truncate a long value on a rune boundary", func(t *testing.T) {
+		// "é" is 2 bytes long, the limit falls in the middle of the last one
+		value := strings.Repeat("a", securityReportMaxFieldLength-1) + "éé"
+		truncated := truncateSecurityReportValue(value)
+		assert.True(t, utf8.ValidString(truncated))
+		assert.Equal(t, strings.Repeat("a", securityReportMaxFieldLength-1), truncated)
+	})
+}
@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+	"github.com/Scalingo/go-utils/logger"
+)
+
+const (
+	serverDefaultName              = "http"
+	serverDefaultAddress           = ":8080"
+	serverDefaultReadHeaderTimeout = 10 * time.Second
+	serverDefaultReadTimeout       = 30 * time.Second
+	// The write timeout must leave enough room for long running endpoints such
+	// as the pprof CPU profile (30 seconds by default)
+	serverDefaultWriteTimeout    = 60 * time.Second
+	serverDefaultIdleTimeout     = 120 * time.Second
+	serverDefaultShutdownTimeout = 30 * time.Second
+)
+
+// Server runs an HTTP server around a Router and takes care of the listener
+// setup, the signal handling and the graceful shutdown.
+type Server struct {
+	// name identifies the server in the logs, it is useful when several servers
+	// run in the same process
+	name    string
+	handler http.Handler
+	network string
+	address string
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	// drainPeriod is the time during which the server keeps serving requests
+	// after a shutdown has been requested, to let load balancers stop routing
+	// traffic to it
+	drainPeriod time.Duration
+	// shutdownTimeout is the maximum time given to in-flight requests to
+	// complete once the server stopped accepting new connections
+	shutdownTimeout time.Duration
+	signals         []os.Signal
+	onShutdown      []func()
+
+	listenerMutex sync.Mutex
+	listener      net.Listener
+}
+
+type ServerOption func(s *Server)
+
+// WithServerName sets the name identifying the server in the logs ("http" by
+// default)
+func WithServerName(name string) ServerOption {
+	return func(s *Server) {
+		s.name = name
+	}
+}
+
+// WithAddress sets the TCP address the server listens on (":8080" by default)
+func WithAddress(address string) ServerOption {
+	return func(s *Server) {
+		s.network = "tcp"
+		s.address = address
+	}
+}
+
+// WithUnixSocket makes the server listen on the Unix socket located at path
+func WithUnixSocket(path string) ServerOption {
+	return func(s *Server) {
+		s.network = "unix"
+		s.address = path
+	}
+}
+
+// WithListener makes the server use an already opened listener. It is mostly
+// useful in tests to listen on an ephemeral port.
+func WithListener(listener net.Listener) ServerOption {
+	return func(s *Server) {
+		s.listener = listener
+	}
+}
+
+func WithReadHeaderTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.readHeaderTimeout = timeout
+	}
+}
+
+func WithReadTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.readTimeout = timeout
+	}
+}
+
+func WithWriteTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.writeTimeout = timeout
+	}
+}
+
+func WithIdleTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.idleTimeout = timeout
+	}
+}
+
+// WithDrainPeriod sets the time during which the server keeps serving requests
+// after a shutdown has been requested. No drain period by default.
+func WithDrainPeriod(period time.Duration) ServerOption {
+	return func(s *Server) {
+		s.drainPeriod = period
+	}
+}
+
+// WithShutdownTimeout sets the maximum time given to in-flight requests to
+// complete during the shutdown (30 seconds by default)
+func WithShutdownTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.shutdownTimeout = timeout
+	}
+}
+
+// WithShutdownSignals overrides the signals triggering the graceful shutdown
+// (SIGTERM and SIGINT by default). Without any signal, only the cancellation of
+// the context given to Run stops the server.
+func WithShutdownSignals(signals ...os.Signal) ServerOption {
+	return func(s *Server) {
+		s.signals = signals
+	}
+}
+
+// WithOnShutdown registers a function called as soon as the shutdown starts,
+// before the drain period
+func WithOnShutdown(f func()) ServerOption {
+	return func(s *Server) {
+		s.onShutdown = append(s.onShutdown, f)
+	}
+}
+
+// NewServer initializes a server serving the given router
+func NewServer(router *Router, options ...ServerOption) *Server {
+	s := &Server{
+		name:              serverDefaultName,
+		handler:           router,
+		network:           "tcp",
+		address:           serverDefaultAddress,
+		readHeaderTimeout: serverDefaultReadHeaderTimeout,
+		readTimeout:       serverDefaultReadTimeout,
+		writeTimeout:      serverDefaultWriteTimeout,
+		idleTimeout:       serverDefaultIdleTimeout,
+		shutdownTimeout:   serverDefaultShutdownTimeout,
+		signals:           []os.Signal{syscall.SIGTERM, os.Interrupt},
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+	return s
+}
+
+// Addr returns the address the server is listening on, or nil if the server is
+// not listening yet
+func (s *Server) Addr() net.Addr {
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Listen opens the listener of the server if it is not already opened. It is
+// called by Run, calling it beforehand lets the caller know the listening
+// address before the server starts.
+func (s *Server) Listen(ctx context.Context) error {
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+	if s.listener != nil {
+		return nil
+	}
+
+	if s.network == "unix" {
+		// A socket file left by a previous process would prevent us to listen
+		err := os.Remove(s.address)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(ctx, err, "remove existing unix socket %s", s.address)
+		}
+	}
+
+	listener, err := net.Listen(s.network, s.address)
+	if err != nil {
+		return errors.Wrapf(ctx, err, "listen on %s %s", s.network, s.address)
+	}
+	s.listener = listener
+	return nil
+}
+
+// Run serves the requests until the context is canceled or one of the shutdown
+// signals is received. It then gracefully shuts the server down and returns
+// once the shutdown completed.
+func (s *Server) Run(ctx context.Context) error {
+	log := logger.Get(ctx).WithField("server", s.name)
+
+	err := s.Listen(ctx)
+	if err != nil {
+		return errors.Wrap(ctx, err, "start server")
+	}
+	addr := s.Addr()
+
+	httpServer := &http.Server{
+		Handler:           s.handler,
+		ReadHeaderTimeout: s.readHeaderTimeout,
+		ReadTimeout:       s.readTimeout,
+		WriteTimeout:      s.writeTimeout,
+		IdleTimeout:       s.idleTimeout,
+	}
+
+	stopCtx := ctx
+	if len(s.signals) > 0 {
+		var stop context.CancelFunc
+		stopCtx, stop = signal.NotifyContext(ctx, s.signals...)
+		defer stop()
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.WithField("address", addr.String()).Info("Starting HTTP server")
+		serveErr <- httpServer.Serve(s.listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return errors.Wrapf(ctx, err, "serve on %s", addr)
+	case <-stopCtx.Done():
+	}
+
+	log.Info("Shutting down HTTP server")
+	for _, f := range s.onShutdown {
+		f()
+	}
+
+	if s.drainPeriod > 0 {
+		log.WithField("drain_period", s.drainPeriod.String()).Info("Draining HTTP server")
+		time.Sleep(s.drainPeriod)
+	}
+
+	// The parent context is most probably canceled at this point, the shutdown
+	// must not inherit of its cancellation
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.shutdownTimeout)
+	defer cancel()
+	err = httpServer.Shutdown(shutdownCtx)
+	if err != nil {
+		_ = httpServer.Close()
+		return errors.Wrap(ctx, err, "shutdown HTTP server")
+	}
+
+	err = <-serveErr
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return errors.Wrapf(ctx, err, "serve on %s", addr)
+	}
+
+	log.Info("HTTP server stopped")
+	return nil
+}
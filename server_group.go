@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+)
+
+// ServerGroup runs several servers with a shared lifecycle. It is typically
+// used to serve the application router on the public address and the
+// profiling, health or metrics routers on private addresses.
+type ServerGroup struct {
+	servers []*Server
+}
+
+// NewServerGroup initializes a group with the given servers. Nil servers are
+// ignored so that optional servers (e.g. the one returned by
+// NewProfilingServer) can be given without any check.
+func NewServerGroup(servers ...*Server) *ServerGroup {
+	g := &ServerGroup{}
+	for _, server := range servers {
+		g.Add(server)
+	}
+	return g
+}
+
+// Add adds a server to the group. It must be called before Run.
+func (g *ServerGroup) Add(server *Server) {
+	if server == nil {
+		return
+	}
+	g.servers = append(g.servers, server)
+}
+
+// Run starts all the servers of the group. The servers are all listening before
+// any of them starts serving requests, hence a server failing to listen
+// prevents the whole group from starting. As soon as one of the servers stops,
+// because of an error, a signal or the cancellation of the context, all the
+// other servers are gracefully shut down. Run returns once all the servers are
+// stopped.
+func (g *ServerGroup) Run(ctx context.Context) error {
+	addresses := map[string]string{}
+	for _, server := range g.servers {
+		// Serving two routers on the same address would for instance expose the
+		// profiling endpoints on the public port
+		if server.listener == nil {
+			key := server.network + ":" + server.address
+			if name, ok := addresses[key]; ok {
+				return errors.Newf(ctx, "servers %s and %s are configured with the same address %s", name, server.name, server.address)
+			}
+			addresses[key] = server.name
+		}
+	}
+
+	for _, server := range g.servers {
+		err := server.Listen(ctx)
+		if err != nil {
+			g.closeListeners()
+			return errors.Wrapf(ctx, err, "start server %s", server.name)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(g.servers))
+	for i, server := range g.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+			err := server.Run(ctx)
+			if err != nil {
+				errs[i] = errors.Wrapf(ctx, err, "run server %s", server.name)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func (g *ServerGroup) closeListeners() {
+	for _, server := range g.servers {
+		server.listenerMutex.Lock()
+		if server.listener != nil {
+			_ = server.listener.Close()
+			server.listener = nil
+		}
+		server.listenerMutex.Unlock()
+	}
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerGroup_Run(t *testing.T) {
+	t.Run("it should serve all the servers until the context is canceled", func(t *testing.T) {
+		public := NewServer(newTestServerRouter(), WithServerName("public"), WithAddress("127.0.0.1:0"), WithShutdownSignals())
+		private := NewServer(newTestServerRouter(), WithServerName("private"), WithAddress("127.0.0.1:0"), WithShutdownSignals())
+		require.NoError(t, public.Listen(context.Background()))
+		require.NoError(t, private.Listen(context.Background()))
+
+		group := NewServerGroup(public, nil, private)
+		ctx, cancel := context.WithCancel(context.Background())
+		runErr := make(chan error, 1)
+		go func() {
+			runErr <- group.Run(ctx)
+		}()
+
+		for _, server := range []*Server{public, private} {
+			res, err := http.Get("http://" + server.Addr().String() + "/")
+			require.NoError(t, err)
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.Equal(t, "hello", string(body))
+		}
+
+		cancel()
+		require.NoError(t, <-runErr)
+	})
+
+	t.Run("it should not start any server if one of them fails to listen", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+
+		public := NewServer(newTestServerRouter(), WithServerName("public"), WithAddress("127.0.0.1:0"), WithShutdownSignals())
+		private := NewServer(newTestServerRouter(), WithServerName("private"), WithAddress(listener.Addr().String()), WithShutdownSignals())
+
+		err = NewServerGroup(public, private).Run(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "start server private")
+		assert.Nil(t, public.Addr())
+	})
+
+	t.Run("it should refuse to serve two servers on the same address", func(t *testing.T) {
+		public := NewServer(newTestServerRouter(), WithServerName("public"), WithAddress(":8080"))
+		profiling := NewServer(newTestServerRouter(), WithServerName("profiling"), WithAddress(":8080"))
+
+		err := NewServerGroup(public, profiling).Run(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "servers public and profiling are configured with the same address :8080")
+	})
+
+	t.Run("it should stop all the servers if one of them fails", func(t *testing.T) {
+		failingListener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		public := NewServer(newTestServerRouter(), WithServerName("public"), WithAddress("127.0.0.1:0"), WithShutdownSignals())
+		failing := NewServer(newTestServerRouter(), WithServerName("failing"), WithListener(failingListener), WithShutdownSignals())
+		// Serving on a closed listener makes the server fail right away
+		failingListener.Close()
+
+		err = NewServerGroup(public, failing).Run(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "run server failing")
+	})
+}
+
+func TestNewProfilingServer(t *testing.T) {
+	t.Run("it should not return any server if profiling is not activable", func(t *testing.T) {
+		t.Setenv("PPROF_ENABLED", "false")
+
+		server, err := NewProfilingServer(context.Background())
+		require.NoError(t, err)
+		assert.Nil(t, server)
+	})
+
+	t.Run("it should serve the profiling router on the PPROF_ADDRESS address", func(t *testing.T) {
+		t.Setenv("PPROF_ENABLED", "true")
+		t.Setenv("PPROF_USERNAME", username)
+		t.Setenv("PPROF_PASSWORD", password)
+		t.Setenv("PPROF_ADDRESS", "127.0.0.1:0")
+
+		server, err := NewProfilingServer(createLog(), WithShutdownSignals())
+		require.NoError(t, err)
+		require.NotNil(t, server)
+		assert.Equal(t, "profiling", server.name)
+		require.NoError(t, server.Listen(context.Background()))
+
+		ctx, cancel := context.WithCancel(createLog())
+		runErr := make(chan error, 1)
+		go func() {
+			runErr <- server.Run(ctx)
+		}()
+
+		req, err := http.NewRequest(http.MethodGet, "http://"+server.Addr().String()+PprofRoutePrefix+"/cmdline", nil)
+		require.NoError(t, err)
+		res, err := http.DefaultClient.Do(addAuthorization(req))
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		cancel()
+		require.NoError(t, <-runErr)
+	})
+}
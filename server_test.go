@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServerRouter() *Router {
+	router := NewRouter(logrus.New(), WithoutOtelInstrumentation())
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		_, _ = io.WriteString(w, "hello")
+		return nil
+	})
+	router.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = io.WriteString(w, "slow")
+		return nil
+	})
+	return router
+}
+
+func TestServer_Run(t *testing.T) {
+	t.Run("it should serve requests until the context is canceled", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		server := NewServer(newTestServerRouter(), WithListener(listener), WithShutdownSignals())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		runErr := make(chan error, 1)
+		go func() {
+			runErr <- server.Run(ctx)
+		}()
+
+		res, err := http.Get("http://" + server.Addr().String() + "/")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "hello", string(body))
+
+		cancel()
+		require.NoError(t, <-runErr)
+
+		_, err = http.Get("http://" + listener.Addr().String() + "/")
+		assert.Error(t, err)
+	})
+
+	t.Run("it should let in-flight requests complete during the shutdown", func(t *testing.T) {
+		server := NewServer(newTestServerRouter(), WithAddress("127.0.0.1:0"), WithShutdownSignals())
+		require.NoError(t, server.Listen(context.Background()))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		runErr := make(chan error, 1)
+		go func() {
+			runErr <- server.Run(ctx)
+		}()
+
+		resCh := make(chan *http.Response, 1)
+		go func() {
+			res, err := http.Get("http://" + server.Addr().String() + "/slow")
+			assert.NoError(t, err)
+			resCh <- res
+		}()
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+
+		res := <-resCh
+		require.NotNil(t, res)
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, "slow", string(body))
+		require.NoError(t, <-runErr)
+	})
+
+	t.Run("it should return an error if in-flight requests exceed the shutdown timeout", func(t *testing.T) {
+		server := NewServer(newTestServerRouter(),
+			WithAddress("127.0.0.1:0"), WithShutdownSignals(), WithShutdownTimeout(10*time.Millisecond),
+		)
+		require.NoError(t, server.Listen(context.Background()))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		runErr := make(chan error, 1)
+		go func() {
+			runErr <- server.Run(ctx)
+		}()
+
+		go func() {
+			res, err := http.Get("http://" + server.Addr().String() + "/slow")
+			if err == nil {
+				res.Body.Close()
+			}
+		}()
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+
+		err := <-runErr
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "shutdown HTTP server")
+	})
+
+	t.Run("it should call the shutdown hooks", func(t *testing.T) {
+		called := false
+		server := NewServer(newTestServerRouter(),
+			WithAddress("127.0.0.1:0"), WithShutdownSignals(), WithOnShutdown(func() { called = true }),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.NoError(t, server.Run(ctx))
+		assert.True(t, called)
+	})
+
+	t.Run("it should listen on a unix socket", func(t *testing.T) {
+		socketPath := filepath.Join(t.TempDir(), "server.sock")
+		server := NewServer(newTestServerRouter(), WithUnixSocket(socketPath), WithShutdownSignals())
+		require.NoError(t, server.Listen(context.Background()))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		runErr := make(chan error, 1)
+		go func() {
+			runErr <- server.Run(ctx)
+		}()
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+				},
+			},
+		}
+		res, err := client.Get("http://unix/")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, "hello", string(body))
+
+		cancel()
+		require.NoError(t, <-runErr)
+	})
+
+	t.Run("it should return an error if the address is not available", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+
+		server := NewServer(newTestServerRouter(), WithAddress(listener.Addr().String()), WithShutdownSignals())
+		err = server.Run(context.Background())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "listen on tcp")
+	})
+}
@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Scalingo/go-utils/errors/v3"
+	"github.com/Scalingo/go-utils/logger"
+)
+
+type timeoutMiddleware struct {
+	timeout time.Duration
+	// routeTimeouts are the timeouts of specific routes, by path template or
+	// route name
+	routeTimeouts map[string]time.Duration
+	statusCode    int
+	// clientTimeoutHeader is the header in which the client sends its timeout,
+	// capped to maxClientTimeout
+	clientTimeoutHeader string
+	maxClientTimeout    time.Duration
+}
+
+type TimeoutMiddlewareOption func(m *timeoutMiddleware)
+
+// WithRouteTimeout sets the timeout of a route, identified by its path template
+// (e.g. /apps/{app_id}/deployments) or its name. 0 disables the timeout of the
+// route.
+func WithRouteTimeout(route string, timeout time.Duration) TimeoutMiddlewareOption {
+	return func(m *timeoutMiddleware) {
+		m.routeTimeouts[route] = timeout
+	}
+}
+
+// WithClientTimeoutHeader uses the timeout sent by the client in the given
+// header, e.g. Request-Timeout. The value is a number of seconds or a Go
+// duration (e.g. 500ms). The client can only shorten the timeout: its timeout
+// is capped to max and to the timeout of the route. The header is ignored if
+// max is lower or equal to 0.
+func WithClientTimeoutHeader(header string, max time.Duration) TimeoutMiddlewareOption {
+	return func(m *timeoutMiddleware) {
+		if max <= 0 {
+			return
+		}
+		m.clientTimeoutHeader = header
+		m.maxClientTimeout = max
+	}
+}
+
+// WithTimeoutStatusCode sets the status code of the timed out requests (503 by
+// default). 504 can be used by the services proxying requests to an upstream.
+func WithTimeoutStatusCode(statusCode int) TimeoutMiddlewareOption {
+	return func(m *timeoutMiddleware) {
+		m.statusCode = statusCode
+	}
+}
+
+// NewTimeoutMiddleware initializes a middleware canceling the context of the
+// requests after timeout. The handler runs in its own goroutine. If it did not
+// write anything when the deadline passes, a *TimeoutError is returned and
+// rendered by the ErrorMiddleware, the subsequent writes of the handler failing
+// with http.ErrHandlerTimeout. If the handler already started writing the
+// response, the middleware waits for it to return. If the client closes the
+// connection first, a ClientClosedRequestError (499) is returned.
+func NewTimeoutMiddleware(timeout time.Duration, options ...TimeoutMiddlewareOption) Middleware {
+	m := &timeoutMiddleware{
+		timeout:       timeout,
+		routeTimeouts: map[string]time.Duration{},
+		statusCode:    http.StatusServiceUnavailable,
+	}
+	for _, opt := range options {
+		opt(m)
+	}
+	return m
+}
+
+func (m *timeoutMiddleware) Apply(next HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		timeout := m.requestTimeout(r)
+		if timeout <= 0 {
+			return next(w, r, vars)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{w: w, header: w.Header().Clone()}
+		done := make(chan error, 1)
+		panics := &handlerPanics{ch: make(chan handlerPanic, 1)}
+		go func() {
+			defer func() {
+				if rec := recover(); rec != nil {
+					panics.report(ctx, handlerPanic{value: rec, stack: debug.Stack()})
+				}
+			}()
+			done <- next(tw, r, vars)
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil && errors.Is(err, context.DeadlineExceeded) && tw.timeout() {
+				return m.timeoutError(ctx, timeout)
+			}
+			tw.copyHeader()
+			return err
+		case p := <-panics.ch:
+			// Let the ErrorMiddleware recover the panic
+			panic(p.value)
+		case <-ctx.Done():
+		}
+
+		if !tw.timeout() {
+			// The response is being written, it cannot be replaced by an error
+			select {
+			case err := <-done:
+				tw.copyHeader()
+				return err
+			case p := <-panics.ch:
+				panic(p.value)
+			}
+		}
+		// The handler keeps running after the middleware returned, its panics
+		// can only be logged
+		panics.abandon(ctx)
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// The client is gone, this is not an error of the service
+			return ClientClosedRequestError{}
+		}
+		return m.timeoutError(ctx, timeout)
+	}
+}
+
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// handlerPanics forwards the panic of the handler goroutine to the middleware,
+// or logs it once the middleware returned
+type handlerPanics struct {
+	mutex     sync.Mutex
+	ch        chan handlerPanic
+	abandoned bool
+}
+
+func (p *handlerPanics) report(ctx context.Context, hp handlerPanic) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.abandoned {
+		logHandlerPanic(ctx, hp)
+		return
+	}
+	p.ch <- hp
+}
+
+// abandon stops forwarding the panics, the panic already reported is logged
+func (p *handlerPanics) abandon(ctx context.Context) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.abandoned = true
+	select {
+	case hp := <-p.ch:
+		logHandlerPanic(ctx, hp)
+	default:
+	}
+}
+
+func logHandlerPanic(ctx context.Context, hp handlerPanic) {
+	logger.Get(ctx).WithFields(logrus.Fields{
+		"panic": fmt.Sprint(hp.value),
+		"stack": string(hp.stack),
+	}).Error("Recover panic of a timed out handler")
+}
+
+func (m *timeoutMiddleware) timeoutError(ctx context.Context, timeout time.Duration) error {
+	logger.Get(ctx).WithField("timeout", timeout.Seconds()).Info("Request timed out")
+	return &TimeoutError{Timeout: timeout, statusCode: m.statusCode}
+}
+
+func (m *timeoutMiddleware) requestTimeout(r *http.Request) time.Duration {
+	timeout := m.routeTimeout(r)
+	if m.clientTimeoutHeader == "" {
+		return timeout
+	}
+	clientTimeout, ok := parseClientTimeout(r.Header.Get(m.clientTimeoutHeader))
+	if !ok {
+		return timeout
+	}
+	clientTimeout = min(clientTimeout, m.maxClientTimeout)
+	if timeout > 0 && timeout < clientTimeout {
+		return timeout
+	}
+	return clientTimeout
+}
+
+func (m *timeoutMiddleware) routeTimeout(r *http.Request) time.Duration {
+	if len(m.routeTimeouts) == 0 {
+		return m.timeout
+	}
+	template, name := currentRoute(r)
+	if timeout, ok := m.routeTimeouts[template]; ok && template != "" {
+		return timeout
+	}
+	if timeout, ok := m.routeTimeouts[name]; ok && name != "" {
+		return timeout
+	}
+	return m.timeout
+}
+
+// parseClientTimeout parses a number of seconds or a Go duration
+func parseClientTimeout(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		if seconds <= 0 {
+			return 0, false
+		}
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, false
+	}
+	return timeout, true
+}
+
+// timeoutWriter is the ResponseWriter of the handler goroutine. Once the
+// request timed out, the writes are discarded so that they do not race with the
+// error response. The handler has its own header map for the same reason.
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	mutex       sync.Mutex
+	timedOut    bool
+	wroteHeader bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(statusCode int) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.writeHeader(statusCode)
+}
+
+func (tw *timeoutWriter) writeHeader(statusCode int) {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	tw.copyHeaderLocked()
+	tw.w.WriteHeader(statusCode)
+}
+
+// copyHeader copies the headers set by the handler if it returned without
+// writing anything
+func (tw *timeoutWriter) copyHeader() {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if !tw.wroteHeader {
+		tw.copyHeaderLocked()
+	}
+}
+
+func (tw *timeoutWriter) copyHeaderLocked() {
+	header := tw.w.Header()
+	for name := range header {
+		if _, ok := tw.header[name]; !ok {
+			header.Del(name)
+		}
+	}
+	for name, values := range tw.header {
+		header[name] = values
+	}
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeader(http.StatusOK)
+	return tw.w.Write(b)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.writeHeader(http.StatusOK)
+	if flusher, ok := tw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// timeout marks the writer as timed out and returns true if the handler did not
+// write anything yet
+func (tw *timeoutWriter) timeout() bool {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if tw.wroteHeader {
+		return false
+	}
+	tw.timedOut = true
+	return true
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTimeoutMiddleware(t *testing.T) {
+	lateWrites := make(chan error, 1)
+	slowHandler := func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		<-r.Context().Done()
+		// Give the middleware the time to answer before writing
+		time.Sleep(10 * time.Millisecond)
+		w.Header().Set("X-Late", "true")
+		_, err := io.WriteString(w, "late")
+		lateWrites <- err
+		return nil
+	}
+	fastHandler := func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		w.Header().Set("X-Handler", "true")
+		_, err := io.WriteString(w, "fast")
+		return err
+	}
+
+	examples := map[string]struct {
+		options            []TimeoutMiddlewareOption
+		handler            HandlerFunc
+		path               string
+		headers            map[string]string
+		expectedStatusCode int
+		expectedBody       string
+		expectedLateWrite  bool
+	}{
+		"it should serve a request completing before the timeout": {
+			handler:            fastHandler,
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "fast",
+		},
+		"it should answer 503 when the deadline passes": {
+			handler:            slowHandler,
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedBody:       "request timed out after 20ms\n",
+			expectedLateWrite:  true,
+		},
+		"it should use the configured status code": {
+			options:            []TimeoutMiddlewareOption{WithTimeoutStatusCode(http.StatusGatewayTimeout)},
+			handler:            slowHandler,
+			expectedStatusCode: http.StatusGatewayTimeout,
+			expectedBody:       "request timed out after 20ms\n",
+			expectedLateWrite:  true,
+		},
+		"it should answer 503 if the handler returns the context error": {
+			handler: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				<-r.Context().Done()
+				return r.Context().Err()
+			},
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedBody:       "request timed out after 20ms\n",
+		},
+		"it should wait for a handler which started writing the response": {
+			handler: func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+				_, _ = io.WriteString(w, "started ")
+				<-r.Context().Done()
+				_, err := io.WriteString(w, "and completed")
+				return err
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "started and completed",
+		},
+		"it should use the timeout of the route": {
+			options:            []TimeoutMiddlewareOption{WithRouteTimeout("/apps/{app}/exports", 5*time.Millisecond)},
+			handler:            slowHandler,
+			path:               "/apps/my-app/exports",
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedBody:       "request timed out after 5ms\n",
+			expectedLateWrite:  true,
+		},
+		"it should use the timeout sent by the client": {
+			options:            []TimeoutMiddlewareOption{WithClientTimeoutHeader("Request-Timeout", time.Second)},
+			handler:            slowHandler,
+			headers:            map[string]string{"Request-Timeout": "10ms"},
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedBody:       "request timed out after 10ms\n",
+			expectedLateWrite:  true,
+		},
+		"it should cap the timeout sent by the client": {
+			options:            []TimeoutMiddlewareOption{WithClientTimeoutHeader("Request-Timeout", 15*time.Millisecond)},
+			handler:            slowHandler,
+			headers:            map[string]string{"Request-Timeout": "3600"},
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedBody:       "request timed out after 15ms\n",
+			expectedLateWrite:  true,
+		},
+		"it should not let the client raise the timeout of the route": {
+			options:            []TimeoutMiddlewareOption{WithClientTimeoutHeader("Request-Timeout", time.Hour)},
+			handler:            slowHandler,
+			headers:            map[string]string{"Request-Timeout": "3600"},
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedBody:       "request timed out after 20ms\n",
+			expectedLateWrite:  true,
+		},
+		"it should ignore the timeout sent by the client without maximum": {
+			options:            []TimeoutMiddlewareOption{WithClientTimeoutHeader("Request-Timeout", 0)},
+			handler:            slowHandler,
+			headers:            map[string]string{"Request-Timeout": "10ms"},
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedBody:       "request timed out after 20ms\n",
+			expectedLateWrite:  true,
+		},
+		"it should ignore an invalid timeout sent by the client": {
+			options:            []TimeoutMiddlewareOption{WithClientTimeoutHeader("Request-Timeout", time.Second)},
+			handler:            slowHandler,
+			headers:            map[string]string{"Request-Timeout": "-1"},
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedBody:       "request timed out after 20ms\n",
+			expectedLateWrite:  true,
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			log, _ := test.NewNullLogger()
+			router := NewRouter(log, WithoutOtelInstrumentation())
+			router.Use(ErrorMiddleware)
+			router.Use(NewTimeoutMiddleware(20*time.Millisecond, example.options...))
+			router.HandleFunc("/apps", example.handler)
+			router.HandleFunc("/apps/{app}/exports", example.handler)
+
+			path := example.path
+			if path == "" {
+				path = "/apps"
+			}
+			r := httptest.NewRequest(http.MethodGet, path, nil)
+			for name, value := range example.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, example.expectedStatusCode, w.Code)
+			assert.Equal(t, example.expectedBody, w.Body.String())
+			assert.NotEmpty(t, w.Header().Get("X-Request-ID"))
+			if example.expectedLateWrite {
+				select {
+				case err := <-lateWrites:
+					assert.ErrorIs(t, err, http.ErrHandlerTimeout)
+				case <-time.After(time.Second):
+					t.Fatal("the handler did not return")
+				}
+				assert.Empty(t, w.Header().Get("X-Late"))
+			}
+		})
+	}
+}
+
+func TestNewTimeoutMiddleware_Headers(t *testing.T) {
+	middleware := NewTimeoutMiddleware(time.Second)
+
+	t.Run("it should copy the headers of a handler returning without writing", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		w.Header().Set("X-Outer", "true")
+		handler := middleware.Apply(func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+			assert.Equal(t, "true", w.Header().Get("X-Outer"))
+			w.Header().Set("X-Handler", "true")
+			return nil
+		})
+		require.NoError(t, handler(w, httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{}))
+		assert.Equal(t, "true", w.Header().Get("X-Outer"))
+		assert.Equal(t, "true", w.Header().Get("X-Handler"))
+	})
+
+	t.Run("it should let the error middleware recover the panics", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler := ErrorMiddleware.Apply(middleware.Apply(func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+			panic("biniou")
+		}))
+		_ = handler(w, httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{})
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+	})
+}
+
+func TestNewTimeoutMiddleware_ClientClosedRequest(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	router := NewRouter(log, WithoutOtelInstrumentation())
+	router.Use(ErrorMiddleware)
+	router.Use(NewTimeoutMiddleware(time.Second))
+	started := make(chan struct{})
+	router.HandleFunc("/apps", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		close(started)
+		<-r.Context().Done()
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/apps", nil).WithContext(ctx))
+
+	assert.Equal(t, 499, w.Code)
+	require.NotEmpty(t, hook.AllEntries())
+	for _, entry := range hook.AllEntries() {
+		// The disconnection of a client is not an error of the service
+		assert.Greater(t, entry.Level, logrus.ErrorLevel, entry.Message)
+	}
+}
+
+func TestNewTimeoutMiddleware_LatePanic(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	router := NewRouter(log, WithoutOtelInstrumentation())
+	router.Use(ErrorMiddleware)
+	router.Use(NewTimeoutMiddleware(10 * time.Millisecond))
+	router.HandleFunc("/apps", func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		<-r.Context().Done()
+		time.Sleep(10 * time.Millisecond)
+		panic("biniou")
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/apps", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	require.Eventually(t, func() bool {
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "Recover panic of a timed out handler" {
+				return entry.Data["panic"] == "biniou" && entry.Level == logrus.ErrorLevel
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond)
+}